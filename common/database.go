@@ -0,0 +1,101 @@
+package common
+
+import (
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/config"
+	"github.com/DuanNengxin/wepass-pod/migration"
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// 支持的数据库驱动，没有配置时使用 mysql
+const (
+	DriverMysql    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSqlite   = "sqlite"
+)
+
+var db *gorm.DB
+
+func InitDatabase(migrate bool) *gorm.DB {
+	driver := DriverMysql
+	if databaseConfig := config.Config().Database; databaseConfig != nil && databaseConfig.Driver != "" {
+		driver = databaseConfig.Driver
+	}
+	dialector, err := NewDialector(driver)
+	if err != nil {
+		panic(err)
+	}
+	db, err = OpenDatabase(dialector)
+	if err != nil {
+		panic(err)
+	}
+
+	if migrate {
+		if err := migration.NewMigrator(db).Up(); err != nil {
+			panic(err)
+		}
+	}
+	return db
+}
+
+// NewDialector 根据配置文件中对应驱动的配置生成 gorm 的 Dialector
+func NewDialector(driver string) (gorm.Dialector, error) {
+	switch driver {
+	case DriverMysql:
+		mysqlConfig := config.Config().Mysql
+		return mysql.Open(fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=%s&parseTime=true&loc=Local",
+			mysqlConfig.Username, mysqlConfig.Password, mysqlConfig.Host, mysqlConfig.Port, mysqlConfig.DB, "utf8mb4")), nil
+	case DriverPostgres:
+		postgresConfig := config.Config().Postgres
+		if postgresConfig == nil {
+			return nil, fmt.Errorf("postgres config not found")
+		}
+		sslMode := postgresConfig.SSLMode
+		if sslMode == "" {
+			sslMode = "disable"
+		}
+		return postgres.Open(fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+			postgresConfig.Host, postgresConfig.Port, postgresConfig.Username, postgresConfig.Password, postgresConfig.DB, sslMode)), nil
+	case DriverSqlite:
+		sqliteConfig := config.Config().Sqlite
+		if sqliteConfig == nil || sqliteConfig.Path == "" {
+			return nil, fmt.Errorf("sqlite path not found")
+		}
+		return SqliteDialector(sqliteConfig.Path), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %s", driver)
+	}
+}
+
+// SqliteDialector 纯 go 实现的 sqlite，打开外键约束并在锁冲突时等待，path 为 ":memory:" 时使用内存数据库
+func SqliteDialector(path string) gorm.Dialector {
+	return sqlite.Open(path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+}
+
+func OpenDatabase(dialector gorm.Dialector) (*gorm.DB, error) {
+	// 把唯一索引冲突等错误转换成 gorm.ErrDuplicatedKey，和具体的数据库无关
+	database, err := gorm.Open(dialector, &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+	// sqlite 同一时间只能有一个写连接，也保证内存数据库在所有查询之间共享
+	if dialector.Name() == DriverSqlite {
+		pool, err := database.DB()
+		if err != nil {
+			return nil, err
+		}
+		pool.SetMaxOpenConns(1)
+	}
+	return database, nil
+}
+
+func CloseDatabase() error {
+	pool, err := db.DB()
+	if err != nil {
+		panic(err)
+	}
+	return pool.Close()
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	microErrors "github.com/asim/go-micro/v3/errors"
+	"gorm.io/gorm"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+)
+
+// ServiceName 返回给调用方的 go-micro 错误中的 id
+const ServiceName = "go.micro.service.pod"
+
+// ErrorCode 调用方根据错误码区分错误类型，不要依赖错误信息
+type ErrorCode string
+
+const (
+	CodeNotFound         ErrorCode = "NOT_FOUND"
+	CodeInvalidArgument  ErrorCode = "INVALID_ARGUMENT"
+	CodeAlreadyExists    ErrorCode = "ALREADY_EXISTS"
+	CodeConflict         ErrorCode = "CONFLICT"
+	CodeUnavailable      ErrorCode = "UNAVAILABLE"
+	CodePermissionDenied ErrorCode = "PERMISSION_DENIED"
+	CodeInternal         ErrorCode = "INTERNAL"
+)
+
+// CodePreconditionRequired 修改时没有带版本号，对应 http 428
+const CodePreconditionRequired ErrorCode = "PRECONDITION_REQUIRED"
+
+// CodeMethodNotAllowed 网关中路径存在但是不支持这个 http 方法，对应 http 405
+const CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+
+// httpStatus go-micro 的错误码使用 http 状态码
+var httpStatus = map[ErrorCode]int32{
+	CodeNotFound:         http.StatusNotFound,
+	CodeInvalidArgument:  http.StatusBadRequest,
+	CodeAlreadyExists:    http.StatusConflict,
+	CodeConflict:         http.StatusConflict,
+	CodeUnavailable:      http.StatusServiceUnavailable,
+	CodePermissionDenied: http.StatusForbidden,
+	CodeInternal:         http.StatusInternalServerError,
+
+	CodePreconditionRequired: http.StatusPreconditionRequired,
+	CodeMethodNotAllowed:     http.StatusMethodNotAllowed,
+}
+
+// FieldViolation 请求中某个字段的错误，field 是 PodInfo 中的字段路径，比如 pod_port[0].container_port
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// Error 带错误码的错误，序列化成 json 放在 go-micro 错误的 detail 中
+type Error struct {
+	Code    ErrorCode        `json:"code"`
+	Message string           `json:"message"`
+	Fields  []FieldViolation `json:"fields,omitempty"`
+	// 附加信息，比如版本冲突时的 current_version
+	Metadata map[string]string `json:"metadata,omitempty"`
+	cause    error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// WithField 添加字段错误，返回自身方便链式调用
+func (e *Error) WithField(field, description string) *Error {
+	e.Fields = append(e.Fields, FieldViolation{Field: field, Description: description})
+	return e
+}
+
+func (e *Error) WithMetadata(key, value string) *Error {
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata[key] = value
+	return e
+}
+
+func newError(code ErrorCode, cause error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), cause: cause}
+}
+
+func NotFound(format string, args ...interface{}) *Error {
+	return newError(CodeNotFound, nil, format, args...)
+}
+
+func InvalidArgument(format string, args ...interface{}) *Error {
+	return newError(CodeInvalidArgument, nil, format, args...)
+}
+
+func AlreadyExists(format string, args ...interface{}) *Error {
+	return newError(CodeAlreadyExists, nil, format, args...)
+}
+
+func Conflict(format string, args ...interface{}) *Error {
+	return newError(CodeConflict, nil, format, args...)
+}
+
+func PreconditionRequired(format string, args ...interface{}) *Error {
+	return newError(CodePreconditionRequired, nil, format, args...)
+}
+
+func MethodNotAllowed(format string, args ...interface{}) *Error {
+	return newError(CodeMethodNotAllowed, nil, format, args...)
+}
+
+func Unavailable(format string, args ...interface{}) *Error {
+	return newError(CodeUnavailable, nil, format, args...)
+}
+
+func PermissionDenied(format string, args ...interface{}) *Error {
+	return newError(CodePermissionDenied, nil, format, args...)
+}
+
+// Wrap 用指定的错误码包装 err，errors.Is 和 errors.As 仍然可以找到 err
+func Wrap(code ErrorCode, err error) *Error {
+	return newError(code, err, "%s", err.Error())
+}
+
+// FromError 把数据库、k8s 和 model 中的错误转换成 Error，不认识的错误是 CodeInternal
+func FromError(err error) *Error {
+	var typed *Error
+	if errors.As(err, &typed) {
+		return typed
+	}
+	var existsErr *model.AlreadyExistsError
+	if errors.As(err, &existsErr) {
+		return Wrap(CodeAlreadyExists, err).WithMetadata("kind", existsErr.Kind).
+			WithMetadata("cluster", existsErr.Cluster).WithMetadata("namespace", existsErr.Namespace).
+			WithMetadata("name", existsErr.Name)
+	}
+	var conflictErr *model.ConflictError
+	if errors.As(err, &conflictErr) {
+		return Wrap(CodeConflict, err).WithMetadata("kind", conflictErr.Kind).
+			WithMetadata("name", conflictErr.Name).WithMetadata("current_version", conflictErr.CurrentVersion)
+	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return Wrap(CodeNotFound, err)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return Wrap(CodeAlreadyExists, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return Wrap(CodeUnavailable, err)
+	}
+	var statusErr k8serrors.APIStatus
+	if errors.As(err, &statusErr) {
+		return fromStatus(err, statusErr.Status())
+	}
+	return Wrap(CodeInternal, err)
+}
+
+// fromStatus 按 k8s 返回的 reason 转换，Invalid 的每个 cause 转换成字段错误
+func fromStatus(err error, status metav1.Status) *Error {
+	var typed *Error
+	switch status.Reason {
+	case metav1.StatusReasonNotFound, metav1.StatusReasonGone:
+		typed = Wrap(CodeNotFound, err)
+	case metav1.StatusReasonAlreadyExists:
+		typed = Wrap(CodeAlreadyExists, err)
+	case metav1.StatusReasonConflict:
+		typed = Wrap(CodeConflict, err)
+	case metav1.StatusReasonInvalid, metav1.StatusReasonBadRequest, metav1.StatusReasonRequestEntityTooLarge:
+		typed = Wrap(CodeInvalidArgument, err)
+	case metav1.StatusReasonForbidden, metav1.StatusReasonUnauthorized:
+		typed = Wrap(CodePermissionDenied, err)
+	case metav1.StatusReasonServerTimeout, metav1.StatusReasonTimeout, metav1.StatusReasonTooManyRequests,
+		metav1.StatusReasonServiceUnavailable:
+		typed = Wrap(CodeUnavailable, err)
+	default:
+		typed = Wrap(CodeInternal, err)
+	}
+	if status.Details != nil {
+		for _, cause := range status.Details.Causes {
+			if cause.Field != "" {
+				typed.WithField(cause.Field, cause.Message)
+			}
+		}
+	}
+	return typed
+}
+
+// MicroError 转换成返回给调用方的 go-micro 错误，detail 是 Error 的 json
+func MicroError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var microErr *microErrors.Error
+	if errors.As(err, &microErr) {
+		return microErr
+	}
+	typed := FromError(err)
+	detail, marshalErr := json.Marshal(typed)
+	if marshalErr != nil {
+		detail = []byte(typed.Message)
+	}
+	return &microErrors.Error{
+		Id:     ServiceName,
+		Code:   httpStatus[typed.Code],
+		Detail: string(detail),
+		Status: http.StatusText(int(httpStatus[typed.Code])),
+	}
+}
+
+// ParseMicroError 从 go-micro 错误中解析出 Error，detail 不是 Error 的 json 时按错误码推断
+func ParseMicroError(err error) *Error {
+	microErr := microErrors.FromError(err)
+	typed := &Error{}
+	if json.Unmarshal([]byte(microErr.Detail), typed) == nil && typed.Code != "" {
+		return typed
+	}
+	typed.Message = microErr.Detail
+	typed.Code = CodeInternal
+	for code, status := range httpStatus {
+		// 409 同时对应 AlreadyExists 和 Conflict，按 Conflict 处理
+		if status == microErr.Code && code != CodeAlreadyExists {
+			typed.Code = code
+		}
+	}
+	return typed
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/config"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net"
+	"time"
+)
+
+// InitMongo 连接配置文件中的 mongodb，没有配置或者连接失败时返回错误
+func InitMongo() (*mongo.Database, error) {
+	mongoConfig := config.Config().MongoDB
+	if mongoConfig == nil || mongoConfig.Host == "" {
+		return nil, fmt.Errorf("mongodb config not found")
+	}
+	port := mongoConfig.Port
+	if port == "" {
+		port = "27017"
+	}
+	clientOptions := options.Client().ApplyURI("mongodb://" + net.JoinHostPort(mongoConfig.Host, port))
+	if mongoConfig.Username != "" {
+		clientOptions.SetAuth(options.Credential{Username: mongoConfig.Username, Password: mongoConfig.Password})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client.Database(mongoConfig.DB), nil
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"context"
+	"github.com/DuanNengxin/wepass-pod/config"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"time"
+)
+
+// InitRedis 没有配置 redis 或者连接失败时返回 nil，调用方使用内存缓存
+func InitRedis() *redis.Client {
+	redisConfig := config.Config().Redis
+	if redisConfig == nil || redisConfig.Host == "" {
+		return nil
+	}
+	port := redisConfig.Port
+	if port == "" {
+		port = "6379"
+	}
+	db, _ := strconv.Atoi(redisConfig.DB)
+	client := redis.NewClient(&redis.Options{
+		Addr:     net.JoinHostPort(redisConfig.Host, port),
+		Username: redisConfig.Username,
+		Password: redisConfig.Password,
+		DB:       db,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		zap.S().Warnf("connect redis %s error %s, use memory cache", client.Options().Addr, err.Error())
+		_ = client.Close()
+		return nil
+	}
+	return client
+}
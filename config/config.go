@@ -8,11 +8,20 @@ import (
 )
 
 type config struct {
-	Mysql   *Mysql        `yaml:"mysql"`
-	Redis   *Redis        `yaml:"redis"`
-	MongoDB *MongoDB      `yaml:"mongoDB"`
-	Consul  *ConsulConfig `yaml:"consul"`
-	Tracer  *TracerConfig `yaml:"tracer"`
+	Database  *DatabaseConfig  `yaml:"database"`
+	Mysql     *Mysql           `yaml:"mysql"`
+	Postgres  *Postgres        `yaml:"postgres"`
+	Sqlite    *Sqlite          `yaml:"sqlite"`
+	Redis     *Redis           `yaml:"redis"`
+	MongoDB   *MongoDB         `yaml:"mongoDB"`
+	Consul    *ConsulConfig    `yaml:"consul"`
+	Tracer    *TracerConfig    `yaml:"tracer"`
+	Reconcile *ReconcileConfig `yaml:"reconcile"`
+	Retention *RetentionConfig `yaml:"retention"`
+	Operation *OperationConfig `yaml:"operation"`
+	Cache     *CacheConfig     `yaml:"cache"`
+	History   *HistoryConfig   `yaml:"history"`
+	Gateway   *GatewayConfig   `yaml:"gateway"`
 }
 
 type Mysql struct {
@@ -26,8 +35,28 @@ type Mysql struct {
 	MaxIdleConn int    `yaml:"max_idle_conn"`
 }
 
+type DatabaseConfig struct {
+	// mysql、postgres 或者 sqlite，为空时使用 mysql
+	Driver string `yaml:"driver"`
+}
+
+type Postgres struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       string `yaml:"db"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+type Sqlite struct {
+	// 数据库文件路径
+	Path string `yaml:"path"`
+}
+
 type MongoDB struct {
 	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	DB       string `yaml:"db"`
@@ -35,6 +64,7 @@ type MongoDB struct {
 
 type Redis struct {
 	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	DB       string `yaml:"db"`
@@ -50,6 +80,44 @@ type TracerConfig struct {
 	Port string `yaml:"port"`
 }
 
+type ReconcileConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 对账间隔，单位秒
+	Interval int `yaml:"interval"`
+}
+
+type RetentionConfig struct {
+	// 软删除的 pod 保留天数，超过后彻底删除，0 表示不清理
+	Days int `yaml:"days"`
+	// 清理间隔，单位秒
+	Interval int `yaml:"interval"`
+}
+
+type OperationConfig struct {
+	// worker 检查待执行操作的间隔，单位秒
+	Interval int `yaml:"interval"`
+	// 最多尝试次数，超过后补偿
+	Attempts int `yaml:"attempts"`
+}
+
+type CacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 缓存过期时间，单位秒
+	TTL int `yaml:"ttl"`
+}
+
+type HistoryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// 每种历史记录的保留天数，key 是记录类型，没有配置或者为 0 时永久保留
+	TTL map[string]int `yaml:"ttl"`
+}
+
+type GatewayConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// REST 接口监听的端口
+	Port int `yaml:"port"`
+}
+
 var c config
 
 func ParseConfig() {
@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// AuditLog 记录每一次修改 pod 的请求
+type AuditLog struct {
+	ID int64 `gorm:"primary_key;not_null;auto_increment" json:"id"`
+	// 调用方，从 go-micro metadata 中获取
+	Actor        string `gorm:"size:191" json:"actor"`
+	RPC          string `gorm:"size:64" json:"rpc"`
+	PodID        int64  `gorm:"index" json:"pod_id"`
+	PodName      string `json:"pod_name"`
+	PodNamespace string `json:"pod_namespace"`
+	PodTeamID    string `gorm:"index;size:191" json:"pod_team_id"`
+	// 修改前后的 pod，json 格式
+	Before string `gorm:"type:text" json:"before"`
+	After  string `gorm:"type:text" json:"after"`
+	// 发生变化的字段，格式为 {"字段": {"before": 旧值, "after": 新值}}
+	Diff       string    `gorm:"type:text" json:"diff"`
+	K8sOutcome string    `gorm:"type:text" json:"k8s_outcome"`
+	Error      string    `gorm:"type:text" json:"error"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+// AuditFilter QueryAudit 的查询条件，字段为空时不过滤
+type AuditFilter struct {
+	PodTeamID string
+	PodID     int64
+	Start     time.Time
+	End       time.Time
+	Limit     int
+}
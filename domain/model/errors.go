@@ -0,0 +1,27 @@
+package model
+
+import "fmt"
+
+// ConflictError 更新时版本号和当前版本不一致，说明数据已经被别人修改过
+type ConflictError struct {
+	// pod 或者 deployment
+	Kind           string
+	Name           string
+	CurrentVersion string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s has been modified, current version is %s", e.Kind, e.Name, e.CurrentVersion)
+}
+
+// AlreadyExistsError 同一个集群和命名空间下已经有同名的 pod
+type AlreadyExistsError struct {
+	Kind      string
+	Cluster   string
+	Namespace string
+	Name      string
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%s %s already exists in namespace %s of cluster %s", e.Kind, e.Name, e.Namespace, e.Cluster)
+}
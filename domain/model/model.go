@@ -1,5 +1,32 @@
 package model
 
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// DefaultCluster 没有指定集群时使用的集群名称
+const DefaultCluster = "default"
+
+func ClusterOrDefault(cluster string) string {
+	if cluster == "" {
+		return DefaultCluster
+	}
+	return cluster
+}
+
+// SupportedClusters 目前只有一个 k8s client，其他集群的 pod 会应用到同一个集群上互相覆盖，支持多集群之前只允许 default
+var SupportedClusters = []string{DefaultCluster}
+
+func IsSupportedCluster(cluster string) bool {
+	for _, supported := range SupportedClusters {
+		if ClusterOrDefault(cluster) == supported {
+			return true
+		}
+	}
+	return false
+}
+
 // Pod 的状态
 //挂起（Pending）：Pod 已被 Kubernetes 系统接受，但有一个或者多个容器镜像尚未创建。等待时间包括调度 Pod 的时间和通过网络下载镜像的时间，这可能需要花点时间。
 //运行中（Running）：该 Pod 已经绑定到了一个节点上，Pod 中所有的容器都已被创建。至少有一个容器正在运行，或者正处于启动或重启状态。
@@ -7,11 +34,13 @@ package model
 //失败（Failed）：Pod 中的所有容器都已终止了，并且至少有一个容器是因为失败终止。也就是说，容器以非0状态退出或者被系统终止。
 //未知（Unknown）：因为某些原因无法取得 Pod 的状态，通常是因为与 Pod 所在主机通信失败。
 type Pod struct {
-	ID           int64  `gorm:"primary_key;not_null;auto_increment" json:"id"`
-	PodName      string `gorm:"unique_index;not_null" json:"pod_name"`
-	PodNamespace string `json:"pod_namespace"`
+	ID int64 `gorm:"primary_key;not_null;auto_increment" json:"id"`
+	// k8s 的名称只在命名空间内唯一，pod 用 (集群, 命名空间, 名称) 标识
+	PodCluster   string `gorm:"uniqueIndex:idx_pod_identity,priority:1;size:191;not null;default:default" json:"pod_cluster"`
+	PodNamespace string `gorm:"uniqueIndex:idx_pod_identity,priority:2;size:191" json:"pod_namespace"`
+	PodName      string `gorm:"uniqueIndex:idx_pod_identity,priority:3;size:191;not null" json:"pod_name"`
 	// 团队名称或者项目名称(用名称最好不用id)
-	PodTeamID int64 `json:"pod_team_id"`
+	PodTeamID string `gorm:"index" json:"pod_team_id"`
 	// pod 使用最大cpu
 	PodCpuMax   float32 `json:"pod_cpu_max"`
 	PodCpuMin   float32 `json:"pod_cpu_min"`
@@ -23,6 +52,8 @@ type Pod struct {
 	PodPort []*PodPort `gorm:"foreignkey:PodID;delete:CASCADE" json:"pod_port"`
 	// pod 环境变量
 	PodEnv []*PodEnv `gorm:"foreignkey:PodID;delete:CASCADE" json:"pod_env"`
+	// pod 标签，会同步到 Deployment 上，FindAll 的 label selector 也按它过滤
+	PodLabel []*PodLabel `gorm:"foreignkey:PodID;delete:CASCADE" json:"pod_label"`
 	// 镜像拉去策略, always,ifnotpresent,never
 	PodPullPolicy string `gorm:"default:always" json:"pod_pull_policy"`
 	// pod 重启策略
@@ -44,6 +75,14 @@ type Pod struct {
 	PodType string `json:"pod_type"`
 	// 镜像名称+tag
 	PodImage string `json:"pod_image"`
+	// 乐观锁版本号，每次更新加一
+	Version int64 `gorm:"not null;default:1" json:"resource_version"`
+	// 创建时间，重名的 pod 按创建时间区分 k8s 事件，迁移之前创建的 pod 是 1970-01-01
+	CreatedAt time.Time `json:"created_at"`
+	// 软删除，回收站中的 pod 可以恢复，超过保留时间后才会真正删除
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	// 软删除时设置为自身的 id，没有删除时是 0，回收站中的同名 pod 不会违反唯一索引
+	DeletedID int64 `gorm:"uniqueIndex:idx_pod_identity,priority:4;not null;default:0" json:"-"`
 	// TODO 挂盘，域名设置
 }
 
@@ -61,3 +100,10 @@ type PodEnv struct {
 	EnvKey   string `json:"env_key"`
 	EnvValue string `json:"env_value"`
 }
+
+type PodLabel struct {
+	ID         int64  `gorm:"primary_key;not_null;auto_increment" json:"id"`
+	PodID      int64  `gorm:"index" json:"pod_id"`
+	LabelKey   string `gorm:"index:idx_pod_label,priority:1;size:317" json:"label_key"`
+	LabelValue string `gorm:"index:idx_pod_label,priority:2;size:63" json:"label_value"`
+}
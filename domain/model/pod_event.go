@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// PodEventRecord 持久化的 k8s Warning 事件，k8s 默认只保留一小时
+type PodEventRecord struct {
+	ID    int64 `gorm:"primary_key;not_null;auto_increment" json:"id"`
+	PodID int64 `gorm:"index;not_null" json:"pod_id"`
+	// k8s Event 的 uid，用于去重
+	EventUID       string    `gorm:"uniqueIndex;size:64;not_null" json:"event_uid"`
+	Type           string    `json:"type"`
+	Reason         string    `json:"reason"`
+	Message        string    `gorm:"type:text" json:"message"`
+	ObjectKind     string    `json:"object_kind"`
+	ObjectName     string    `json:"object_name"`
+	Count          int32     `json:"count"`
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+}
@@ -0,0 +1,24 @@
+package model
+
+// PodFilter FindPage 的查询条件，字段为空时不过滤
+type PodFilter struct {
+	PodCluster   string
+	PodNamespace string
+	PodTeamID    string
+	NamePrefix   string
+	// 镜像名称包含的字符串
+	Image string
+	// k8s label selector 语法，按 PodLabel 过滤
+	LabelSelector string
+	PageToken     string
+	PageSize      int
+	// id、-id、pod_name、-pod_name，默认 id
+	OrderBy string
+}
+
+// PodPage 分页查询结果
+type PodPage struct {
+	Pods          []*Pod
+	TotalCount    int64
+	NextPageToken string
+}
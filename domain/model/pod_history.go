@@ -0,0 +1,45 @@
+package model
+
+import "time"
+
+// pod 历史记录的类型，每种类型单独配置保留时间
+const (
+	HistorySpecChange = "spec_change"
+	HistoryK8sEvent   = "k8s_event"
+	// HistoryRollout 操作应用到 k8s 的结果
+	HistoryRollout   = "rollout"
+	HistoryReconcile = "reconcile"
+)
+
+// PodHistory 保存在 mongodb 中，只追加不修改，ExpireAt 之后由 TTL 索引删除
+type PodHistory struct {
+	ID string `bson:"_id,omitempty" json:"id"`
+	// k8s 事件只知道名称，PodID 为 0
+	PodID int64 `bson:"pod_id" json:"pod_id"`
+	// 之前的记录没有集群，按 default 处理
+	PodCluster   string `bson:"pod_cluster,omitempty" json:"pod_cluster"`
+	PodNamespace string `bson:"pod_namespace" json:"pod_namespace"`
+	PodName      string `bson:"pod_name" json:"pod_name"`
+	Type         string `bson:"type" json:"type"`
+	Reason       string `bson:"reason" json:"reason"`
+	Message      string `bson:"message" json:"message"`
+	// 不同类型的详细信息，json 格式
+	Detail    string    `bson:"detail,omitempty" json:"detail"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+	// 为空时永久保留
+	ExpireAt *time.Time `bson:"expire_at,omitempty" json:"-"`
+}
+
+// PodHistoryFilter GetPodHistory 的查询条件
+type PodHistoryFilter struct {
+	PodID        int64
+	PodCluster   string
+	PodNamespace string
+	PodName      string
+	// 按名称匹配的 k8s 事件只返回 [Since, Until) 之间的，重建的同名 pod 不会看到之前的事件，为空时不限制
+	Since time.Time
+	Until time.Time
+	// 为空时查询所有类型
+	Types []string
+	Limit int
+}
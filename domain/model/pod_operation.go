@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+const (
+	// OperationPending 等待 worker 执行，失败后重试时也会回到这个状态
+	OperationPending = "pending"
+	OperationRunning = "running"
+	OperationSucceed = "succeeded"
+	// OperationCompensated 重试多次仍然失败，数据库已经回滚到修改之前
+	OperationCompensated = "compensated"
+	// OperationFailed 补偿也失败了，需要人工处理
+	OperationFailed = "failed"
+)
+
+// PodOperation 待应用到 k8s 的操作，和 pod 的修改在同一个事务中写入
+type PodOperation struct {
+	ID     int64  `gorm:"primary_key;not_null;auto_increment" json:"id"`
+	PodID  int64  `gorm:"index" json:"pod_id"`
+	Type   string `gorm:"size:16" json:"type"`
+	Status string `gorm:"index:idx_operation_status,priority:1;size:16" json:"status"`
+	// 期望状态，model.Pod 的 json
+	Spec string `gorm:"type:text" json:"spec"`
+	// 修改之前的 pod，model.Pod 的 json，用于补偿
+	Previous  string    `gorm:"type:text" json:"previous"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `gorm:"type:text" json:"last_error"`
+	NextRunAt time.Time `gorm:"index:idx_operation_status,priority:2" json:"next_run_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Finished 操作是否已经结束，不会再被执行
+func (o *PodOperation) Finished() bool {
+	return o.Status == OperationSucceed || o.Status == OperationCompensated || o.Status == OperationFailed
+}
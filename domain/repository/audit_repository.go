@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/migration"
+	"gorm.io/gorm"
+)
+
+const defaultAuditLimit = 100
+
+type IAuditRepository interface {
+	InitTable() error
+	CreateAuditLog(log *model.AuditLog) error
+	FindAuditLogs(filter *model.AuditFilter) ([]*model.AuditLog, error)
+}
+
+type AuditRepository struct {
+	mysqlDb *gorm.DB
+}
+
+func NewAuditRepository(db *gorm.DB) IAuditRepository {
+	return &AuditRepository{mysqlDb: db}
+}
+
+func (a AuditRepository) InitTable() error {
+	return migration.NewMigrator(a.mysqlDb).Up()
+}
+
+func (a AuditRepository) CreateAuditLog(log *model.AuditLog) error {
+	return a.mysqlDb.Create(log).Error
+}
+
+func (a AuditRepository) FindAuditLogs(filter *model.AuditFilter) ([]*model.AuditLog, error) {
+	query := a.mysqlDb.Model(&model.AuditLog{})
+	if filter.PodTeamID != "" {
+		query = query.Where("pod_team_id = ?", filter.PodTeamID)
+	}
+	if filter.PodID != 0 {
+		query = query.Where("pod_id = ?", filter.PodID)
+	}
+	if !filter.Start.IsZero() {
+		query = query.Where("created_at >= ?", filter.Start)
+	}
+	if !filter.End.IsZero() {
+		query = query.Where("created_at < ?", filter.End)
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > maxPageSize {
+		limit = defaultAuditLimit
+	}
+	var logs []*model.AuditLog
+	if err := query.Order("created_at DESC").Order("id DESC").Limit(limit).Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
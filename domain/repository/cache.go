@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"sync"
+	"time"
+)
+
+// ICache 缓存的值都序列化成 json，调用方修改查询结果不会影响缓存
+type ICache interface {
+	// Get 没有命中时返回 false
+	Get(key string, value interface{}) (bool, error)
+	Set(key string, value interface{}, ttl time.Duration) error
+	Delete(keys ...string) error
+}
+
+type RedisCache struct {
+	client *redis.Client
+}
+
+func NewRedisCache(client *redis.Client) ICache {
+	return &RedisCache{client: client}
+}
+
+func (r RedisCache) Get(key string, value interface{}) (bool, error) {
+	data, err := r.client.Get(context.TODO(), key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func (r RedisCache) Set(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(context.TODO(), key, data, ttl).Err()
+}
+
+func (r RedisCache) Delete(keys ...string) error {
+	return r.client.Del(context.TODO(), keys...).Err()
+}
+
+type memoryEntry struct {
+	data     []byte
+	expireAt time.Time
+}
+
+// MemoryCache 只在当前进程内有效，多个实例之间靠过期时间保证最终一致
+type MemoryCache struct {
+	mu      sync.RWMutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryCache() ICache {
+	return &MemoryCache{entries: map[string]*memoryEntry{}}
+}
+
+func (m *MemoryCache) Get(key string, value interface{}) (bool, error) {
+	m.mu.RLock()
+	entry, ok := m.entries[key]
+	m.mu.RUnlock()
+	if !ok || time.Now().After(entry.expireAt) {
+		return false, nil
+	}
+	return true, json.Unmarshal(entry.data, value)
+}
+
+func (m *MemoryCache) Set(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 顺便清理已经过期的数据，避免 map 一直增长
+	now := time.Now()
+	for k, entry := range m.entries {
+		if now.After(entry.expireAt) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = &memoryEntry{data: data, expireAt: now.Add(ttl)}
+	return nil
+}
+
+func (m *MemoryCache) Delete(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
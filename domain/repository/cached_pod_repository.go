@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+const (
+	podGenerationCacheKey = "wepass-pod:generation"
+	// generation 比缓存的数据保存得更久，过期之后所有缓存都会失效
+	podGenerationTTL = 24 * time.Hour
+)
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wepass_pod_cache_requests_total",
+	Help: "pod 缓存的查询次数",
+}, []string{"cache", "result"})
+
+// CachedPodRepository 缓存 FindPodByID、FindAll 和 FindPage，其他查询直接访问数据库
+// 缓存的 key 带有 generation，修改 pod 的方法写入之后换一个新的 generation，之前缓存的数据都不会再被读到
+// 查询数据库之前先取 generation，查询期间有写入时结果写到旧的 generation 下，不会覆盖新的数据
+// 缓存出错时退回到数据库
+type CachedPodRepository struct {
+	IPodRepository
+	cache ICache
+	ttl   time.Duration
+}
+
+func NewCachedPodRepository(podRepository IPodRepository, cache ICache, ttl time.Duration) IPodRepository {
+	return &CachedPodRepository{
+		IPodRepository: podRepository,
+		cache:          cache,
+		ttl:            ttl,
+	}
+}
+
+func (c CachedPodRepository) FindPodByID(id int64) (*model.Pod, error) {
+	generation, ok := c.generation()
+	if !ok {
+		return c.IPodRepository.FindPodByID(id)
+	}
+	key := podCacheKey(generation, "pod:"+strconv.FormatInt(id, 10))
+	pod := &model.Pod{}
+	if c.get("pod", key, pod) {
+		return pod, nil
+	}
+	pod, err := c.IPodRepository.FindPodByID(id)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, pod)
+	return pod, nil
+}
+
+func (c CachedPodRepository) FindAll() ([]*model.Pod, error) {
+	generation, ok := c.generation()
+	if !ok {
+		return c.IPodRepository.FindAll()
+	}
+	key := podCacheKey(generation, "pods:all")
+	var pods []*model.Pod
+	if c.get("pods", key, &pods) {
+		return pods, nil
+	}
+	pods, err := c.IPodRepository.FindAll()
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, pods)
+	return pods, nil
+}
+
+func (c CachedPodRepository) FindPage(filter *model.PodFilter) (*model.PodPage, error) {
+	generation, ok := c.generation()
+	if !ok {
+		return c.IPodRepository.FindPage(filter)
+	}
+	key := podCacheKey(generation, "page:"+podFilterKey(filter))
+	page := &model.PodPage{}
+	if c.get("page", key, page) {
+		return page, nil
+	}
+	page, err := c.IPodRepository.FindPage(filter)
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, page)
+	return page, nil
+}
+
+func (c CachedPodRepository) CreatePod(pod *model.Pod) (int64, error) {
+	id, err := c.IPodRepository.CreatePod(pod)
+	c.invalidate()
+	return id, err
+}
+
+func (c CachedPodRepository) DeletePod(id int64) error {
+	err := c.IPodRepository.DeletePod(id)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) UpdatePod(pod *model.Pod) error {
+	err := c.IPodRepository.UpdatePod(pod)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) RestorePod(id int64) error {
+	err := c.IPodRepository.RestorePod(id)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) PurgeDeletedPods(before time.Time) (int64, error) {
+	purged, err := c.IPodRepository.PurgeDeletedPods(before)
+	c.invalidate()
+	return purged, err
+}
+
+func (c CachedPodRepository) CreatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error {
+	err := c.IPodRepository.CreatePodWithOperation(pod, operation)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) UpdatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error {
+	err := c.IPodRepository.UpdatePodWithOperation(pod, operation)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) DeletePodWithOperation(id int64, operation *model.PodOperation) error {
+	err := c.IPodRepository.DeletePodWithOperation(id, operation)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) RestorePodWithOperation(id int64, operation *model.PodOperation) error {
+	err := c.IPodRepository.RestorePodWithOperation(id, operation)
+	c.invalidate()
+	return err
+}
+
+func (c CachedPodRepository) get(cache, key string, value interface{}) bool {
+	hit, err := c.cache.Get(key, value)
+	if err != nil {
+		zap.S().Errorf("get cache %s error %s", key, err.Error())
+	}
+	if hit && err == nil {
+		cacheRequests.WithLabelValues(cache, "hit").Inc()
+		return true
+	}
+	cacheRequests.WithLabelValues(cache, "miss").Inc()
+	return false
+}
+
+func (c CachedPodRepository) set(key string, value interface{}) {
+	if err := c.cache.Set(key, value, c.ttl); err != nil {
+		zap.S().Errorf("set cache %s error %s", key, err.Error())
+	}
+}
+
+// generation 返回当前的 generation，还没有时生成一个，缓存出错时返回 false，直接查询数据库
+func (c CachedPodRepository) generation() (string, bool) {
+	var generation string
+	hit, err := c.cache.Get(podGenerationCacheKey, &generation)
+	if err != nil {
+		zap.S().Errorf("get cache %s error %s", podGenerationCacheKey, err.Error())
+		return "", false
+	}
+	if hit {
+		return generation, true
+	}
+	return c.newGeneration()
+}
+
+// newGeneration 并发生成时后写入的生效，先生成的 generation 下缓存的数据不会再被读到
+func (c CachedPodRepository) newGeneration() (string, bool) {
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := c.cache.Set(podGenerationCacheKey, generation, podGenerationTTL); err != nil {
+		zap.S().Errorf("set cache %s error %s", podGenerationCacheKey, err.Error())
+		return "", false
+	}
+	return generation, true
+}
+
+// invalidate 写入失败时也换 generation，多换一次没有影响，旧的数据等过期删除
+// 换 generation 失败时删除 generation，下次查询重新生成
+func (c CachedPodRepository) invalidate() {
+	if _, ok := c.newGeneration(); !ok {
+		if err := c.cache.Delete(podGenerationCacheKey); err != nil {
+			zap.S().Errorf("delete cache %s error %s", podGenerationCacheKey, err.Error())
+		}
+	}
+}
+
+func podCacheKey(generation, key string) string {
+	return "wepass-pod:" + generation + ":" + key
+}
+
+// podFilterKey 默认值相同的查询条件使用同一个缓存
+func podFilterKey(filter *model.PodFilter) string {
+	normalized := *filter
+	if normalized.OrderBy == "" {
+		normalized.OrderBy = "id"
+	}
+	normalized.PageSize = normalizePageSize(normalized.PageSize)
+	data, _ := json.Marshal(normalized)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
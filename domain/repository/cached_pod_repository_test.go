@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+const testCacheTTL = 100 * time.Millisecond
+
+// countingPodRepository 记录查询数据库的次数
+type countingPodRepository struct {
+	IPodRepository
+	calls map[string]int
+	// afterFindPage 在查询数据库之后、写入缓存之前执行，用来模拟查询期间的写入
+	afterFindPage func()
+}
+
+func (c *countingPodRepository) FindPodByID(id int64) (*model.Pod, error) {
+	c.calls["FindPodByID"]++
+	return c.IPodRepository.FindPodByID(id)
+}
+
+func (c *countingPodRepository) FindAll() ([]*model.Pod, error) {
+	c.calls["FindAll"]++
+	return c.IPodRepository.FindAll()
+}
+
+func (c *countingPodRepository) FindPage(filter *model.PodFilter) (*model.PodPage, error) {
+	c.calls["FindPage"]++
+	page, err := c.IPodRepository.FindPage(filter)
+	if c.afterFindPage != nil {
+		afterFindPage := c.afterFindPage
+		c.afterFindPage = nil
+		afterFindPage()
+	}
+	return page, err
+}
+
+type cacheBackend struct {
+	name string
+	// newCache 返回缓存和让缓存的数据过期的方法
+	newCache func(t *testing.T) (ICache, func())
+}
+
+var cacheBackends = []cacheBackend{
+	{name: "memory", newCache: func(t *testing.T) (ICache, func()) {
+		return NewMemoryCache(), func() { time.Sleep(testCacheTTL + 10*time.Millisecond) }
+	}},
+	{name: "redis", newCache: func(t *testing.T) (ICache, func()) {
+		server := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		return NewRedisCache(client), func() { server.FastForward(testCacheTTL + 10*time.Millisecond) }
+	}},
+}
+
+func newTestCachedPodRepository(t *testing.T, cache ICache) (IPodRepository, *countingPodRepository) {
+	t.Helper()
+	counting := &countingPodRepository{IPodRepository: newTestPodRepository(t), calls: map[string]int{}}
+	return NewCachedPodRepository(counting, cache, testCacheTTL), counting
+}
+
+func mustFindPage(t *testing.T, podRepository IPodRepository, filter *model.PodFilter) *model.PodPage {
+	t.Helper()
+	page, err := podRepository.FindPage(filter)
+	if err != nil {
+		t.Fatalf("find page error %s", err)
+	}
+	return page
+}
+
+func TestCachedPodRepositoryHitAndMiss(t *testing.T) {
+	for _, backend := range cacheBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			cache, _ := backend.newCache(t)
+			cached, counting := newTestCachedPodRepository(t, cache)
+			pod := mustCreatePod(t, cached, newTestPod("web"))
+			mustCreatePod(t, cached, newTestPod("api"))
+
+			for i := 0; i < 2; i++ {
+				if _, err := cached.FindPodByID(pod.ID); err != nil {
+					t.Fatalf("find pod error %s", err)
+				}
+				if _, err := cached.FindAll(); err != nil {
+					t.Fatalf("find all error %s", err)
+				}
+			}
+			// 默认值相同的查询条件命中同一个缓存
+			page := mustFindPage(t, cached, &model.PodFilter{PodNamespace: "default"})
+			cachedPage := mustFindPage(t, cached, &model.PodFilter{PodNamespace: "default", OrderBy: "id", PageSize: 100})
+			if len(cachedPage.Pods) != 2 || cachedPage.TotalCount != page.TotalCount || cachedPage.Pods[0].PodName != "web" {
+				t.Fatalf("cached page %+v, want %+v", cachedPage, page)
+			}
+			// mustCreatePod 查询一次，之后的查询都命中缓存
+			if counting.calls["FindPodByID"] != 3 || counting.calls["FindAll"] != 1 || counting.calls["FindPage"] != 1 {
+				t.Fatalf("database calls %v, want the second lookups cached", counting.calls)
+			}
+
+			if page := mustFindPage(t, cached, &model.PodFilter{PodNamespace: "default", OrderBy: "-id"}); page.Pods[0].PodName != "api" {
+				t.Fatalf("first pod %s, want api", page.Pods[0].PodName)
+			}
+			if counting.calls["FindPage"] != 2 {
+				t.Fatalf("FindPage calls %d, want a different filter to miss", counting.calls["FindPage"])
+			}
+		})
+	}
+}
+
+func TestCachedPodRepositoryInvalidatesOnWrite(t *testing.T) {
+	for _, backend := range cacheBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			cache, _ := backend.newCache(t)
+			cached, counting := newTestCachedPodRepository(t, cache)
+			pod := mustCreatePod(t, cached, newTestPod("web"))
+			mustFindPage(t, cached, &model.PodFilter{})
+			if _, err := cached.FindAll(); err != nil {
+				t.Fatalf("find all error %s", err)
+			}
+
+			pod.PodImage = "nginx:1.26"
+			if err := cached.UpdatePod(pod); err != nil {
+				t.Fatalf("update pod error %s", err)
+			}
+			found, err := cached.FindPodByID(pod.ID)
+			if err != nil || found.PodImage != "nginx:1.26" {
+				t.Fatalf("find pod %+v error %v, want the updated image", found, err)
+			}
+			all, err := cached.FindAll()
+			if err != nil || all[0].PodImage != "nginx:1.26" {
+				t.Fatalf("find all %+v error %v, want the updated image", all, err)
+			}
+			if page := mustFindPage(t, cached, &model.PodFilter{}); page.Pods[0].PodImage != "nginx:1.26" {
+				t.Fatalf("page image %s, want the updated image", page.Pods[0].PodImage)
+			}
+			if counting.calls["FindPodByID"] != 2 || counting.calls["FindAll"] != 2 || counting.calls["FindPage"] != 2 {
+				t.Fatalf("database calls %v, want every lookup to miss after the write", counting.calls)
+			}
+		})
+	}
+}
+
+func TestCachedPodRepositoryExpires(t *testing.T) {
+	for _, backend := range cacheBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			cache, expire := backend.newCache(t)
+			cached, counting := newTestCachedPodRepository(t, cache)
+			mustCreatePod(t, cached, newTestPod("web"))
+			mustFindPage(t, cached, &model.PodFilter{})
+			mustFindPage(t, cached, &model.PodFilter{})
+			expire()
+			mustFindPage(t, cached, &model.PodFilter{})
+			if counting.calls["FindPage"] != 2 {
+				t.Fatalf("FindPage calls %d, want a miss after the ttl", counting.calls["FindPage"])
+			}
+		})
+	}
+}
+
+func TestCachedPodRepositoryIgnoresResultsReadBeforeAWrite(t *testing.T) {
+	for _, backend := range cacheBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			cache, _ := backend.newCache(t)
+			cached, counting := newTestCachedPodRepository(t, cache)
+			pod := mustCreatePod(t, cached, newTestPod("web"))
+			// 查询已经读到旧数据之后，另一个请求修改了 pod
+			counting.afterFindPage = func() {
+				pod.PodImage = "nginx:1.26"
+				if err := cached.UpdatePod(pod); err != nil {
+					t.Fatalf("update pod error %s", err)
+				}
+			}
+			if page := mustFindPage(t, cached, &model.PodFilter{}); page.Pods[0].PodImage != "nginx:1.25" {
+				t.Fatalf("page image %s, want the image read before the write", page.Pods[0].PodImage)
+			}
+			if page := mustFindPage(t, cached, &model.PodFilter{}); page.Pods[0].PodImage != "nginx:1.26" {
+				t.Fatalf("page image %s, want the stale page not cached", page.Pods[0].PodImage)
+			}
+		})
+	}
+}
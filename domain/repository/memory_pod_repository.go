@@ -0,0 +1,481 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"gorm.io/gorm"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryPodRepository 内存实现，不需要数据库，用于测试和本地调试
+// 同时实现 IPodRepository 和 IPodOperationRepository，修改 pod 和写入操作在同一把锁内完成，相当于一个事务
+// 返回的错误和数据库实现保持一致，比如找不到时返回 gorm.ErrRecordNotFound
+type MemoryPodRepository struct {
+	mu              sync.Mutex
+	pods            map[int64]*model.Pod
+	operations      map[int64]*model.PodOperation
+	lastPodID       int64
+	lastChildID     int64
+	lastOperationID int64
+}
+
+func NewMemoryPodRepository() *MemoryPodRepository {
+	return &MemoryPodRepository{
+		pods:       map[int64]*model.Pod{},
+		operations: map[int64]*model.PodOperation{},
+	}
+}
+
+func (m *MemoryPodRepository) InitTable() error {
+	return nil
+}
+
+func (m *MemoryPodRepository) FindPodByID(id int64) (*model.Pod, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pod, ok := m.pods[id]
+	if !ok || pod.DeletedAt.Valid {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return copyPod(pod), nil
+}
+
+func (m *MemoryPodRepository) FindPodByName(cluster, namespace, name string) (*model.Pod, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pod := range m.pods {
+		if !pod.DeletedAt.Valid && pod.PodCluster == cluster && pod.PodNamespace == namespace && pod.PodName == name {
+			return copyPod(pod), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (m *MemoryPodRepository) CreatePod(pod *model.Pod) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.createPod(pod)
+	return pod.ID, err
+}
+
+func (m *MemoryPodRepository) createPod(pod *model.Pod) error {
+	pod.Version = 1
+	pod.PodCluster = model.ClusterOrDefault(pod.PodCluster)
+	if err := m.checkIdentity(pod); err != nil {
+		return err
+	}
+	pod.CreatedAt = time.Now()
+	m.lastPodID++
+	pod.ID = m.lastPodID
+	m.setChildren(pod)
+	m.pods[pod.ID] = copyPod(pod)
+	return nil
+}
+
+// checkIdentity 相当于 idx_pod_identity 唯一索引，回收站中的 pod 不参与检查
+func (m *MemoryPodRepository) checkIdentity(pod *model.Pod) error {
+	for _, existing := range m.pods {
+		if existing.ID == pod.ID || existing.DeletedAt.Valid {
+			continue
+		}
+		if existing.PodCluster == pod.PodCluster && existing.PodNamespace == pod.PodNamespace && existing.PodName == pod.PodName {
+			return &model.AlreadyExistsError{Kind: "pod", Cluster: pod.PodCluster, Namespace: pod.PodNamespace, Name: pod.PodName}
+		}
+	}
+	return nil
+}
+
+// setChildren 和 replaceChildren 一样，子表数据重新生成 id
+func (m *MemoryPodRepository) setChildren(pod *model.Pod) {
+	for _, port := range pod.PodPort {
+		m.lastChildID++
+		port.ID, port.PodID = m.lastChildID, pod.ID
+	}
+	for _, env := range pod.PodEnv {
+		m.lastChildID++
+		env.ID, env.PodID = m.lastChildID, pod.ID
+	}
+	for _, label := range pod.PodLabel {
+		m.lastChildID++
+		label.ID, label.PodID = m.lastChildID, pod.ID
+	}
+}
+
+func (m *MemoryPodRepository) DeletePod(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deletePod(id)
+}
+
+func (m *MemoryPodRepository) deletePod(id int64) error {
+	pod, ok := m.pods[id]
+	if !ok || pod.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	pod.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	pod.DeletedID = id
+	return nil
+}
+
+func (m *MemoryPodRepository) UpdatePod(pod *model.Pod) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updatePod(pod)
+}
+
+// updatePod 失败时 pod.Version 保持不变
+func (m *MemoryPodRepository) updatePod(pod *model.Pod) error {
+	current, ok := m.pods[pod.ID]
+	if !ok || current.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	if current.Version != pod.Version {
+		return &model.ConflictError{Kind: "pod", Name: current.PodName, CurrentVersion: strconv.FormatInt(current.Version, 10)}
+	}
+	pod.PodCluster = model.ClusterOrDefault(pod.PodCluster)
+	if err := m.checkIdentity(pod); err != nil {
+		return err
+	}
+	pod.Version++
+	pod.CreatedAt = current.CreatedAt
+	m.setChildren(pod)
+	m.pods[pod.ID] = copyPod(pod)
+	return nil
+}
+
+func (m *MemoryPodRepository) FindAll() ([]*model.Pod, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findPods(func(pod *model.Pod) bool { return !pod.DeletedAt.Valid }), nil
+}
+
+// findPods 按 id 排序返回满足条件的 pod
+func (m *MemoryPodRepository) findPods(match func(pod *model.Pod) bool) []*model.Pod {
+	var pods []*model.Pod
+	for _, pod := range m.pods {
+		if match(pod) {
+			pods = append(pods, copyPod(pod))
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].ID < pods[j].ID })
+	return pods
+}
+
+func (m *MemoryPodRepository) FindPage(filter *model.PodFilter) (*model.PodPage, error) {
+	orderBy := filter.OrderBy
+	if orderBy == "" {
+		orderBy = "id"
+	}
+	column, desc := strings.TrimPrefix(orderBy, "-"), strings.HasPrefix(orderBy, "-")
+	if column != "id" && column != "pod_name" {
+		return nil, ErrInvalidOrderBy
+	}
+	selector := labels.Everything()
+	if filter.LabelSelector != "" {
+		var err error
+		if selector, err = labels.Parse(filter.LabelSelector); err != nil {
+			return nil, invalidLabelSelector(err.Error())
+		}
+		requirements, _ := selector.Requirements()
+		for _, requirement := range requirements {
+			switch requirement.Operator() {
+			case selection.GreaterThan, selection.LessThan:
+				return nil, invalidLabelSelector(fmt.Sprintf("operator %s is not supported", requirement.Operator()))
+			}
+		}
+	}
+	var token *pageToken
+	if filter.PageToken != "" {
+		var err error
+		token, err = decodePageToken(filter.PageToken)
+		if err != nil || token.OrderBy != orderBy {
+			return nil, ErrInvalidPageToken
+		}
+	}
+
+	m.mu.Lock()
+	pods := m.findPods(func(pod *model.Pod) bool {
+		return !pod.DeletedAt.Valid && matchFilter(pod, filter, selector)
+	})
+	m.mu.Unlock()
+
+	// less 和数据库实现的排序一致，pod_name 相同时按 id 排序
+	less := func(a, b *model.Pod) bool {
+		if column == "pod_name" && a.PodName != b.PodName {
+			return a.PodName < b.PodName
+		}
+		return a.ID < b.ID
+	}
+	if desc {
+		asc := less
+		less = func(a, b *model.Pod) bool { return asc(b, a) }
+	}
+	sort.Slice(pods, func(i, j int) bool { return less(pods[i], pods[j]) })
+
+	page := &model.PodPage{TotalCount: int64(len(pods))}
+	if token != nil {
+		last := &model.Pod{ID: token.ID, PodName: token.PodName}
+		start := sort.Search(len(pods), func(i int) bool { return less(last, pods[i]) })
+		pods = pods[start:]
+	}
+	pageSize := filter.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	if len(pods) > pageSize {
+		pods = pods[:pageSize]
+		last := pods[pageSize-1]
+		page.NextPageToken = encodePageToken(&pageToken{OrderBy: orderBy, PodName: last.PodName, ID: last.ID})
+	}
+	page.Pods = pods
+	return page, nil
+}
+
+func matchFilter(pod *model.Pod, filter *model.PodFilter, selector labels.Selector) bool {
+	switch {
+	case filter.PodCluster != "" && pod.PodCluster != filter.PodCluster:
+		return false
+	case filter.PodNamespace != "" && pod.PodNamespace != filter.PodNamespace:
+		return false
+	case filter.PodTeamID != "" && pod.PodTeamID != filter.PodTeamID:
+		return false
+	case !strings.HasPrefix(pod.PodName, filter.NamePrefix):
+		return false
+	case !strings.Contains(pod.PodImage, filter.Image):
+		return false
+	}
+	set := labels.Set{}
+	for _, label := range pod.PodLabel {
+		set[label.LabelKey] = label.LabelValue
+	}
+	return selector.Matches(set)
+}
+
+func (m *MemoryPodRepository) FindDeletedPods(namespace, teamID string) ([]*model.Pod, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pods := m.findPods(func(pod *model.Pod) bool {
+		return pod.DeletedAt.Valid && (namespace == "" || pod.PodNamespace == namespace) &&
+			(teamID == "" || pod.PodTeamID == teamID)
+	})
+	sort.SliceStable(pods, func(i, j int) bool { return pods[i].DeletedAt.Time.After(pods[j].DeletedAt.Time) })
+	return pods, nil
+}
+
+func (m *MemoryPodRepository) FindDeletedPodByID(id int64) (*model.Pod, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pod, ok := m.pods[id]
+	if !ok || !pod.DeletedAt.Valid {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return copyPod(pod), nil
+}
+
+func (m *MemoryPodRepository) RestorePod(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.restorePod(id)
+}
+
+func (m *MemoryPodRepository) restorePod(id int64) error {
+	pod, ok := m.pods[id]
+	if !ok || !pod.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	if err := m.checkIdentity(pod); err != nil {
+		return err
+	}
+	pod.DeletedAt = gorm.DeletedAt{}
+	pod.DeletedID = 0
+	return nil
+}
+
+func (m *MemoryPodRepository) PurgeDeletedPods(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purged int64
+	for id, pod := range m.pods {
+		if pod.DeletedAt.Valid && pod.DeletedAt.Time.Before(before) {
+			delete(m.pods, id)
+			for operationID, operation := range m.operations {
+				if operation.PodID == id {
+					delete(m.operations, operationID)
+				}
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryPodRepository) CreatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.createPod(pod); err != nil {
+		return err
+	}
+	operation.PodID = pod.ID
+	m.createOperation(operation)
+	return nil
+}
+
+func (m *MemoryPodRepository) UpdatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.updatePod(pod); err != nil {
+		return err
+	}
+	operation.PodID = pod.ID
+	m.createOperation(operation)
+	return nil
+}
+
+func (m *MemoryPodRepository) DeletePodWithOperation(id int64, operation *model.PodOperation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.deletePod(id); err != nil {
+		return err
+	}
+	operation.PodID = id
+	m.createOperation(operation)
+	return nil
+}
+
+func (m *MemoryPodRepository) RestorePodWithOperation(id int64, operation *model.PodOperation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.restorePod(id); err != nil {
+		return err
+	}
+	operation.PodID = id
+	m.createOperation(operation)
+	return nil
+}
+
+func (m *MemoryPodRepository) createOperation(operation *model.PodOperation) {
+	m.lastOperationID++
+	now := time.Now()
+	operation.ID = m.lastOperationID
+	operation.CreatedAt, operation.UpdatedAt = now, now
+	saved := *operation
+	m.operations[operation.ID] = &saved
+}
+
+func (m *MemoryPodRepository) FindOperationByID(id int64) (*model.PodOperation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	operation, ok := m.operations[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	found := *operation
+	return &found, nil
+}
+
+func (m *MemoryPodRepository) FindDueOperations(now time.Time, limit int) ([]*model.PodOperation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var operations []*model.PodOperation
+	for _, operation := range m.operations {
+		if operation.Status == model.OperationPending && !operation.NextRunAt.After(now) {
+			found := *operation
+			operations = append(operations, &found)
+		}
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].ID < operations[j].ID })
+	if len(operations) > limit {
+		operations = operations[:limit]
+	}
+	return operations, nil
+}
+
+func (m *MemoryPodRepository) HasUnfinishedBefore(podID, id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, operation := range m.operations {
+		if operation.PodID == podID && operation.ID < id &&
+			(operation.Status == model.OperationPending || operation.Status == model.OperationRunning) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryPodRepository) ClaimOperation(id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	operation, ok := m.operations[id]
+	if !ok || operation.Status != model.OperationPending {
+		return false, nil
+	}
+	operation.Status = model.OperationRunning
+	operation.UpdatedAt = time.Now()
+	return true, nil
+}
+
+func (m *MemoryPodRepository) UpdateOperation(operation *model.PodOperation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	operation.UpdatedAt = time.Now()
+	saved := *operation
+	m.operations[operation.ID] = &saved
+	return nil
+}
+
+func (m *MemoryPodRepository) CancelOperationsAfter(podID, id int64, reason string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var cancelled int64
+	for _, operation := range m.operations {
+		if operation.PodID == podID && operation.ID > id && operation.Status == model.OperationPending {
+			operation.Status = model.OperationCompensated
+			operation.LastError = reason
+			operation.UpdatedAt = time.Now()
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+func (m *MemoryPodRepository) ResetStaleOperations(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var reset int64
+	for _, operation := range m.operations {
+		if operation.Status == model.OperationRunning && operation.UpdatedAt.Before(before) {
+			operation.Status = model.OperationPending
+			operation.NextRunAt = time.Now()
+			reset++
+		}
+	}
+	return reset, nil
+}
+
+// copyPod 深拷贝，调用方修改返回值不会影响保存的数据
+func copyPod(pod *model.Pod) *model.Pod {
+	copied := *pod
+	copied.PodPort, copied.PodEnv, copied.PodLabel = nil, nil, nil
+	for _, port := range pod.PodPort {
+		item := *port
+		copied.PodPort = append(copied.PodPort, &item)
+	}
+	for _, env := range pod.PodEnv {
+		item := *env
+		copied.PodEnv = append(copied.PodEnv, &item)
+	}
+	for _, label := range pod.PodLabel {
+		item := *label
+		copied.PodLabel = append(copied.PodLabel, &item)
+	}
+	return &copied
+}
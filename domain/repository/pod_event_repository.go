@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/migration"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type IPodEventRepository interface {
+	InitTable() error
+	SaveEvents(events []*model.PodEventRecord) error
+	FindByPodID(podID int64) ([]*model.PodEventRecord, error)
+}
+
+type PodEventRepository struct {
+	mysqlDb *gorm.DB
+}
+
+func NewPodEventRepository(db *gorm.DB) IPodEventRepository {
+	return &PodEventRepository{mysqlDb: db}
+}
+
+func (p PodEventRepository) InitTable() error {
+	return migration.NewMigrator(p.mysqlDb).Up()
+}
+
+// SaveEvents 按 event uid 去重，已经存在的事件只更新次数和时间
+func (p PodEventRepository) SaveEvents(events []*model.PodEventRecord) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return p.mysqlDb.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "event_uid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"message", "count", "last_timestamp"}),
+	}).Create(&events).Error
+}
+
+func (p PodEventRepository) FindByPodID(podID int64) ([]*model.PodEventRecord, error) {
+	var events []*model.PodEventRecord
+	if err := p.mysqlDb.Where("pod_id = ?", podID).Order("last_timestamp").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const (
+	podHistoryCollection = "pod_history"
+	defaultHistoryLimit  = 100
+	maxHistoryLimit      = 1000
+	mongoTimeout         = 5 * time.Second
+)
+
+type IPodHistoryRepository interface {
+	// InitIndexes 创建查询索引和 expire_at 上的 TTL 索引，可以重复执行
+	InitIndexes() error
+	AppendHistory(histories ...*model.PodHistory) error
+	// FindHistory 按时间倒序返回 pod 的历史记录
+	FindHistory(filter *model.PodHistoryFilter) ([]*model.PodHistory, error)
+}
+
+type PodHistoryRepository struct {
+	collection *mongo.Collection
+}
+
+func NewPodHistoryRepository(db *mongo.Database) IPodHistoryRepository {
+	return &PodHistoryRepository{collection: db.Collection(podHistoryCollection)}
+}
+
+func (p PodHistoryRepository) InitIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := p.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "pod_id", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "pod_namespace", Value: 1}, {Key: "pod_name", Value: 1}, {Key: "pod_cluster", Value: 1},
+			{Key: "timestamp", Value: -1}}},
+		// expire_at 为空的文档不会过期
+		{Keys: bson.D{{Key: "expire_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+func (p PodHistoryRepository) AppendHistory(histories ...*model.PodHistory) error {
+	if len(histories) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, 0, len(histories))
+	for _, history := range histories {
+		documents = append(documents, history)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	_, err := p.collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+func (p PodHistoryRepository) FindHistory(filter *model.PodHistoryFilter) ([]*model.PodHistory, error) {
+	// k8s 事件只有名称，按集群、名称和 pod 的存在时间匹配没有 pod id 的记录
+	byName := bson.M{"pod_id": 0, "pod_namespace": filter.PodNamespace, "pod_name": filter.PodName}
+	cluster := model.ClusterOrDefault(filter.PodCluster)
+	byName["pod_cluster"] = cluster
+	if cluster == model.DefaultCluster {
+		// 没有集群的记录是 default 集群的
+		byName["pod_cluster"] = bson.M{"$in": bson.A{cluster, nil}}
+	}
+	timestamp := bson.M{}
+	if !filter.Since.IsZero() {
+		timestamp["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		timestamp["$lt"] = filter.Until
+	}
+	if len(timestamp) > 0 {
+		byName["timestamp"] = timestamp
+	}
+	query := bson.M{"$or": bson.A{bson.M{"pod_id": filter.PodID}, byName}}
+	if len(filter.Types) > 0 {
+		query["type"] = bson.M{"$in": filter.Types}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cursor, err := p.collection.Find(ctx, query, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	var histories []*model.PodHistory
+	if err := cursor.All(ctx, &histories); err != nil {
+		return nil, err
+	}
+	return histories, nil
+}
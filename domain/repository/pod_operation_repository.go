@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/migration"
+	"gorm.io/gorm"
+	"time"
+)
+
+type IPodOperationRepository interface {
+	InitTable() error
+	FindOperationByID(id int64) (*model.PodOperation, error)
+	// FindDueOperations 查询到了执行时间的 pending 操作，按 id 排序
+	FindDueOperations(now time.Time, limit int) ([]*model.PodOperation, error)
+	// HasUnfinishedBefore 同一个 pod 是否还有更早的操作没有结束，操作必须按顺序执行
+	HasUnfinishedBefore(podID, id int64) (bool, error)
+	// ClaimOperation 把 pending 操作改成 running，返回 false 说明已经被别的 worker 领走了
+	ClaimOperation(id int64) (bool, error)
+	UpdateOperation(operation *model.PodOperation) error
+	// CancelOperationsAfter 前面的操作补偿之后，同一个 pod 后面还没执行的操作也一起取消
+	CancelOperationsAfter(podID, id int64, reason string) (int64, error)
+	// ResetStaleOperations 把 before 之前就开始执行但一直没有结束的操作重新改成 pending
+	ResetStaleOperations(before time.Time) (int64, error)
+}
+
+type PodOperationRepository struct {
+	mysqlDb *gorm.DB
+}
+
+func NewPodOperationRepository(db *gorm.DB) IPodOperationRepository {
+	return &PodOperationRepository{mysqlDb: db}
+}
+
+func (p PodOperationRepository) InitTable() error {
+	return migration.NewMigrator(p.mysqlDb).Up()
+}
+
+func (p PodOperationRepository) FindOperationByID(id int64) (*model.PodOperation, error) {
+	var operation model.PodOperation
+	if err := p.mysqlDb.First(&operation, id).Error; err != nil {
+		return nil, err
+	}
+	return &operation, nil
+}
+
+func (p PodOperationRepository) FindDueOperations(now time.Time, limit int) ([]*model.PodOperation, error) {
+	var operations []*model.PodOperation
+	if err := p.mysqlDb.Where("status = ? AND next_run_at <= ?", model.OperationPending, now).
+		Order("id").Limit(limit).Find(&operations).Error; err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+func (p PodOperationRepository) HasUnfinishedBefore(podID, id int64) (bool, error) {
+	var count int64
+	if err := p.mysqlDb.Model(&model.PodOperation{}).
+		Where("pod_id = ? AND id < ? AND status IN ?", podID, id, []string{model.OperationPending, model.OperationRunning}).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (p PodOperationRepository) ClaimOperation(id int64) (bool, error) {
+	result := p.mysqlDb.Model(&model.PodOperation{}).Where("id = ? AND status = ?", id, model.OperationPending).
+		Updates(map[string]interface{}{"status": model.OperationRunning, "updated_at": time.Now()})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (p PodOperationRepository) UpdateOperation(operation *model.PodOperation) error {
+	return p.mysqlDb.Save(operation).Error
+}
+
+func (p PodOperationRepository) ResetStaleOperations(before time.Time) (int64, error) {
+	result := p.mysqlDb.Model(&model.PodOperation{}).Where("status = ? AND updated_at < ?", model.OperationRunning, before).
+		Updates(map[string]interface{}{"status": model.OperationPending, "next_run_at": time.Now()})
+	return result.RowsAffected, result.Error
+}
+
+func (p PodOperationRepository) CancelOperationsAfter(podID, id int64, reason string) (int64, error) {
+	result := p.mysqlDb.Model(&model.PodOperation{}).Where("pod_id = ? AND id > ? AND status = ?", podID, id, model.OperationPending).
+		Updates(map[string]interface{}{"status": model.OperationCompensated, "last_error": reason, "updated_at": time.Now()})
+	return result.RowsAffected, result.Error
+}
@@ -1,17 +1,53 @@
 package repository
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
 	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/migration"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+var (
+	ErrInvalidPageToken = common.InvalidArgument("invalid page token").WithField("page_token", "not returned by a previous page")
+	ErrInvalidOrderBy   = common.InvalidArgument("invalid order by").WithField("order_by", "must be one of id, -id, pod_name, -pod_name")
 )
 
 type IPodRepository interface {
+	// InitTable 执行所有还没有执行的数据库迁移
 	InitTable() error
 	FindPodByID(id int64) (*model.Pod, error)
+	FindPodByName(cluster, namespace, name string) (*model.Pod, error)
 	CreatePod(pod *model.Pod) (int64, error)
 	DeletePod(id int64) error
 	UpdatePod(pod *model.Pod) error
 	FindAll() ([]*model.Pod, error)
+	FindPage(filter *model.PodFilter) (*model.PodPage, error)
+	FindDeletedPods(namespace, teamID string) ([]*model.Pod, error)
+	FindDeletedPodByID(id int64) (*model.Pod, error)
+	RestorePod(id int64) error
+	// PurgeDeletedPods 彻底删除 before 之前软删除的 pod 和它的操作、事件，返回删除的数量
+	PurgeDeletedPods(before time.Time) (int64, error)
+	// 下面的方法在同一个事务中修改 pod 并写入待执行的操作，由 worker 应用到 k8s
+	CreatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error
+	UpdatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error
+	DeletePodWithOperation(id int64, operation *model.PodOperation) error
+	RestorePodWithOperation(id int64, operation *model.PodOperation) error
 }
 
 type PodRepository struct {
@@ -23,56 +59,414 @@ func NewPodRepository(db *gorm.DB) IPodRepository {
 }
 
 func (p PodRepository) InitTable() error {
-	return p.mysqlDb.Migrator().CreateTable(&model.PodPort{}, &model.PodEnv{}, &model.Pod{})
+	return migration.NewMigrator(p.mysqlDb).Up()
 }
 
 func (p PodRepository) FindPodByID(id int64) (*model.Pod, error) {
 	var pod model.Pod
-	err := p.mysqlDb.Preload("PodEnv").Preload("PodPort").Find(&pod, id)
-	if err != nil {
-		return nil, err.Error
+	if err := p.mysqlDb.Preload("PodEnv").Preload("PodPort").Preload("PodLabel").First(&pod, id).Error; err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+func (p PodRepository) FindPodByName(cluster, namespace, name string) (*model.Pod, error) {
+	var pod model.Pod
+	if err := p.mysqlDb.Preload("PodEnv").Preload("PodPort").Preload("PodLabel").
+		Where("pod_cluster = ? AND pod_namespace = ? AND pod_name = ?", cluster, namespace, name).First(&pod).Error; err != nil {
+		return nil, err
 	}
 	return &pod, nil
 }
 
 func (p PodRepository) CreatePod(pod *model.Pod) (int64, error) {
-	return pod.ID, p.mysqlDb.Create(pod).Error
+	pod.Version = 1
+	pod.PodCluster = model.ClusterOrDefault(pod.PodCluster)
+	err := p.mysqlDb.Create(pod).Error
+	return pod.ID, alreadyExists(err, pod)
 }
 
+// DeletePod 软删除，端口、环境变量和标签保留下来用于恢复
 func (p PodRepository) DeletePod(id int64) error {
-	tx := p.mysqlDb.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Callback()
-		}
-	}()
-	if tx.Error != nil {
-		return tx.Error
+	return softDeletePod(p.mysqlDb, id)
+}
+
+// softDeletePod 同时设置 deleted_id，让回收站中的 pod 不占用唯一索引
+func softDeletePod(db *gorm.DB, id int64) error {
+	result := db.Model(&model.Pod{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"deleted_at": time.Now(), "deleted_id": id})
+	if result.Error != nil {
+		return result.Error
 	}
-	if err := p.mysqlDb.Delete(&model.Pod{}, id).Error; err != nil {
-		tx.Callback()
-		return err
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
-	if err := p.mysqlDb.Where("pod_id = ?", id).Delete(&model.PodPort{}).Error; err != nil {
-		tx.Callback()
+	return nil
+}
+
+// alreadyExists 把唯一索引冲突转换成 AlreadyExistsError，其他错误原样返回
+func alreadyExists(err error, pod *model.Pod) error {
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
 		return err
 	}
-	if err := p.mysqlDb.Where("pod_id = ?", id).Delete(&model.PodEnv{}).Error; err != nil {
-		tx.Callback()
-		return err
+	return &model.AlreadyExistsError{Kind: "pod", Cluster: pod.PodCluster, Namespace: pod.PodNamespace, Name: pod.PodName}
+}
+
+func (p PodRepository) FindDeletedPods(namespace, teamID string) ([]*model.Pod, error) {
+	query := p.mysqlDb.Unscoped().Where("deleted_at IS NOT NULL")
+	if namespace != "" {
+		query = query.Where("pod_namespace = ?", namespace)
+	}
+	if teamID != "" {
+		query = query.Where("pod_team_id = ?", teamID)
+	}
+	var pods []*model.Pod
+	if err := query.Preload("PodEnv").Preload("PodPort").Preload("PodLabel").
+		Order("deleted_at DESC").Find(&pods).Error; err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+func (p PodRepository) FindDeletedPodByID(id int64) (*model.Pod, error) {
+	var pod model.Pod
+	if err := p.mysqlDb.Unscoped().Where("deleted_at IS NOT NULL").
+		Preload("PodEnv").Preload("PodPort").Preload("PodLabel").First(&pod, id).Error; err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+func (p PodRepository) RestorePod(id int64) error {
+	return restorePod(p.mysqlDb, id)
+}
+
+func restorePod(db *gorm.DB, id int64) error {
+	result := db.Unscoped().Model(&model.Pod{}).Where("id = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]interface{}{"deleted_at": nil, "deleted_id": 0})
+	if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+		var pod model.Pod
+		if err := db.Unscoped().First(&pod, id).Error; err != nil {
+			return err
+		}
+		return alreadyExists(result.Error, &pod)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
+	return nil
+}
 
-	return tx.Commit().Error
+func (p PodRepository) PurgeDeletedPods(before time.Time) (int64, error) {
+	var ids []int64
+	if err := p.mysqlDb.Unscoped().Model(&model.Pod{}).
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", before).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	var purged int64
+	for _, id := range ids {
+		err := p.mysqlDb.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("pod_id = ?", id).Delete(&model.PodPort{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("pod_id = ?", id).Delete(&model.PodEnv{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("pod_id = ?", id).Delete(&model.PodLabel{}).Error; err != nil {
+				return err
+			}
+			// 操作和事件只对这个 pod 有意义，一起删除
+			if err := tx.Where("pod_id = ?", id).Delete(&model.PodOperation{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("pod_id = ?", id).Delete(&model.PodEventRecord{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&model.Pod{}, id).Error
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
 }
 
+// UpdatePod 用 pod 整体替换数据库中的数据，包括端口、环境变量和标签
+// 只有版本号和数据库中一致时才会更新，成功后 pod.Version 是新的版本号
 func (p PodRepository) UpdatePod(pod *model.Pod) error {
-	return p.mysqlDb.Updates(pod).Error
+	expected := pod.Version
+	err := p.mysqlDb.Transaction(func(tx *gorm.DB) error {
+		return p.updatePod(tx, pod)
+	})
+	if err != nil {
+		pod.Version = expected
+	}
+	return err
+}
+
+// updatePod 需要在事务中调用，失败时 pod.Version 可能已经被修改
+func (p PodRepository) updatePod(tx *gorm.DB, pod *model.Pod) error {
+	expected := pod.Version
+	pod.Version = expected + 1
+	pod.PodCluster = model.ClusterOrDefault(pod.PodCluster)
+	// Select("*") 让零值字段也能更新，子表在 replaceChildren 中单独处理
+	result := tx.Model(pod).Select("*").Omit("id", "created_at", "deleted_at", "deleted_id", clause.Associations).
+		Where("version = ?", expected).Updates(pod)
+	if result.Error != nil {
+		return alreadyExists(result.Error, pod)
+	}
+	if result.RowsAffected == 0 {
+		var current model.Pod
+		if err := tx.First(&current, pod.ID).Error; err != nil {
+			return err
+		}
+		return &model.ConflictError{Kind: "pod", Name: current.PodName, CurrentVersion: strconv.FormatInt(current.Version, 10)}
+	}
+	return replaceChildren(tx, pod)
+}
+
+// replaceChildren 删除 pod 原有的子表数据再插入新的数据，Pod 中所有 has many 的字段都会处理
+func replaceChildren(tx *gorm.DB, pod *model.Pod) error {
+	statement := &gorm.Statement{DB: tx}
+	if err := statement.Parse(pod); err != nil {
+		return err
+	}
+	ctx := tx.Statement.Context
+	podValue := reflect.ValueOf(pod).Elem()
+	for _, relationship := range statement.Schema.Relationships.HasMany {
+		foreignKey := relationship.References[0].ForeignKey
+		child := reflect.New(relationship.FieldSchema.ModelType).Interface()
+		if err := tx.Where(foreignKey.DBName+" = ?", pod.ID).Delete(child).Error; err != nil {
+			return err
+		}
+		children, _ := relationship.Field.ValueOf(ctx, podValue)
+		childrenValue := reflect.ValueOf(children)
+		if childrenValue.Len() == 0 {
+			continue
+		}
+		for i := 0; i < childrenValue.Len(); i++ {
+			item := childrenValue.Index(i)
+			// 请求中带的 id 可能属于别的 pod，统一重新生成
+			if err := relationship.FieldSchema.PrioritizedPrimaryField.Set(ctx, item, 0); err != nil {
+				return err
+			}
+			if err := foreignKey.Set(ctx, item, pod.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(children).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p PodRepository) CreatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error {
+	return p.mysqlDb.Transaction(func(tx *gorm.DB) error {
+		pod.Version = 1
+		pod.PodCluster = model.ClusterOrDefault(pod.PodCluster)
+		if err := tx.Create(pod).Error; err != nil {
+			return alreadyExists(err, pod)
+		}
+		operation.PodID = pod.ID
+		return tx.Create(operation).Error
+	})
+}
+
+func (p PodRepository) UpdatePodWithOperation(pod *model.Pod, operation *model.PodOperation) error {
+	expected := pod.Version
+	err := p.mysqlDb.Transaction(func(tx *gorm.DB) error {
+		if err := p.updatePod(tx, pod); err != nil {
+			return err
+		}
+		operation.PodID = pod.ID
+		return tx.Create(operation).Error
+	})
+	if err != nil {
+		pod.Version = expected
+	}
+	return err
+}
+
+func (p PodRepository) DeletePodWithOperation(id int64, operation *model.PodOperation) error {
+	return p.mysqlDb.Transaction(func(tx *gorm.DB) error {
+		if err := softDeletePod(tx, id); err != nil {
+			return err
+		}
+		operation.PodID = id
+		return tx.Create(operation).Error
+	})
+}
+
+func (p PodRepository) RestorePodWithOperation(id int64, operation *model.PodOperation) error {
+	return p.mysqlDb.Transaction(func(tx *gorm.DB) error {
+		if err := restorePod(tx, id); err != nil {
+			return err
+		}
+		operation.PodID = id
+		return tx.Create(operation).Error
+	})
 }
 
 func (p PodRepository) FindAll() ([]*model.Pod, error) {
 	var pods []*model.Pod
-	if err := p.mysqlDb.Find(&pods).Error; err != nil {
+	if err := p.mysqlDb.Preload("PodEnv").Preload("PodPort").Preload("PodLabel").Find(&pods).Error; err != nil {
 		return nil, err
 	}
 	return pods, nil
 }
+
+// pageToken 记录上一页最后一条数据的排序字段，按索引做 keyset 分页
+type pageToken struct {
+	OrderBy string `json:"o"`
+	PodName string `json:"n,omitempty"`
+	ID      int64  `json:"i"`
+}
+
+func (p PodRepository) FindPage(filter *model.PodFilter) (*model.PodPage, error) {
+	scope, err := p.filterScope(filter)
+	if err != nil {
+		return nil, err
+	}
+	page := &model.PodPage{}
+	if err := p.mysqlDb.Model(&model.Pod{}).Scopes(scope).Count(&page.TotalCount).Error; err != nil {
+		return nil, err
+	}
+
+	orderBy := filter.OrderBy
+	if orderBy == "" {
+		orderBy = "id"
+	}
+	column, desc := strings.TrimPrefix(orderBy, "-"), strings.HasPrefix(orderBy, "-")
+	if column != "id" && column != "pod_name" {
+		return nil, ErrInvalidOrderBy
+	}
+	direction, compare := "ASC", ">"
+	if desc {
+		direction, compare = "DESC", "<"
+	}
+	query := p.mysqlDb.Scopes(scope)
+	if filter.PageToken != "" {
+		token, err := decodePageToken(filter.PageToken)
+		if err != nil || token.OrderBy != orderBy {
+			return nil, ErrInvalidPageToken
+		}
+		if column == "id" {
+			query = query.Where("pods.id "+compare+" ?", token.ID)
+		} else {
+			query = query.Where("(pods.pod_name "+compare+" ? OR (pods.pod_name = ? AND pods.id "+compare+" ?))",
+				token.PodName, token.PodName, token.ID)
+		}
+	}
+	if column == "pod_name" {
+		query = query.Order("pods.pod_name " + direction)
+	}
+
+	pageSize := normalizePageSize(filter.PageSize)
+	// 多查一条用来判断是否还有下一页
+	if err := query.Order("pods.id " + direction).Limit(pageSize + 1).
+		Preload("PodEnv").Preload("PodPort").Preload("PodLabel").Find(&page.Pods).Error; err != nil {
+		return nil, err
+	}
+	if len(page.Pods) > pageSize {
+		page.Pods = page.Pods[:pageSize]
+		last := page.Pods[pageSize-1]
+		page.NextPageToken = encodePageToken(&pageToken{OrderBy: orderBy, PodName: last.PodName, ID: last.ID})
+	}
+	return page, nil
+}
+
+func (p PodRepository) filterScope(filter *model.PodFilter) (func(db *gorm.DB) *gorm.DB, error) {
+	var requirements labels.Requirements
+	if filter.LabelSelector != "" {
+		selector, err := labels.Parse(filter.LabelSelector)
+		if err != nil {
+			return nil, invalidLabelSelector(err.Error())
+		}
+		requirements, _ = selector.Requirements()
+	}
+	for _, requirement := range requirements {
+		switch requirement.Operator() {
+		case selection.GreaterThan, selection.LessThan:
+			return nil, invalidLabelSelector(fmt.Sprintf("operator %s is not supported", requirement.Operator()))
+		}
+	}
+	return func(db *gorm.DB) *gorm.DB {
+		if filter.PodCluster != "" {
+			db = db.Where("pods.pod_cluster = ?", filter.PodCluster)
+		}
+		if filter.PodNamespace != "" {
+			db = db.Where("pods.pod_namespace = ?", filter.PodNamespace)
+		}
+		if filter.PodTeamID != "" {
+			db = db.Where("pods.pod_team_id = ?", filter.PodTeamID)
+		}
+		if filter.NamePrefix != "" {
+			db = db.Where("pods.pod_name LIKE ? ESCAPE '!'", escapeLike(filter.NamePrefix)+"%")
+		}
+		if filter.Image != "" {
+			db = db.Where("pods.pod_image LIKE ? ESCAPE '!'", "%"+escapeLike(filter.Image)+"%")
+		}
+		for _, requirement := range requirements {
+			db = labelRequirementScope(db, requirement)
+		}
+		return db
+	}, nil
+}
+
+func invalidLabelSelector(reason string) error {
+	return common.InvalidArgument("invalid label selector").WithField("label_selector", reason)
+}
+
+// labelRequirementScope 把 label selector 的一个条件转换成 pod_labels 上的子查询
+func labelRequirementScope(db *gorm.DB, requirement labels.Requirement) *gorm.DB {
+	const subQuery = "EXISTS (SELECT 1 FROM pod_labels WHERE pod_labels.pod_id = pods.id AND pod_labels.label_key = ?"
+	values := requirement.Values().List()
+	switch requirement.Operator() {
+	case selection.Equals, selection.DoubleEquals, selection.In:
+		return db.Where(subQuery+" AND pod_labels.label_value IN ?)", requirement.Key(), values)
+	case selection.NotEquals, selection.NotIn:
+		// 和 k8s 一致，没有这个 key 的 pod 也满足条件
+		return db.Where("NOT "+subQuery+" AND pod_labels.label_value IN ?)", requirement.Key(), values)
+	case selection.Exists:
+		return db.Where(subQuery+")", requirement.Key())
+	case selection.DoesNotExist:
+		return db.Where("NOT "+subQuery+")", requirement.Key())
+	}
+	return db
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+func encodePageToken(token *pageToken) string {
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageToken(value string) (*pageToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	token := &pageToken{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func normalizePageSize(pageSize int) int {
+	if pageSize <= 0 {
+		return defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		return maxPageSize
+	}
+	return pageSize
+}
@@ -0,0 +1,479 @@
+package repository
+
+import (
+	"errors"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestPodRepository(t *testing.T) IPodRepository {
+	t.Helper()
+	db, err := common.OpenDatabase(common.SqliteDialector(":memory:"))
+	if err != nil {
+		t.Fatalf("open database error %s", err)
+	}
+	t.Cleanup(func() {
+		if pool, err := db.DB(); err == nil {
+			_ = pool.Close()
+		}
+	})
+	podRepository := NewPodRepository(db)
+	if err := podRepository.InitTable(); err != nil {
+		t.Fatalf("init table error %s", err)
+	}
+	return podRepository
+}
+
+func newTestPod(name string) *model.Pod {
+	return &model.Pod{
+		PodName:      name,
+		PodNamespace: "default",
+		PodTeamID:    "team",
+		PodReplicas:  2,
+		PodImage:     "nginx:1.25",
+		PodPort: []*model.PodPort{
+			{ContainerPort: 80, Protocol: "TCP"},
+			{ContainerPort: 443, Protocol: "TCP"},
+		},
+		PodEnv: []*model.PodEnv{
+			{EnvKey: "A", EnvValue: "1"},
+			{EnvKey: "B", EnvValue: "2"},
+		},
+		PodLabel: []*model.PodLabel{
+			{LabelKey: "tier", LabelValue: "web"},
+		},
+	}
+}
+
+func mustCreatePod(t *testing.T, podRepository IPodRepository, pod *model.Pod) *model.Pod {
+	t.Helper()
+	if _, err := podRepository.CreatePod(pod); err != nil {
+		t.Fatalf("create pod error %s", err)
+	}
+	created, err := podRepository.FindPodByID(pod.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	return created
+}
+
+func ports(pod *model.Pod) []int32 {
+	var result []int32
+	for _, port := range pod.PodPort {
+		result = append(result, port.ContainerPort)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func envKeys(pod *model.Pod) []string {
+	var result []string
+	for _, env := range pod.PodEnv {
+		result = append(result, env.EnvKey+"="+env.EnvValue)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestUpdatePodReplacesChildren(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	pod := mustCreatePod(t, podRepository, newTestPod("web"))
+	other := mustCreatePod(t, podRepository, newTestPod("other"))
+
+	pod.PodPort = []*model.PodPort{{ID: pod.PodPort[0].ID, ContainerPort: 8080, Protocol: "TCP"}}
+	pod.PodEnv = nil
+	pod.PodLabel = []*model.PodLabel{{LabelKey: "tier", LabelValue: "api"}}
+	if err := podRepository.UpdatePod(pod); err != nil {
+		t.Fatalf("update pod error %s", err)
+	}
+
+	updated, err := podRepository.FindPodByID(pod.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	if got := ports(updated); len(got) != 1 || got[0] != 8080 {
+		t.Errorf("ports = %v, want [8080]", got)
+	}
+	if got := envKeys(updated); len(got) != 0 {
+		t.Errorf("env = %v, want empty", got)
+	}
+	if len(updated.PodLabel) != 1 || updated.PodLabel[0].LabelValue != "api" {
+		t.Errorf("labels = %+v, want tier=api", updated.PodLabel)
+	}
+
+	// 其他 pod 的子表不受影响
+	untouched, err := podRepository.FindPodByID(other.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	if got := ports(untouched); len(got) != 2 {
+		t.Errorf("other pod ports = %v, want 2 ports", got)
+	}
+	if got := envKeys(untouched); len(got) != 2 {
+		t.Errorf("other pod env = %v, want 2 env", got)
+	}
+}
+
+func TestUpdatePodZeroValues(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	pod := mustCreatePod(t, podRepository, newTestPod("web"))
+
+	pod.PodReplicas = 0
+	if err := podRepository.UpdatePod(pod); err != nil {
+		t.Fatalf("update pod error %s", err)
+	}
+	updated, err := podRepository.FindPodByID(pod.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	if updated.PodReplicas != 0 {
+		t.Errorf("replicas = %d, want 0", updated.PodReplicas)
+	}
+	if updated.Version != 2 {
+		t.Errorf("version = %d, want 2", updated.Version)
+	}
+}
+
+// TestUpdatePodKeepsCreatedAt 修改时传入的 pod 来自 PodInfo，没有创建时间
+func TestUpdatePodKeepsCreatedAt(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	pod := mustCreatePod(t, podRepository, newTestPod("web"))
+	if pod.CreatedAt.IsZero() {
+		t.Fatal("created_at is not set")
+	}
+	createdAt := pod.CreatedAt
+	pod.CreatedAt = time.Time{}
+	pod.PodReplicas = 3
+	if err := podRepository.UpdatePod(pod); err != nil {
+		t.Fatalf("update pod error %s", err)
+	}
+	updated, err := podRepository.FindPodByID(pod.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	if !updated.CreatedAt.Equal(createdAt) {
+		t.Errorf("created_at = %s, want %s", updated.CreatedAt, createdAt)
+	}
+}
+
+func TestUpdatePodConflictKeepsChildren(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	pod := mustCreatePod(t, podRepository, newTestPod("web"))
+
+	stale := *pod
+	pod.PodImage = "nginx:1.26"
+	if err := podRepository.UpdatePod(pod); err != nil {
+		t.Fatalf("update pod error %s", err)
+	}
+
+	stale.PodPort = nil
+	stale.PodEnv = nil
+	err := podRepository.UpdatePod(&stale)
+	var conflictErr *model.ConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("update with stale version error = %v, want ConflictError", err)
+	}
+	if conflictErr.CurrentVersion != "2" {
+		t.Errorf("current version = %s, want 2", conflictErr.CurrentVersion)
+	}
+	if stale.Version != 1 {
+		t.Errorf("stale version = %d, want unchanged 1", stale.Version)
+	}
+
+	current, err := podRepository.FindPodByID(pod.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	if got := ports(current); len(got) != 2 {
+		t.Errorf("ports = %v, want 2 ports after conflict", got)
+	}
+	if got := envKeys(current); len(got) != 2 {
+		t.Errorf("env = %v, want 2 env after conflict", got)
+	}
+}
+
+func TestUpdatePodWithOperationReplacesChildren(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	pod := mustCreatePod(t, podRepository, newTestPod("web"))
+
+	pod.PodEnv = []*model.PodEnv{{EnvKey: "C", EnvValue: "3"}}
+	operation := &model.PodOperation{Type: model.OperationUpdate, Status: model.OperationPending}
+	if err := podRepository.UpdatePodWithOperation(pod, operation); err != nil {
+		t.Fatalf("update pod error %s", err)
+	}
+	updated, err := podRepository.FindPodByID(pod.ID)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	if got := envKeys(updated); len(got) != 1 || got[0] != "C=3" {
+		t.Errorf("env = %v, want [C=3]", got)
+	}
+	if operation.ID == 0 || operation.PodID != pod.ID {
+		t.Errorf("operation = %+v, want saved for pod %d", operation, pod.ID)
+	}
+}
+
+func TestFindAllPreloadsChildren(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	mustCreatePod(t, podRepository, newTestPod("web"))
+	mustCreatePod(t, podRepository, newTestPod("api"))
+
+	pods, err := podRepository.FindAll()
+	if err != nil {
+		t.Fatalf("find all error %s", err)
+	}
+	if len(pods) != 2 {
+		t.Fatalf("find all returned %d pods, want 2", len(pods))
+	}
+	for _, pod := range pods {
+		if len(pod.PodPort) != 2 || len(pod.PodEnv) != 2 || len(pod.PodLabel) != 1 {
+			t.Errorf("pod %s children = %d ports %d env %d labels, want 2/2/1",
+				pod.PodName, len(pod.PodPort), len(pod.PodEnv), len(pod.PodLabel))
+		}
+	}
+}
+
+func TestPodNameUniquePerNamespace(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	mustCreatePod(t, podRepository, newTestPod("api"))
+
+	otherNamespace := newTestPod("api")
+	otherNamespace.PodNamespace = "team-b"
+	if _, err := podRepository.CreatePod(otherNamespace); err != nil {
+		t.Fatalf("create pod with same name in another namespace error %s", err)
+	}
+	otherCluster := newTestPod("api")
+	otherCluster.PodCluster = "backup"
+	if _, err := podRepository.CreatePod(otherCluster); err != nil {
+		t.Fatalf("create pod with same name in another cluster error %s", err)
+	}
+
+	_, err := podRepository.CreatePod(newTestPod("api"))
+	var existsErr *model.AlreadyExistsError
+	if !errors.As(err, &existsErr) {
+		t.Fatalf("create duplicate pod error = %v, want AlreadyExistsError", err)
+	}
+	if existsErr.Cluster != model.DefaultCluster || existsErr.Namespace != "default" || existsErr.Name != "api" {
+		t.Errorf("already exists error = %+v", existsErr)
+	}
+
+	found, err := podRepository.FindPodByName(model.DefaultCluster, "team-b", "api")
+	if err != nil {
+		t.Fatalf("find pod by name error %s", err)
+	}
+	if found.ID != otherNamespace.ID || len(found.PodPort) != 2 {
+		t.Errorf("find pod by name = %d with %d ports, want %d with 2 ports", found.ID, len(found.PodPort), otherNamespace.ID)
+	}
+}
+
+func TestDeletedPodDoesNotBlockName(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	deleted := mustCreatePod(t, podRepository, newTestPod("api"))
+	if err := podRepository.DeletePod(deleted.ID); err != nil {
+		t.Fatalf("delete pod error %s", err)
+	}
+	if _, err := podRepository.CreatePod(newTestPod("api")); err != nil {
+		t.Fatalf("create pod with name of deleted pod error %s", err)
+	}
+
+	err := podRepository.RestorePod(deleted.ID)
+	var existsErr *model.AlreadyExistsError
+	if !errors.As(err, &existsErr) {
+		t.Fatalf("restore pod error = %v, want AlreadyExistsError", err)
+	}
+	if _, err := podRepository.FindDeletedPodByID(deleted.ID); err != nil {
+		t.Errorf("pod should stay deleted after failed restore, find error %s", err)
+	}
+}
+
+func podNames(pods []*model.Pod) []string {
+	names := []string{}
+	for _, pod := range pods {
+		names = append(names, pod.PodName)
+	}
+	return names
+}
+
+func TestFindPageLabelSelector(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	web := newTestPod("web")
+	web.PodLabel = append(web.PodLabel, &model.PodLabel{LabelKey: "env", LabelValue: "prod"})
+	mustCreatePod(t, podRepository, web)
+	api := newTestPod("api")
+	api.PodLabel = []*model.PodLabel{{LabelKey: "tier", LabelValue: "api"}}
+	mustCreatePod(t, podRepository, api)
+	worker := newTestPod("worker")
+	worker.PodLabel = nil
+	mustCreatePod(t, podRepository, worker)
+
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"tier=web", []string{"web"}},
+		{"tier==api", []string{"api"}},
+		// 没有这个 key 的 pod 也满足 != 和 notin
+		{"tier!=web", []string{"api", "worker"}},
+		{"tier in (web,api)", []string{"web", "api"}},
+		{"tier notin (web)", []string{"api", "worker"}},
+		{"env", []string{"web"}},
+		{"!env", []string{"api", "worker"}},
+		{"tier=web,env=prod", []string{"web"}},
+		{"tier=web,env=staging", []string{}},
+	}
+	for _, test := range tests {
+		page, err := podRepository.FindPage(&model.PodFilter{LabelSelector: test.selector})
+		if err != nil {
+			t.Fatalf("find page %q error %s", test.selector, err)
+		}
+		if names := podNames(page.Pods); !reflect.DeepEqual(names, test.want) || page.TotalCount != int64(len(test.want)) {
+			t.Errorf("find page %q = %v total %d, want %v", test.selector, names, page.TotalCount, test.want)
+		}
+	}
+
+	for _, selector := range []string{"tier>1", "tier in (web"} {
+		var apiErr *common.Error
+		if _, err := podRepository.FindPage(&model.PodFilter{LabelSelector: selector}); !errors.As(err, &apiErr) ||
+			apiErr.Code != common.CodeInvalidArgument {
+			t.Errorf("find page %q error %v, want invalid argument", selector, err)
+		}
+	}
+}
+
+func TestFindPageEscapesWildcards(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	for _, name := range []string{"a_b", "axb", "a%c", "ayc", "a!d"} {
+		pod := newTestPod(name)
+		pod.PodImage = "registry/" + name + ":1"
+		mustCreatePod(t, podRepository, pod)
+	}
+
+	tests := []struct {
+		filter *model.PodFilter
+		want   []string
+	}{
+		{&model.PodFilter{NamePrefix: "a_"}, []string{"a_b"}},
+		{&model.PodFilter{NamePrefix: "a%"}, []string{"a%c"}},
+		{&model.PodFilter{NamePrefix: "a!"}, []string{"a!d"}},
+		{&model.PodFilter{NamePrefix: "a"}, []string{"a_b", "axb", "a%c", "ayc", "a!d"}},
+		{&model.PodFilter{Image: "/a_b:"}, []string{"a_b"}},
+		{&model.PodFilter{Image: "/a%c:"}, []string{"a%c"}},
+	}
+	for _, test := range tests {
+		page, err := podRepository.FindPage(test.filter)
+		if err != nil {
+			t.Fatalf("find page %+v error %s", test.filter, err)
+		}
+		if names := podNames(page.Pods); !reflect.DeepEqual(names, test.want) {
+			t.Errorf("find page %+v = %v, want %v", test.filter, names, test.want)
+		}
+	}
+}
+
+func TestFindPageOrdersTiesByID(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	// 名称只在命名空间内唯一，不同命名空间的同名 pod 按 id 排序
+	var webIDs, apiIDs []int64
+	for _, namespace := range []string{"ns-1", "ns-2", "ns-3"} {
+		for _, name := range []string{"web", "api"} {
+			pod := newTestPod(name)
+			pod.PodNamespace = namespace
+			mustCreatePod(t, podRepository, pod)
+			if name == "web" {
+				webIDs = append(webIDs, pod.ID)
+			} else {
+				apiIDs = append(apiIDs, pod.ID)
+			}
+		}
+	}
+
+	reversed := func(ids []int64) []int64 {
+		result := make([]int64, 0, len(ids))
+		for i := len(ids) - 1; i >= 0; i-- {
+			result = append(result, ids[i])
+		}
+		return result
+	}
+	tests := []struct {
+		orderBy string
+		want    []int64
+	}{
+		{"pod_name", append(append([]int64{}, apiIDs...), webIDs...)},
+		{"-pod_name", append(reversed(webIDs), reversed(apiIDs)...)},
+	}
+	for _, test := range tests {
+		var ids []int64
+		filter := &model.PodFilter{OrderBy: test.orderBy, PageSize: 2}
+		for pages := 0; ; pages++ {
+			if pages > len(test.want) {
+				t.Fatalf("order by %s did not finish paging", test.orderBy)
+			}
+			page, err := podRepository.FindPage(filter)
+			if err != nil {
+				t.Fatalf("find page order by %s error %s", test.orderBy, err)
+			}
+			if page.TotalCount != int64(len(test.want)) {
+				t.Fatalf("total count %d, want %d", page.TotalCount, len(test.want))
+			}
+			for _, pod := range page.Pods {
+				ids = append(ids, pod.ID)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			filter.PageToken = page.NextPageToken
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("order by %s = %v, want %v", test.orderBy, ids, test.want)
+		}
+	}
+
+	if _, err := podRepository.FindPage(&model.PodFilter{OrderBy: "id", PageToken: encodePageToken(&pageToken{OrderBy: "pod_name"})}); !errors.Is(err, ErrInvalidPageToken) {
+		t.Errorf("page token for another order error %v, want ErrInvalidPageToken", err)
+	}
+}
+
+func TestPurgeDeletedPodsRemovesOperationsAndEvents(t *testing.T) {
+	podRepository := newTestPodRepository(t)
+	db := podRepository.(*PodRepository).mysqlDb
+	eventRepository := NewPodEventRepository(db)
+	var ids []int64
+	for _, name := range []string{"web", "api"} {
+		pod := newTestPod(name)
+		if err := podRepository.CreatePodWithOperation(pod, &model.PodOperation{Type: model.OperationCreate, Status: model.OperationSucceed}); err != nil {
+			t.Fatalf("create pod error %s", err)
+		}
+		if err := eventRepository.SaveEvents([]*model.PodEventRecord{{PodID: pod.ID, EventUID: name, Reason: "BackOff"}}); err != nil {
+			t.Fatalf("save events error %s", err)
+		}
+		ids = append(ids, pod.ID)
+	}
+	if err := podRepository.DeletePodWithOperation(ids[0], &model.PodOperation{Type: model.OperationDelete, Status: model.OperationSucceed}); err != nil {
+		t.Fatalf("delete pod error %s", err)
+	}
+
+	purged, err := podRepository.PurgeDeletedPods(time.Now().Add(time.Minute))
+	if err != nil || purged != 1 {
+		t.Fatalf("purged %d error %v, want 1", purged, err)
+	}
+	for _, table := range []interface{}{&model.Pod{}, &model.PodPort{}, &model.PodEnv{}, &model.PodLabel{}, &model.PodOperation{}, &model.PodEventRecord{}} {
+		column := "pod_id"
+		if _, ok := table.(*model.Pod); ok {
+			column = "id"
+		}
+		// 第一个 pod 已经彻底删除，第二个 pod 的数据不受影响
+		for i, id := range ids {
+			var count int64
+			if err := db.Unscoped().Model(table).Where(column+" = ?", id).Count(&count).Error; err != nil {
+				t.Fatalf("count %T error %s", table, err)
+			}
+			if purged := i == 0; (count == 0) != purged {
+				t.Errorf("%T rows of pod %d = %d, want purged %v", table, id, count, purged)
+			}
+		}
+	}
+}
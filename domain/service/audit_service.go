@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type IAuditService interface {
+	// Record 根据修改前后的 pod 生成审计记录，before 或者 after 可以为空
+	Record(log *model.AuditLog, before, after *model.Pod) error
+	Query(filter *model.AuditFilter) ([]*model.AuditLog, error)
+}
+
+type AuditService struct {
+	AuditRepository repository.IAuditRepository
+}
+
+func NewAuditService(auditRepository repository.IAuditRepository) IAuditService {
+	return &AuditService{AuditRepository: auditRepository}
+}
+
+func (a AuditService) Record(log *model.AuditLog, before, after *model.Pod) error {
+	for _, podModel := range []*model.Pod{after, before} {
+		if podModel != nil {
+			log.PodID = podModel.ID
+			log.PodName = podModel.PodName
+			log.PodNamespace = podModel.PodNamespace
+			log.PodTeamID = podModel.PodTeamID
+			break
+		}
+	}
+	beforeFields, err := toFields(before)
+	if err != nil {
+		return err
+	}
+	afterFields, err := toFields(after)
+	if err != nil {
+		return err
+	}
+	if log.Before, err = marshalFields(beforeFields); err != nil {
+		return err
+	}
+	if log.After, err = marshalFields(afterFields); err != nil {
+		return err
+	}
+
+	diff := map[string]map[string]interface{}{}
+	for key := range mergeKeys(beforeFields, afterFields) {
+		if !reflect.DeepEqual(beforeFields[key], afterFields[key]) {
+			diff[key] = map[string]interface{}{"before": beforeFields[key], "after": afterFields[key]}
+		}
+	}
+	if len(diff) > 0 {
+		data, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		log.Diff = string(data)
+	}
+	return a.AuditRepository.CreateAuditLog(log)
+}
+
+func (a AuditService) Query(filter *model.AuditFilter) ([]*model.AuditLog, error) {
+	return a.AuditRepository.FindAuditLogs(filter)
+}
+
+func toFields(podModel *model.Pod) (map[string]interface{}, error) {
+	if podModel == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(podModel)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func marshalFields(fields map[string]interface{}) (string, error) {
+	if fields == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(fields)
+	return string(data), err
+}
+
+func mergeKeys(maps ...map[string]interface{}) map[string]bool {
+	keys := map[string]bool{}
+	for _, m := range maps {
+		for key := range m {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+type auditOutcomeKey struct{}
+
+// AuditOutcome 收集一次请求中对 k8s 的操作结果，由审计 wrapper 放到 context 中
+type AuditOutcome struct {
+	mu       sync.Mutex
+	outcomes []string
+}
+
+func (a *AuditOutcome) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return strings.Join(a.outcomes, "; ")
+}
+
+func WithAuditOutcome(ctx context.Context) (context.Context, *AuditOutcome) {
+	outcome := &AuditOutcome{}
+	return context.WithValue(ctx, auditOutcomeKey{}, outcome), outcome
+}
+
+// RecordK8sOutcome 记录一次 k8s 操作的结果，context 中没有 AuditOutcome 时什么也不做
+func RecordK8sOutcome(ctx context.Context, action string, err error) {
+	outcome, ok := ctx.Value(auditOutcomeKey{}).(*AuditOutcome)
+	if !ok {
+		return
+	}
+	result := action + ": ok"
+	if err != nil {
+		result = action + ": " + err.Error()
+	}
+	outcome.mu.Lock()
+	defer outcome.mu.Unlock()
+	outcome.outcomes = append(outcome.outcomes, result)
+}
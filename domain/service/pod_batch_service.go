@@ -0,0 +1,366 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/DuanNengxin/wepass-pod/validation"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 批量操作中每一项的状态
+const (
+	BatchSucceeded = "succeeded"
+	BatchFailed    = "failed"
+	// BatchPending 超时的时候还没有应用完成，worker 会继续执行
+	BatchPending    = "pending"
+	BatchRolledBack = "rolled_back"
+	// BatchSkipped atomic 时前面的项失败，这一项没有提交
+	BatchSkipped = "skipped"
+)
+
+const (
+	defaultBatchConcurrency = 5
+	maxBatchConcurrency     = 20
+	defaultBatchTimeout     = 5 * time.Minute
+)
+
+type IPodBatchService interface {
+	BatchApply(ctx context.Context, request *pod.BatchApplyRequest) (*pod.BatchResponse, error)
+	BatchDelete(ctx context.Context, request *pod.BatchDeleteRequest) (*pod.BatchResponse, error)
+}
+
+// PodBatchService 每一项和单个接口一样先写数据库和操作，再由这里并发执行操作，不等待 worker
+type PodBatchService struct {
+	PodDataService      IPodDataService
+	PodOperationService IPodOperationService
+	PodHistoryService   IPodHistoryService
+}
+
+func NewPodBatchService(podDataService IPodDataService, podOperationService IPodOperationService,
+	podHistoryService IPodHistoryService) IPodBatchService {
+	return &PodBatchService{
+		PodDataService:      podDataService,
+		PodOperationService: podOperationService,
+		PodHistoryService:   podHistoryService,
+	}
+}
+
+// batchItem pod 是要提交的 pod，previous 是修改之前的 pod，回滚更新时写回
+type batchItem struct {
+	result    *pod.BatchItemResult
+	pod       *model.Pod
+	previous  *model.Pod
+	operation *model.PodOperation
+}
+
+func (b *batchItem) fail(err error) {
+	b.result.Status = BatchFailed
+	b.result.Error = err.Error()
+}
+
+func (p PodBatchService) BatchApply(ctx context.Context, request *pod.BatchApplyRequest) (*pod.BatchResponse, error) {
+	if len(request.PodInfos) == 0 {
+		return nil, common.InvalidArgument("pod_infos is empty").WithField("pod_infos", "at least one pod is required")
+	}
+	items := make([]*batchItem, 0, len(request.PodInfos))
+	for i, info := range request.PodInfos {
+		items = append(items, p.prepareApply(i, info))
+	}
+	return p.run(ctx, items, request.Concurrency, request.Atomic, request.TimeoutSeconds), nil
+}
+
+func (p PodBatchService) BatchDelete(ctx context.Context, request *pod.BatchDeleteRequest) (*pod.BatchResponse, error) {
+	if len(request.Ids) == 0 {
+		return nil, common.InvalidArgument("ids is empty").WithField("ids", "at least one pod id is required")
+	}
+	items := make([]*batchItem, 0, len(request.Ids))
+	for i, id := range request.Ids {
+		item := &batchItem{result: &pod.BatchItemResult{Index: int32(i), PodId: id, Action: model.OperationDelete}}
+		current, err := p.PodDataService.FindPodByID(id)
+		if err != nil {
+			item.fail(err)
+		} else {
+			item.pod = current
+			item.result.PodNamespace, item.result.PodName = current.PodNamespace, current.PodName
+		}
+		items = append(items, item)
+	}
+	return p.run(ctx, items, request.Concurrency, request.Atomic, request.TimeoutSeconds), nil
+}
+
+// prepareApply 和 AddPod、UpdatePod 做同样的检查，检查失败的项不会提交
+func (p PodBatchService) prepareApply(index int, info *pod.PodInfo) *batchItem {
+	item := &batchItem{result: &pod.BatchItemResult{
+		Index:        int32(index),
+		PodId:        info.Id,
+		PodNamespace: info.PodNamespace,
+		PodName:      info.PodName,
+		Action:       model.OperationCreate,
+	}}
+	info.PodCluster = model.ClusterOrDefault(info.PodCluster)
+	if errs := validation.ValidatePodInfo(info); len(errs) > 0 {
+		item.fail(errs.ToAggregate())
+		return item
+	}
+	item.pod = &model.Pod{}
+	if err := common.SwapTo(info, item.pod); err != nil {
+		item.fail(err)
+		return item
+	}
+	if info.Id == 0 {
+		// 只有不存在时才能创建，查询出错时不能确定
+		_, err := p.PodDataService.FindPodByName(info.PodCluster, info.PodNamespace, info.PodName)
+		switch {
+		case err == nil:
+			item.fail(&model.AlreadyExistsError{Kind: "pod", Cluster: info.PodCluster, Namespace: info.PodNamespace, Name: info.PodName})
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			item.fail(err)
+		}
+		return item
+	}
+	item.result.Action = model.OperationUpdate
+	current, err := p.PodDataService.FindPodByID(info.Id)
+	if err != nil {
+		item.fail(err)
+		return item
+	}
+	if current.Version != info.ResourceVersion {
+		item.fail(&model.ConflictError{Kind: "pod", Name: current.PodName, CurrentVersion: strconv.FormatInt(current.Version, 10)})
+		return item
+	}
+	if errs := validation.ValidatePodUpdate(info, current); len(errs) > 0 {
+		item.fail(errs.ToAggregate())
+		return item
+	}
+	item.previous = current
+	return item
+}
+
+// run atomic 时有一项检查或者提交失败就不再提交后面的项，执行完之后有任何一项失败或者超时还没有完成就回滚其他项
+// 超时的项和失败一样处理，回滚操作排在它后面，由 worker 执行完之后再回滚
+func (p PodBatchService) run(ctx context.Context, items []*batchItem, concurrency int32, atomic bool, timeoutSeconds int32) *pod.BatchResponse {
+	timeout := defaultBatchTimeout
+	if timeoutSeconds > 0 {
+		timeout = time.Duration(timeoutSeconds) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	failed := atomic && anyFailed(items)
+	var operations []*model.PodOperation
+	for _, item := range items {
+		if item.result.Status == BatchFailed {
+			continue
+		}
+		if failed {
+			item.result.Status = BatchSkipped
+			continue
+		}
+		if err := p.submit(item); err != nil {
+			zap.S().Errorf("batch %s pod %s/%s error %s", item.result.Action, item.result.PodNamespace,
+				item.result.PodName, err.Error())
+			item.fail(err)
+			failed = atomic
+			continue
+		}
+		operations = append(operations, item.operation)
+	}
+	p.executeAll(ctx, operations, concurrency, deadline)
+	for _, item := range items {
+		if item.operation != nil {
+			setStatus(item.result, item.operation)
+		}
+	}
+
+	timedOut := false
+	for _, item := range items {
+		if atomic && item.result.Status == BatchPending {
+			item.result.Error = "operation did not finish before the timeout"
+			timedOut = true
+		}
+	}
+	response := &pod.BatchResponse{}
+	if atomic && (anyFailed(items) || timedOut) {
+		p.rollback(ctx, items, concurrency, deadline)
+		response.RolledBack = true
+	}
+	for _, item := range items {
+		response.Results = append(response.Results, item.result)
+		switch item.result.Status {
+		case BatchSucceeded:
+			response.Succeeded++
+		case BatchFailed:
+			response.Failed++
+		}
+	}
+	return response
+}
+
+func (p PodBatchService) submit(item *batchItem) error {
+	var err error
+	switch item.result.Action {
+	case model.OperationCreate:
+		item.operation, err = p.PodDataService.SubmitCreate(item.pod)
+	case model.OperationUpdate:
+		item.operation, err = p.PodDataService.SubmitUpdate(item.pod, item.previous)
+	case model.OperationDelete:
+		item.operation, err = p.PodDataService.SubmitDelete(item.pod)
+	}
+	if err != nil {
+		return err
+	}
+	before, after := item.previous, item.pod
+	if item.result.Action == model.OperationDelete {
+		before, after = item.pod, nil
+	}
+	p.PodHistoryService.RecordSpecChange(item.operation.Type, item.operation.ID, before, after)
+	item.result.PodId = item.pod.ID
+	item.result.ResourceVersion = item.pod.Version
+	item.result.OperationId = item.operation.ID
+	return nil
+}
+
+// rollback 成功和还在执行的项提交相反的操作，同一个 pod 的操作按顺序执行，还在执行的项会先执行完
+// 已经补偿的项数据库和集群都没有修改，不需要回滚
+func (p PodBatchService) rollback(ctx context.Context, items []*batchItem, concurrency int32, deadline time.Time) {
+	var rollbacks []*model.PodOperation
+	rolledBack := map[*model.PodOperation]*batchItem{}
+	for _, item := range items {
+		if item.result.Status != BatchSucceeded && item.result.Status != BatchPending {
+			continue
+		}
+		operation, err := p.submitRollback(item)
+		if err != nil {
+			zap.S().Errorf("batch rollback pod %d error %s", item.result.PodId, err.Error())
+			item.result.Error = "rollback error " + err.Error()
+			continue
+		}
+		item.result.RollbackOperationId = operation.ID
+		rollbacks = append(rollbacks, operation)
+		rolledBack[operation] = item
+	}
+	p.executeAll(ctx, rollbacks, concurrency, deadline)
+	for operation, item := range rolledBack {
+		switch operation.Status {
+		case model.OperationSucceed:
+			item.result.Status = BatchRolledBack
+		case model.OperationPending, model.OperationRunning:
+			item.result.Status = BatchPending
+			item.result.Error = "rollback operation is still running"
+		default:
+			item.result.Status = BatchFailed
+			item.result.Error = "rollback " + operation.Status + ": " + operation.LastError
+		}
+	}
+}
+
+func (p PodBatchService) submitRollback(item *batchItem) (*model.PodOperation, error) {
+	var operation *model.PodOperation
+	switch item.result.Action {
+	case model.OperationCreate:
+		current, err := p.PodDataService.FindPodByID(item.pod.ID)
+		if err != nil {
+			return nil, err
+		}
+		if operation, err = p.PodDataService.SubmitDelete(current); err != nil {
+			return nil, err
+		}
+		p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, current, nil)
+	case model.OperationUpdate:
+		current, err := p.PodDataService.FindPodByID(item.pod.ID)
+		if err != nil {
+			return nil, err
+		}
+		previous := *item.previous
+		previous.Version = current.Version
+		if operation, err = p.PodDataService.SubmitUpdate(&previous, current); err != nil {
+			return nil, err
+		}
+		p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, current, &previous)
+		item.result.ResourceVersion = previous.Version
+	case model.OperationDelete:
+		deleted, err := p.PodDataService.FindDeletedPodByID(item.pod.ID)
+		if err != nil {
+			return nil, err
+		}
+		if operation, err = p.PodDataService.SubmitRestore(deleted); err != nil {
+			return nil, err
+		}
+		p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, nil, deleted)
+	}
+	return operation, nil
+}
+
+// executeAll 最多 concurrency 个操作同时应用到 k8s，执行完之后 operations 中是最新的状态
+func (p PodBatchService) executeAll(ctx context.Context, operations []*model.PodOperation, concurrency int32, deadline time.Time) {
+	if concurrency <= 0 {
+		concurrency = defaultBatchConcurrency
+	}
+	if concurrency > maxBatchConcurrency {
+		concurrency = maxBatchConcurrency
+	}
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, operation := range operations {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(operation *model.PodOperation) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if executed := p.execute(ctx, operation.ID, deadline); executed != nil {
+				*operation = *executed
+			}
+		}(operation)
+	}
+	wg.Wait()
+}
+
+// execute 先直接执行，被 worker 领取、等待重试或者前面还有同一个 pod 的操作时等待 worker 执行完
+func (p PodBatchService) execute(ctx context.Context, id int64, deadline time.Time) *model.PodOperation {
+	operation, err := p.PodOperationService.Execute(id)
+	if err != nil {
+		zap.S().Errorf("batch execute operation %d error %s", id, err.Error())
+	}
+	if operation != nil && operation.Finished() {
+		return operation
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return operation
+	}
+	waited, err := p.PodOperationService.WaitOperation(ctx, id, timeout)
+	if err != nil {
+		zap.S().Errorf("batch wait operation %d error %s", id, err.Error())
+		return operation
+	}
+	return waited
+}
+
+func setStatus(result *pod.BatchItemResult, operation *model.PodOperation) {
+	switch operation.Status {
+	case model.OperationSucceed:
+		result.Status = BatchSucceeded
+	case model.OperationCompensated, model.OperationFailed:
+		result.Status = BatchFailed
+		result.Error = operation.Status + ": " + operation.LastError
+	default:
+		result.Status = BatchPending
+	}
+}
+
+func anyFailed(items []*batchItem) bool {
+	for _, item := range items {
+		if item.result.Status == BatchFailed {
+			return true
+		}
+	}
+	return false
+}
@@ -2,37 +2,73 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
 	"github.com/DuanNengxin/wepass-pod/domain/model"
 	"github.com/DuanNengxin/wepass-pod/domain/repository"
 	pod "github.com/DuanNengxin/wepass-pod/proto"
 	"go.uber.org/zap"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// wepass 管理的 k8s 资源都会带上这些标签，watch 和对账都依赖它们做过滤
+const (
+	LabelAppName   = "app-name"
+	LabelManagedBy = "wepass.io/managed-by"
+	LabelTeam      = "wepass.io/team"
+	ManagedBy      = "wepass-pod"
+)
+
+// deploymentTypeMeta 导出和 dry run 生成的 yaml 需要完整的 kind 和 apiVersion
+var deploymentTypeMeta = metav1.TypeMeta{
+	Kind:       "Deployment",
+	APIVersion: "apps/v1",
+}
+
 type IPodDataService interface {
 	AddPod(pod *model.Pod) (int64, error)
 	UpdatePod(pod *model.Pod) error
 	DeletePod(int64) error
 	FindPodByID(id int64) (*model.Pod, error)
 	FindAll() ([]*model.Pod, error)
+	FindPage(filter *model.PodFilter) (*model.PodPage, error)
+	FindPodByName(cluster, namespace, name string) (*model.Pod, error)
+	FindDeletedPods(namespace, teamID string) ([]*model.Pod, error)
+	FindDeletedPodByID(id int64) (*model.Pod, error)
+	RestorePod(id int64) error
+	PurgeDeletedPods(before time.Time) (int64, error)
+	// 下面的方法只修改数据库，同时写入待执行的操作，由 PodOperationService 应用到 k8s
+	SubmitCreate(pod *model.Pod) (*model.PodOperation, error)
+	SubmitUpdate(pod *model.Pod, previous *model.Pod) (*model.PodOperation, error)
+	SubmitDelete(pod *model.Pod) (*model.PodOperation, error)
+	SubmitRestore(pod *model.Pod) (*model.PodOperation, error)
 	CreateToK8s(info *pod.PodInfo) error
 	UpdateToK8s(info *pod.PodInfo) error
 	DeleteToK8s(*model.Pod) error
+	// DryRunToK8s 只校验不保存，返回生成的资源清单和与集群中对象的差异
+	DryRunToK8s(info *pod.PodInfo) ([]*pod.Manifest, error)
+	// WaitForRollout 等待 Deployment 滚动更新完成，失败或者超时时返回的状态中带有原因
+	WaitForRollout(ctx context.Context, namespace, name string, timeout time.Duration) (*pod.RolloutStatus, error)
 }
 
 type PodDataService struct {
 	PodRepository repository.IPodRepository
-	K8sClientSet  *kubernetes.Clientset
+	K8sClientSet  kubernetes.Interface
 	deployment    *appsv1.Deployment
 }
 
-func NewPodDataService(podRepository repository.IPodRepository, clientSet *kubernetes.Clientset) IPodDataService {
+func NewPodDataService(podRepository repository.IPodRepository, clientSet kubernetes.Interface) IPodDataService {
 	return &PodDataService{
 		PodRepository: podRepository,
 		K8sClientSet:  clientSet,
@@ -60,39 +96,136 @@ func (p PodDataService) FindAll() ([]*model.Pod, error) {
 	return p.PodRepository.FindAll()
 }
 
+func (p PodDataService) FindPage(filter *model.PodFilter) (*model.PodPage, error) {
+	return p.PodRepository.FindPage(filter)
+}
+
+func (p PodDataService) FindPodByName(cluster, namespace, name string) (*model.Pod, error) {
+	return p.PodRepository.FindPodByName(cluster, namespace, name)
+}
+
+func (p PodDataService) FindDeletedPods(namespace, teamID string) ([]*model.Pod, error) {
+	return p.PodRepository.FindDeletedPods(namespace, teamID)
+}
+
+func (p PodDataService) FindDeletedPodByID(id int64) (*model.Pod, error) {
+	return p.PodRepository.FindDeletedPodByID(id)
+}
+
+func (p PodDataService) RestorePod(id int64) error {
+	return p.PodRepository.RestorePod(id)
+}
+
+func (p PodDataService) PurgeDeletedPods(before time.Time) (int64, error) {
+	return p.PodRepository.PurgeDeletedPods(before)
+}
+
+func (p PodDataService) SubmitCreate(pod *model.Pod) (*model.PodOperation, error) {
+	operation, err := newOperation(model.OperationCreate, pod, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.PodRepository.CreatePodWithOperation(pod, operation); err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func (p PodDataService) SubmitUpdate(pod *model.Pod, previous *model.Pod) (*model.PodOperation, error) {
+	operation, err := newOperation(model.OperationUpdate, pod, previous)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.PodRepository.UpdatePodWithOperation(pod, operation); err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+func (p PodDataService) SubmitDelete(pod *model.Pod) (*model.PodOperation, error) {
+	operation, err := newOperation(model.OperationDelete, pod, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.PodRepository.DeletePodWithOperation(pod.ID, operation); err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// SubmitRestore 恢复软删除的 pod，重新创建 Deployment
+func (p PodDataService) SubmitRestore(pod *model.Pod) (*model.PodOperation, error) {
+	operation, err := newOperation(model.OperationCreate, pod, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.PodRepository.RestorePodWithOperation(pod.ID, operation); err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// newOperation spec 是期望的 pod，previous 是修改之前的 pod，补偿时写回数据库
+// 所有的操作都用同一个 clientset 执行，不支持的集群不能提交
+func newOperation(operationType string, spec *model.Pod, previous *model.Pod) (*model.PodOperation, error) {
+	if !model.IsSupportedCluster(spec.PodCluster) {
+		return nil, common.InvalidArgument("unsupported cluster %s", spec.PodCluster).
+			WithField("pod_cluster", "must be one of "+strings.Join(model.SupportedClusters, ", "))
+	}
+	operation := &model.PodOperation{
+		Type:      operationType,
+		Status:    model.OperationPending,
+		NextRunAt: time.Now(),
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	operation.Spec = string(data)
+	if previous != nil {
+		if data, err = json.Marshal(previous); err != nil {
+			return nil, err
+		}
+		operation.Previous = string(data)
+	}
+	return operation, nil
+}
+
 func (p PodDataService) CreateToK8s(info *pod.PodInfo) error {
 	p.SetDeployment(info)
 	if _, err := p.K8sClientSet.AppsV1().Deployments(info.PodNamespace).Create(context.TODO(), p.deployment, metav1.CreateOptions{}); err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			//可以写自己的业务逻辑
+			zap.S().Error("Pod " + info.PodName + "已经存在")
+			return fmt.Errorf("Pod %s 已经存在: %w", info.PodName, err)
+		}
 		return err
-	} else {
-		//可以写自己的业务逻辑
-		zap.S().Error("Pod " + info.PodName + "已经存在")
-		return errors.New("Pod " + info.PodName + " 已经存在")
 	}
+	return nil
 }
 
 func (p *PodDataService) SetDeployment(info *pod.PodInfo) {
+	p.deployment = p.buildDeployment(info)
+}
+
+// buildDeployment 根据 PodInfo 生成期望的 Deployment
+func (p *PodDataService) buildDeployment(info *pod.PodInfo) *appsv1.Deployment {
 	deployment := appsv1.Deployment{}
-	deployment.TypeMeta = metav1.TypeMeta{
-		Kind:       "deployment",
-		APIVersion: "v1",
-	}
+	deployment.TypeMeta = deploymentTypeMeta
 	deployment.ObjectMeta = metav1.ObjectMeta{
 		Name:      info.PodName,
 		Namespace: info.PodNamespace,
-		Labels: map[string]string{
-			"app-name": info.PodName,
-		},
+		Labels:    p.getLabels(info),
 		//Annotations: nil,
 	}
 	deployment.Spec = appsv1.DeploymentSpec{
 		Replicas: &info.PodReplicas,
 		Selector: &metav1.LabelSelector{
-			MatchLabels: map[string]string{"app-name": info.PodName},
+			MatchLabels: map[string]string{LabelAppName: info.PodName},
 		},
 		Template: corev1.PodTemplateSpec{
 			ObjectMeta: metav1.ObjectMeta{
-				Labels: map[string]string{"app_name": info.PodName},
+				Labels: p.getLabels(info),
 			},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
@@ -108,14 +241,25 @@ func (p *PodDataService) SetDeployment(info *pod.PodInfo) {
 				RestartPolicy: p.getRestartPolicy(info.PodRestart),
 			},
 		},
-		Strategy:                appsv1.DeploymentStrategy{},
+		Strategy:                p.getStrategy(info.PodType),
 		MinReadySeconds:         0,
 		RevisionHistoryLimit:    nil,
 		Paused:                  false,
 		ProgressDeadlineSeconds: nil,
 	}
-	p.deployment = &deployment
-	return
+	return &deployment
+}
+
+// getLabels 用户标签加上 wepass 管理的标签，管理标签不能被覆盖
+func (p *PodDataService) getLabels(info *pod.PodInfo) map[string]string {
+	labels := map[string]string{}
+	for _, label := range info.PodLabel {
+		labels[label.LabelKey] = label.LabelValue
+	}
+	labels[LabelAppName] = info.PodName
+	labels[LabelManagedBy] = ManagedBy
+	labels[LabelTeam] = info.PodTeamId
+	return labels
 }
 
 func (p *PodDataService) getContainerPort(info *pod.PodInfo) []corev1.ContainerPort {
@@ -179,6 +323,14 @@ func (p *PodDataService) getImagePullPolicy(policy string) corev1.PullPolicy {
 	}
 }
 
+// getStrategy k8s 只支持 Recreate 和 RollingUpdate，其他类型都按滚动更新处理
+func (p *PodDataService) getStrategy(podType string) appsv1.DeploymentStrategy {
+	if podType == "Recreate" {
+		return appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	}
+	return appsv1.DeploymentStrategy{Type: appsv1.RollingUpdateDeploymentStrategyType}
+}
+
 func (p *PodDataService) getRestartPolicy(policy string) corev1.RestartPolicy {
 	switch policy {
 	case "Always":
@@ -192,9 +344,23 @@ func (p *PodDataService) getRestartPolicy(policy string) corev1.RestartPolicy {
 	}
 }
 
+// UpdateToK8s 带上集群中当前的 resourceVersion 更新，期间被别人修改过时返回 ConflictError
 func (p PodDataService) UpdateToK8s(info *pod.PodInfo) error {
 	p.SetDeployment(info)
-	if _, err := p.K8sClientSet.AppsV1().Deployments(info.PodNamespace).Update(context.TODO(), p.deployment, metav1.UpdateOptions{}); err != nil {
+	deployments := p.K8sClientSet.AppsV1().Deployments(info.PodNamespace)
+	live, err := deployments.Get(context.TODO(), info.PodName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	p.deployment.ResourceVersion = live.ResourceVersion
+	if _, err := deployments.Update(context.TODO(), p.deployment, metav1.UpdateOptions{}); err != nil {
+		if k8serrors.IsConflict(err) {
+			current := live.ResourceVersion
+			if latest, err := deployments.Get(context.TODO(), info.PodName, metav1.GetOptions{}); err == nil {
+				current = latest.ResourceVersion
+			}
+			return &model.ConflictError{Kind: "deployment", Name: info.PodName, CurrentVersion: current}
+		}
 		return err
 	}
 	return nil
@@ -206,3 +372,100 @@ func (p PodDataService) DeleteToK8s(pod *model.Pod) error {
 	}
 	return nil
 }
+
+// 这些原因说明 pod 不可能自己恢复，不需要等到超时
+var rolloutFatalReasons = map[string]bool{
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+}
+
+func (p PodDataService) WaitForRollout(ctx context.Context, namespace, name string, timeout time.Duration) (*pod.RolloutStatus, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status := &pod.RolloutStatus{}
+	err := wait.PollImmediateUntil(2*time.Second, func() (bool, error) {
+		deployment, err := p.K8sClientSet.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		status = getRolloutStatus(deployment)
+		if status.Completed || status.Reason != "" {
+			return true, nil
+		}
+		if reason, message := p.getReplicaFailure(deployment); rolloutFatalReasons[reason] {
+			status.Reason, status.Message = reason, message
+			return true, nil
+		}
+		return false, nil
+	}, waitCtx.Done())
+	// 调用方已经取消，不再等待
+	if err != nil && ctx.Err() != nil {
+		return status, ctx.Err()
+	}
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		status.Reason = "Timeout"
+		status.Message = fmt.Sprintf("rollout not finished after %s", timeout)
+		// 超时的时候尽量给出副本没有就绪的原因
+		if deployment, err := p.K8sClientSet.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+			if reason, message := p.getReplicaFailure(deployment); reason != "" {
+				status.Reason, status.Message = reason, message
+			}
+		}
+		return status, nil
+	}
+	return status, err
+}
+
+// getRolloutStatus 和 kubectl rollout status 的判断逻辑一致
+func getRolloutStatus(deployment *appsv1.Deployment) *pod.RolloutStatus {
+	status := &pod.RolloutStatus{
+		Replicas:           getReplicas(deployment),
+		UpdatedReplicas:    deployment.Status.UpdatedReplicas,
+		ReadyReplicas:      deployment.Status.ReadyReplicas,
+		AvailableReplicas:  deployment.Status.AvailableReplicas,
+		ObservedGeneration: deployment.Status.ObservedGeneration,
+	}
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		return status
+	}
+	for _, condition := range deployment.Status.Conditions {
+		switch {
+		case condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded":
+			status.Reason, status.Message = condition.Reason, condition.Message
+			return status
+		case condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == corev1.ConditionTrue:
+			status.Reason, status.Message = condition.Reason, condition.Message
+			return status
+		}
+	}
+	status.Completed = deployment.Status.UpdatedReplicas >= status.Replicas &&
+		deployment.Status.Replicas <= deployment.Status.UpdatedReplicas &&
+		deployment.Status.AvailableReplicas >= deployment.Status.UpdatedReplicas
+	return status
+}
+
+// getReplicaFailure 从副本的状态中找出没有就绪的原因
+func (p PodDataService) getReplicaFailure(deployment *appsv1.Deployment) (string, string) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return "", ""
+	}
+	replicas, err := p.K8sClientSet.CoreV1().Pods(deployment.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", ""
+	}
+	for _, replica := range replicas.Items {
+		for _, status := range replica.Status.ContainerStatuses {
+			if status.State.Waiting != nil && status.State.Waiting.Reason != "ContainerCreating" {
+				return status.State.Waiting.Reason, replica.Name + ": " + status.State.Waiting.Message
+			}
+		}
+		for _, condition := range replica.Status.Conditions {
+			if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+				return condition.Reason, replica.Name + ": " + condition.Message
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/pmezard/go-difflib/difflib"
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ManifestCreate    = "create"
+	ManifestUpdate    = "update"
+	ManifestUnchanged = "unchanged"
+)
+
+// DryRunToK8s 生成 Deployment 并用 server-side dry run 提交，admission 和校验都会执行，但不会保存
+// 集群中已经存在时按更新处理，diff 比较的是集群中的对象和 dry run 返回的对象
+// 已经存在的 Deployment 不是 wepass 管理的时候和 worker 一样返回已经存在
+func (p PodDataService) DryRunToK8s(info *pod.PodInfo) ([]*pod.Manifest, error) {
+	desired := p.buildDeployment(info)
+	manifest := &pod.Manifest{
+		Kind:      desired.Kind,
+		Namespace: desired.Namespace,
+		Name:      desired.Name,
+		Action:    ManifestCreate,
+	}
+	data, err := yaml.Marshal(desired)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Yaml = string(data)
+
+	deployments := p.K8sClientSet.AppsV1().Deployments(info.PodNamespace)
+	live, err := deployments.Get(context.TODO(), info.PodName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		return nil, err
+	} else if err := checkManaged(live, info.PodName); err != nil {
+		return nil, err
+	}
+	dryRun := []string{metav1.DryRunAll}
+	var result *appsv1.Deployment
+	if live == nil {
+		result, err = deployments.Create(context.TODO(), desired, metav1.CreateOptions{DryRun: dryRun})
+	} else {
+		manifest.Action = ManifestUpdate
+		desired.ResourceVersion = live.ResourceVersion
+		result, err = deployments.Update(context.TODO(), desired, metav1.UpdateOptions{DryRun: dryRun})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Diff, err = diffDeployment(live, result)
+	if err != nil {
+		return nil, err
+	}
+	if live != nil && manifest.Diff == "" {
+		manifest.Action = ManifestUnchanged
+	}
+	return []*pod.Manifest{manifest}, nil
+}
+
+// diffDeployment live 为空时所有内容都是新增
+func diffDeployment(live, result *appsv1.Deployment) (string, error) {
+	var before, after []byte
+	var err error
+	if live != nil {
+		if before, err = yaml.Marshal(comparable(live)); err != nil {
+			return "", err
+		}
+	}
+	if after, err = yaml.Marshal(comparable(result)); err != nil {
+		return "", err
+	}
+	if string(before) == string(after) {
+		return "", nil
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: "live",
+		ToFile:   "dry-run",
+		Context:  3,
+	})
+}
+
+// comparable 去掉每次更新都会变化的字段和 status，只保留 spec 和用户关心的 metadata
+func comparable(deployment *appsv1.Deployment) *appsv1.Deployment {
+	copied := deployment.DeepCopy()
+	copied.TypeMeta = deploymentTypeMeta
+	copied.ObjectMeta = metav1.ObjectMeta{
+		Name:        deployment.Name,
+		Namespace:   deployment.Namespace,
+		Labels:      deployment.Labels,
+		Annotations: deployment.Annotations,
+	}
+	copied.Status = appsv1.DeploymentStatus{}
+	return copied
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"time"
+)
+
+type IPodEventService interface {
+	// ListPodEvents 返回 Deployment、ReplicaSet 和 Pod 上的事件，persistWarnings 为 true 时保存 Warning 事件
+	ListPodEvents(id int64, persistWarnings bool) ([]*pod.ClusterEvent, error)
+}
+
+type PodEventService struct {
+	PodRepository      repository.IPodRepository
+	PodEventRepository repository.IPodEventRepository
+	K8sClientSet       kubernetes.Interface
+}
+
+func NewPodEventService(podRepository repository.IPodRepository, podEventRepository repository.IPodEventRepository, clientSet kubernetes.Interface) IPodEventService {
+	return &PodEventService{
+		PodRepository:      podRepository,
+		PodEventRepository: podEventRepository,
+		K8sClientSet:       clientSet,
+	}
+}
+
+func (p PodEventService) ListPodEvents(id int64, persistWarnings bool) ([]*pod.ClusterEvent, error) {
+	podModel, err := p.PodRepository.FindPodByID(id)
+	if err != nil {
+		return nil, err
+	}
+	k8sEvents, err := p.listK8sEvents(podModel)
+	if err != nil {
+		return nil, err
+	}
+
+	if persistWarnings {
+		var records []*model.PodEventRecord
+		for _, event := range k8sEvents {
+			if event.Type == corev1.EventTypeWarning {
+				records = append(records, &model.PodEventRecord{
+					PodID:          podModel.ID,
+					EventUID:       string(event.UID),
+					Type:           event.Type,
+					Reason:         event.Reason,
+					Message:        event.Message,
+					ObjectKind:     event.InvolvedObject.Kind,
+					ObjectName:     event.InvolvedObject.Name,
+					Count:          event.Count,
+					FirstTimestamp: getFirstTimestamp(event),
+					LastTimestamp:  getLastTimestamp(event),
+				})
+			}
+		}
+		if err := p.PodEventRepository.SaveEvents(records); err != nil {
+			zap.S().Errorf("save pod %d events error %s", id, err.Error())
+			return nil, err
+		}
+	}
+
+	events := map[string]*pod.ClusterEvent{}
+	var keys []string
+	merge := func(event *pod.ClusterEvent) {
+		// 同一个对象上相同原因和内容的事件合并成一条
+		key := event.ObjectKind + "/" + event.ObjectName + "/" + event.Reason + "/" + event.Message
+		existing, ok := events[key]
+		if !ok {
+			events[key] = event
+			keys = append(keys, key)
+			return
+		}
+		if event.Persisted {
+			// 集群中还存在的事件以集群为准
+			return
+		}
+		if existing.Persisted {
+			events[key] = event
+			return
+		}
+		existing.Count += event.Count
+		if event.FirstTimestamp < existing.FirstTimestamp {
+			existing.FirstTimestamp = event.FirstTimestamp
+		}
+		if event.LastTimestamp > existing.LastTimestamp {
+			existing.LastTimestamp = event.LastTimestamp
+		}
+	}
+	for _, event := range k8sEvents {
+		merge(&pod.ClusterEvent{
+			Type:           event.Type,
+			Reason:         event.Reason,
+			Message:        event.Message,
+			ObjectKind:     event.InvolvedObject.Kind,
+			ObjectName:     event.InvolvedObject.Name,
+			Count:          event.Count,
+			FirstTimestamp: getFirstTimestamp(event).Unix(),
+			LastTimestamp:  getLastTimestamp(event).Unix(),
+		})
+	}
+	records, err := p.PodEventRepository.FindByPodID(podModel.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		merge(&pod.ClusterEvent{
+			Type:           record.Type,
+			Reason:         record.Reason,
+			Message:        record.Message,
+			ObjectKind:     record.ObjectKind,
+			ObjectName:     record.ObjectName,
+			Count:          record.Count,
+			FirstTimestamp: record.FirstTimestamp.Unix(),
+			LastTimestamp:  record.LastTimestamp.Unix(),
+			Persisted:      true,
+		})
+	}
+
+	result := make([]*pod.ClusterEvent, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, events[key])
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].LastTimestamp < result[j].LastTimestamp
+	})
+	return result, nil
+}
+
+// listK8sEvents 查询 Deployment 以及它创建的 ReplicaSet 和 Pod 上的事件
+func (p PodEventService) listK8sEvents(podModel *model.Pod) ([]corev1.Event, error) {
+	deployment, err := p.K8sClientSet.AppsV1().Deployments(podModel.PodNamespace).Get(context.TODO(), podModel.PodName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	uids := map[types.UID]bool{deployment.UID: true}
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	listOptions := metav1.ListOptions{LabelSelector: selector.String()}
+	replicaSets, err := p.K8sClientSet.AppsV1().ReplicaSets(podModel.PodNamespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, replicaSet := range replicaSets.Items {
+		if metav1.IsControlledBy(&replicaSet, deployment) {
+			uids[replicaSet.UID] = true
+		}
+	}
+	replicas, err := p.K8sClientSet.CoreV1().Pods(podModel.PodNamespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, replica := range replicas.Items {
+		if owner := metav1.GetControllerOf(&replica); owner != nil && uids[owner.UID] {
+			uids[replica.UID] = true
+		}
+	}
+
+	eventList, err := p.K8sClientSet.CoreV1().Events(podModel.PodNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var events []corev1.Event
+	for _, event := range eventList.Items {
+		if uids[event.InvolvedObject.UID] {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// 新版本的 events API 只设置 EventTime，不设置 FirstTimestamp 和 LastTimestamp
+func getFirstTimestamp(event corev1.Event) time.Time {
+	switch {
+	case !event.FirstTimestamp.IsZero():
+		return event.FirstTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.CreationTimestamp.Time
+	}
+}
+
+func getLastTimestamp(event corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case event.Series != nil:
+		return event.Series.LastObservedTime.Time
+	default:
+		return getFirstTimestamp(event)
+	}
+}
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	corev1 "k8s.io/api/core/v1"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+const (
+	ExportYAML      = "yaml"
+	ExportKustomize = "kustomize"
+	ExportHelm      = "helm"
+)
+
+// chartNameInvalid helm chart 名称只能包含小写字母、数字和 -
+var chartNameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// helmTemplate 每个 pod 渲染一个 Deployment，字段和 buildDeployment 生成的一致
+const helmTemplate = `{{- range $pod := .Values.pods }}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ $pod.name }}
+  namespace: {{ $pod.namespace }}
+  labels:
+    {{- toYaml $pod.labels | nindent 4 }}
+spec:
+  replicas: {{ $pod.replicas }}
+  selector:
+    matchLabels:
+      app-name: {{ $pod.name }}
+  strategy:
+    type: {{ $pod.strategy }}
+  template:
+    metadata:
+      labels:
+        {{- toYaml $pod.labels | nindent 8 }}
+    spec:
+      restartPolicy: {{ $pod.restartPolicy }}
+      containers:
+        - name: {{ $pod.name }}
+          image: {{ $pod.image }}
+          imagePullPolicy: {{ $pod.pullPolicy }}
+          {{- with $pod.ports }}
+          ports:
+            {{- toYaml . | nindent 12 }}
+          {{- end }}
+          {{- with $pod.env }}
+          env:
+            {{- toYaml . | nindent 12 }}
+          {{- end }}
+          resources:
+            {{- toYaml $pod.resources | nindent 12 }}
+{{- end }}
+`
+
+type IPodExportService interface {
+	ExportPods(request *pod.ExportPodsRequest) (*pod.ExportPodsResponse, error)
+}
+
+type PodExportService struct {
+	PodRepository repository.IPodRepository
+}
+
+func NewPodExportService(podRepository repository.IPodRepository) IPodExportService {
+	return &PodExportService{PodRepository: podRepository}
+}
+
+// helmValues values.yaml 中一个 pod 的配置，资源使用 k8s 的数量格式，比如 500m
+type helmValues struct {
+	Name          string                      `json:"name"`
+	Namespace     string                      `json:"namespace"`
+	Replicas      int32                       `json:"replicas"`
+	Image         string                      `json:"image"`
+	PullPolicy    corev1.PullPolicy           `json:"pullPolicy"`
+	RestartPolicy corev1.RestartPolicy        `json:"restartPolicy"`
+	Strategy      string                      `json:"strategy"`
+	Labels        map[string]string           `json:"labels"`
+	Ports         []corev1.ContainerPort      `json:"ports,omitempty"`
+	Env           []corev1.EnvVar             `json:"env,omitempty"`
+	Resources     corev1.ResourceRequirements `json:"resources"`
+}
+
+// ExportPods 只读取数据库，导出的内容和 worker 应用到集群的 Deployment 一致
+func (p PodExportService) ExportPods(request *pod.ExportPodsRequest) (*pod.ExportPodsResponse, error) {
+	format := request.Format
+	if format == "" {
+		format = ExportYAML
+	}
+	if format != ExportYAML && format != ExportKustomize && format != ExportHelm {
+		return nil, common.InvalidArgument("unsupported export format %s", format).
+			WithField("format", "must be one of yaml, kustomize, helm")
+	}
+	pods, err := p.findPods(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, common.NotFound("no pod matches the export request")
+	}
+	infos := make([]*pod.PodInfo, 0, len(pods))
+	for _, podModel := range pods {
+		info := &pod.PodInfo{}
+		if err := common.SwapTo(podModel, info); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	var files []*pod.ExportFile
+	switch format {
+	case ExportYAML:
+		files, err = exportYAML(infos)
+	case ExportKustomize:
+		files, err = exportKustomize(infos)
+	case ExportHelm:
+		files, err = exportHelm(chartName(request, infos), infos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pod.ExportPodsResponse{Files: files, PodCount: int32(len(infos))}, nil
+}
+
+// findPods 按 id 导出时命名空间和团队必须一致，否则按命名空间和团队翻页查询全部
+func (p PodExportService) findPods(request *pod.ExportPodsRequest) ([]*model.Pod, error) {
+	if request.PodId == 0 && request.PodNamespace == "" && request.PodTeamId == "" {
+		return nil, common.InvalidArgument("one of pod_id, pod_namespace or pod_team_id is required").
+			WithField("pod_id", "pod_id, pod_namespace or pod_team_id is required")
+	}
+	if request.PodId != 0 {
+		podModel, err := p.PodRepository.FindPodByID(request.PodId)
+		if err != nil {
+			return nil, err
+		}
+		if (request.PodNamespace != "" && podModel.PodNamespace != request.PodNamespace) ||
+			(request.PodTeamId != "" && podModel.PodTeamID != request.PodTeamId) {
+			return nil, nil
+		}
+		return []*model.Pod{podModel}, nil
+	}
+	filter := &model.PodFilter{
+		PodCluster:   model.ClusterOrDefault(request.PodCluster),
+		PodNamespace: request.PodNamespace,
+		PodTeamID:    request.PodTeamId,
+		OrderBy:      "pod_name",
+	}
+	var pods []*model.Pod
+	for {
+		page, err := p.PodRepository.FindPage(filter)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, page.Pods...)
+		if page.NextPageToken == "" {
+			return pods, nil
+		}
+		filter.PageToken = page.NextPageToken
+	}
+}
+
+// renderDeployment buildDeployment 不依赖 clientset，导出时不需要连接集群
+func renderDeployment(info *pod.PodInfo) ([]byte, error) {
+	return yaml.Marshal((&PodDataService{}).buildDeployment(info))
+}
+
+func exportYAML(infos []*pod.PodInfo) ([]*pod.ExportFile, error) {
+	var builder strings.Builder
+	for i, info := range infos {
+		data, err := renderDeployment(info)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			builder.WriteString("---\n")
+		}
+		builder.Write(data)
+	}
+	return []*pod.ExportFile{{Path: "pods.yaml", Content: builder.String()}}, nil
+}
+
+// exportKustomize 每个 pod 一个文件，按团队导出时可能跨命名空间，文件名带上命名空间
+func exportKustomize(infos []*pod.PodInfo) ([]*pod.ExportFile, error) {
+	var files []*pod.ExportFile
+	var resources []string
+	for _, info := range infos {
+		data, err := renderDeployment(info)
+		if err != nil {
+			return nil, err
+		}
+		path := fmt.Sprintf("%s-%s.yaml", info.PodNamespace, info.PodName)
+		resources = append(resources, path)
+		files = append(files, &pod.ExportFile{Path: path, Content: string(data)})
+	}
+	kustomization, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  resources,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]*pod.ExportFile{{Path: "kustomization.yaml", Content: string(kustomization)}}, files...), nil
+}
+
+func exportHelm(name string, infos []*pod.PodInfo) ([]*pod.ExportFile, error) {
+	chart, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion":  "v2",
+		"name":        name,
+		"description": "Deployments exported from wepass-pod",
+		"type":        "application",
+		"version":     "0.1.0",
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*helmValues, 0, len(infos))
+	for _, info := range infos {
+		deployment := (&PodDataService{}).buildDeployment(info)
+		container := deployment.Spec.Template.Spec.Containers[0]
+		values = append(values, &helmValues{
+			Name:          info.PodName,
+			Namespace:     info.PodNamespace,
+			Replicas:      info.PodReplicas,
+			Image:         info.PodImage,
+			PullPolicy:    container.ImagePullPolicy,
+			RestartPolicy: deployment.Spec.Template.Spec.RestartPolicy,
+			Strategy:      string(deployment.Spec.Strategy.Type),
+			Labels:        deployment.Labels,
+			Ports:         container.Ports,
+			Env:           container.Env,
+			Resources:     container.Resources,
+		})
+	}
+	valuesData, err := yaml.Marshal(map[string]interface{}{"pods": values})
+	if err != nil {
+		return nil, err
+	}
+	return []*pod.ExportFile{
+		{Path: "Chart.yaml", Content: string(chart)},
+		{Path: "values.yaml", Content: string(valuesData)},
+		{Path: "templates/deployment.yaml", Content: helmTemplate},
+	}, nil
+}
+
+// chartName 依次使用请求中的名称、命名空间、团队和 pod 名称
+func chartName(request *pod.ExportPodsRequest, infos []*pod.PodInfo) string {
+	name := request.ChartName
+	for _, candidate := range []string{request.PodNamespace, request.PodTeamId, infos[0].PodName} {
+		if name == "" {
+			name = candidate
+		}
+	}
+	name = strings.Trim(chartNameInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" {
+		return "wepass-pods"
+	}
+	return name
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"go.uber.org/zap"
+	"reflect"
+	"time"
+)
+
+const (
+	historyQueueSize = 1024
+	historyBatchSize = 100
+)
+
+// ErrHistoryDisabled 没有配置 mongodb 时查询历史记录返回这个错误
+var ErrHistoryDisabled = common.Unavailable("pod history is not enabled")
+
+type IPodHistoryService interface {
+	// Run 把记录批量写入 mongodb，同时记录 watch 到的 k8s 事件
+	Run(stopCh <-chan struct{})
+	// 下面的方法只把记录放到队列中，不会阻塞调用方，写入失败只打印日志
+	RecordSpecChange(operationType string, operationID int64, before, after *model.Pod)
+	RecordOperation(operation *model.PodOperation)
+	RecordReconcile(report *pod.ReconcileReport)
+	GetPodHistory(filter *model.PodHistoryFilter) ([]*model.PodHistory, error)
+}
+
+type PodHistoryService struct {
+	// 为空时不记录历史
+	HistoryRepository repository.IPodHistoryRepository
+	PodWatchService   IPodWatchService
+	ttl               map[string]time.Duration
+	queue             chan *model.PodHistory
+}
+
+// NewPodHistoryService ttlDays 是每种记录的保留天数
+func NewPodHistoryService(historyRepository repository.IPodHistoryRepository, watchService IPodWatchService,
+	ttlDays map[string]int) IPodHistoryService {
+	ttl := map[string]time.Duration{}
+	for historyType, days := range ttlDays {
+		if days > 0 {
+			ttl[historyType] = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return &PodHistoryService{
+		HistoryRepository: historyRepository,
+		PodWatchService:   watchService,
+		ttl:               ttl,
+		queue:             make(chan *model.PodHistory, historyQueueSize),
+	}
+}
+
+func (p *PodHistoryService) Run(stopCh <-chan struct{}) {
+	if p.HistoryRepository == nil {
+		return
+	}
+	if err := p.HistoryRepository.InitIndexes(); err != nil {
+		zap.S().Errorf("init pod history indexes error %s", err.Error())
+	}
+	events, cancel := p.PodWatchService.Subscribe("", "")
+	defer cancel()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			p.recordEvent(event)
+		case history := <-p.queue:
+			p.flush(history)
+		}
+	}
+}
+
+// flush 把队列中已有的记录一起写入
+func (p *PodHistoryService) flush(first *model.PodHistory) {
+	batch := []*model.PodHistory{first}
+drain:
+	for len(batch) < historyBatchSize {
+		select {
+		case history := <-p.queue:
+			batch = append(batch, history)
+		default:
+			break drain
+		}
+	}
+	if err := p.HistoryRepository.AppendHistory(batch...); err != nil {
+		zap.S().Errorf("append %d pod history error %s", len(batch), err.Error())
+	}
+}
+
+func (p *PodHistoryService) record(history *model.PodHistory, detail interface{}) {
+	if p.HistoryRepository == nil {
+		return
+	}
+	if history.Timestamp.IsZero() {
+		history.Timestamp = time.Now()
+	}
+	if ttl, ok := p.ttl[history.Type]; ok {
+		expireAt := history.Timestamp.Add(ttl)
+		history.ExpireAt = &expireAt
+	}
+	if detail != nil {
+		data, err := json.Marshal(detail)
+		if err != nil {
+			zap.S().Errorf("marshal pod history detail error %s", err.Error())
+		}
+		history.Detail = string(data)
+	}
+	select {
+	case p.queue <- history:
+	default:
+		zap.S().Warnf("pod history queue full, drop %s %s/%s", history.Type, history.PodNamespace, history.PodName)
+	}
+}
+
+func (p *PodHistoryService) RecordSpecChange(operationType string, operationID int64, before, after *model.Pod) {
+	history := &model.PodHistory{
+		Type:    model.HistorySpecChange,
+		Reason:  operationType,
+		Message: fmt.Sprintf("operation %d", operationID),
+	}
+	for _, podModel := range []*model.Pod{after, before} {
+		if podModel != nil {
+			history.PodID, history.PodCluster = podModel.ID, podModel.PodCluster
+			history.PodNamespace, history.PodName = podModel.PodNamespace, podModel.PodName
+			break
+		}
+	}
+	beforeFields, err := toFields(before)
+	if err != nil {
+		zap.S().Errorf("pod history spec change error %s", err.Error())
+		return
+	}
+	afterFields, err := toFields(after)
+	if err != nil {
+		zap.S().Errorf("pod history spec change error %s", err.Error())
+		return
+	}
+	diff := map[string]map[string]interface{}{}
+	for key := range mergeKeys(beforeFields, afterFields) {
+		if !reflect.DeepEqual(beforeFields[key], afterFields[key]) {
+			diff[key] = map[string]interface{}{"before": beforeFields[key], "after": afterFields[key]}
+		}
+	}
+	p.record(history, diff)
+}
+
+// RecordOperation 记录结束的操作，reason 是 succeeded、compensated 或者 failed
+func (p *PodHistoryService) RecordOperation(operation *model.PodOperation) {
+	podModel := &model.Pod{}
+	if err := json.Unmarshal([]byte(operation.Spec), podModel); err != nil {
+		zap.S().Errorf("pod history operation %d error %s", operation.ID, err.Error())
+		return
+	}
+	message := fmt.Sprintf("operation %d %s", operation.ID, operation.Type)
+	if operation.LastError != "" {
+		message += ": " + operation.LastError
+	}
+	p.record(&model.PodHistory{
+		PodID:        operation.PodID,
+		PodCluster:   model.ClusterOrDefault(podModel.PodCluster),
+		PodNamespace: podModel.PodNamespace,
+		PodName:      podModel.PodName,
+		Type:         model.HistoryRollout,
+		Reason:       operation.Status,
+		Message:      message,
+	}, map[string]interface{}{
+		"operation_id": operation.ID,
+		"type":         operation.Type,
+		"attempts":     operation.Attempts,
+		"last_error":   operation.LastError,
+	})
+}
+
+// RecordReconcile 只记录对账时做了修改或者失败的 pod
+func (p *PodHistoryService) RecordReconcile(report *pod.ReconcileReport) {
+	for _, item := range report.Items {
+		p.record(&model.PodHistory{
+			PodID:        item.PodId,
+			PodCluster:   item.PodCluster,
+			PodNamespace: item.PodNamespace,
+			PodName:      item.PodName,
+			Type:         model.HistoryReconcile,
+			Reason:       item.Action.String(),
+			Message:      item.Message,
+		}, nil)
+	}
+}
+
+func (p *PodHistoryService) recordEvent(event *pod.PodEvent) {
+	// informer 只 watch 当前的集群
+	history := &model.PodHistory{
+		PodCluster:   model.DefaultCluster,
+		PodNamespace: event.PodNamespace,
+		PodName:      event.PodName,
+		Type:         model.HistoryK8sEvent,
+		Reason:       event.Reason,
+		Message:      event.Message,
+		Timestamp:    time.Unix(event.Timestamp, 0),
+	}
+	if history.Reason == "" {
+		history.Reason = event.Type.String()
+	}
+	p.record(history, event)
+}
+
+func (p *PodHistoryService) GetPodHistory(filter *model.PodHistoryFilter) ([]*model.PodHistory, error) {
+	if p.HistoryRepository == nil {
+		return nil, ErrHistoryDisabled
+	}
+	return p.HistoryRepository.FindHistory(filter)
+}
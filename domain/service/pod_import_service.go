@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/DuanNengxin/wepass-pod/validation"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AnnotationImported 标记从集群导入的 Deployment，对账时只比较 ConvertDeployment 能表示的字段
+const AnnotationImported = "wepass.io/imported"
+
+type IPodImportService interface {
+	ImportPods(request *pod.ImportPodsRequest) ([]*pod.ImportResult, error)
+}
+
+type PodImportService struct {
+	PodRepository       repository.IPodRepository
+	OperationRepository repository.IPodOperationRepository
+	K8sClientSet        kubernetes.Interface
+}
+
+func NewPodImportService(podRepository repository.IPodRepository, operationRepository repository.IPodOperationRepository,
+	clientSet kubernetes.Interface) IPodImportService {
+	return &PodImportService{
+		PodRepository:       podRepository,
+		OperationRepository: operationRepository,
+		K8sClientSet:        clientSet,
+	}
+}
+
+func (p PodImportService) ImportPods(request *pod.ImportPodsRequest) ([]*pod.ImportResult, error) {
+	deployments, err := p.K8sClientSet.AppsV1().Deployments(request.PodNamespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: request.LabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var results []*pod.ImportResult
+	for i := range deployments.Items {
+		results = append(results, p.importDeployment(&deployments.Items[i], request))
+	}
+	return results, nil
+}
+
+func (p PodImportService) importDeployment(deployment *appsv1.Deployment, request *pod.ImportPodsRequest) *pod.ImportResult {
+	podModel, unsupported := ConvertDeployment(deployment)
+	unsupported = append(unsupported, missingLimits(deployment)...)
+	result := &pod.ImportResult{
+		PodNamespace: deployment.Namespace,
+		PodName:      deployment.Name,
+		Unsupported:  unsupported,
+	}
+	if podModel.PodTeamID == "" {
+		podModel.PodTeamID = request.PodTeamId
+	}
+
+	existing, err := p.PodRepository.FindPodByName(podModel.PodCluster, deployment.Namespace, deployment.Name)
+	if err == nil {
+		result.PodId = existing.ID
+		result.Error = "pod already exists"
+		return result
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		result.Error = err.Error()
+		return result
+	}
+	// 已经删除但是 worker 还没有删除 Deployment 的 pod，导入之后 Deployment 会被 worker 删除
+	if pending, err := p.isDeleting(podModel); err != nil || pending {
+		result.Error = "pod is being deleted"
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	// selector 不能修改，wepass 生成的 selector 和原来的不一致时无法管理这个 Deployment
+	if !hasManagedSelector(deployment) {
+		result.Error = "spec.selector must only match " + LabelAppName + "=" + deployment.Name
+		return result
+	}
+	if request.Strict && len(unsupported) > 0 {
+		result.Error = "deployment has unsupported fields"
+		return result
+	}
+	// 和 AddPod 一样校验，导入之后不能通过校验的 pod 无法再修改
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(podModel, info); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if errs := validation.ValidatePodInfo(info); len(errs) > 0 {
+		result.Error = errs.ToAggregate().Error()
+		return result
+	}
+
+	// 只修改 Deployment 自身的标签，修改 template 的标签会触发滚动更新
+	labels := map[string]string{
+		LabelAppName:   podModel.PodName,
+		LabelManagedBy: ManagedBy,
+		LabelTeam:      podModel.PodTeamID,
+	}
+	if err := p.patchMetadata(deployment, labels, map[string]string{AnnotationImported: "true"}); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	podID, err := p.PodRepository.CreatePod(podModel)
+	if err != nil {
+		zap.S().Errorf("import deployment %s/%s error %s", deployment.Namespace, deployment.Name, err.Error())
+		result.Error = err.Error()
+		// 没有写入数据库时恢复原来的标签，否则对账会把它当成孤儿
+		if err := p.patchMetadata(deployment, originalValues(deployment.Labels, labels),
+			originalValues(deployment.Annotations, map[string]string{AnnotationImported: ""})); err != nil {
+			zap.S().Errorf("restore deployment %s/%s labels error %s", deployment.Namespace, deployment.Name, err.Error())
+		}
+		return result
+	}
+	result.PodId = podID
+	result.Imported = true
+	zap.S().Infof("import deployment %s/%s success pod id %d", deployment.Namespace, deployment.Name, podID)
+	return result
+}
+
+// isDeleting 同名的 pod 是否已经删除，但是删除操作还没有执行完
+func (p PodImportService) isDeleting(podModel *model.Pod) (bool, error) {
+	deletedPods, err := p.PodRepository.FindDeletedPods(podModel.PodNamespace, "")
+	if err != nil {
+		return false, err
+	}
+	for _, deletedPod := range deletedPods {
+		if model.ClusterOrDefault(deletedPod.PodCluster) != podModel.PodCluster || deletedPod.PodName != podModel.PodName {
+			continue
+		}
+		if pending, err := hasUnfinishedOperations(p.OperationRepository, deletedPod.ID); err != nil || pending {
+			return pending, err
+		}
+	}
+	return false, nil
+}
+
+// patchMetadata 用 merge patch 修改 Deployment 的标签和注解，值为 nil 时删除
+func (p PodImportService) patchMetadata(deployment *appsv1.Deployment, labels, annotations interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.K8sClientSet.AppsV1().Deployments(deployment.Namespace).Patch(context.TODO(), deployment.Name,
+		types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// originalValues 返回 keys 在 values 中原来的值，原来没有的 key 为 nil
+func originalValues(values, keys map[string]string) map[string]interface{} {
+	original := map[string]interface{}{}
+	for key := range keys {
+		if value, ok := values[key]; ok {
+			original[key] = value
+		} else {
+			original[key] = nil
+		}
+	}
+	return original
+}
+
+// missingLimits 没有 limits 时 wepass 会把 requests 设置成 limits，导入后下次更新会改变已经在运行的 Deployment
+func missingLimits(deployment *appsv1.Deployment) []string {
+	containers := deployment.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return nil
+	}
+	var missing []string
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if _, ok := containers[0].Resources.Limits[name]; !ok {
+			missing = append(missing, fmt.Sprintf("spec.template.spec.containers[0].resources.limits[%s]", name))
+		}
+	}
+	return missing
+}
+
+// hasManagedSelector selector 是否和 buildDeployment 生成的一致
+func hasManagedSelector(deployment *appsv1.Deployment) bool {
+	selector := deployment.Spec.Selector
+	return selector != nil && len(selector.MatchExpressions) == 0 && len(selector.MatchLabels) == 1 &&
+		selector.MatchLabels[LabelAppName] == deployment.Name
+}
+
+// ConvertDeployment 把 Deployment 转换成 model.Pod，同时返回无法表示的字段
+// 无法表示的字段用转换出来的 pod 重新生成 Deployment 后逐个字段比较得到，见 getUnsupportedFields
+func ConvertDeployment(deployment *appsv1.Deployment) (*model.Pod, []string) {
+	podModel := &model.Pod{
+		PodCluster:   model.DefaultCluster,
+		PodName:      deployment.Name,
+		PodNamespace: deployment.Namespace,
+		PodTeamID:    deployment.Labels[LabelTeam],
+		PodReplicas:  getReplicas(deployment),
+	}
+	for key, value := range deployment.Labels {
+		if key == LabelAppName || key == LabelManagedBy || key == LabelTeam {
+			continue
+		}
+		podModel.PodLabel = append(podModel.PodLabel, &model.PodLabel{LabelKey: key, LabelValue: value})
+	}
+	switch deployment.Spec.Strategy.Type {
+	case appsv1.RecreateDeploymentStrategyType:
+		podModel.PodType = "Recreate"
+	case appsv1.RollingUpdateDeploymentStrategyType, "":
+		podModel.PodType = "Rolling"
+	}
+
+	podSpec := deployment.Spec.Template.Spec
+	podModel.PodRestart = string(podSpec.RestartPolicy)
+	if len(podSpec.Containers) == 0 {
+		return podModel, []string{"spec.template.spec.containers"}
+	}
+	container := podSpec.Containers[0]
+	podModel.PodImage = container.Image
+	podModel.PodPullPolicy = string(container.ImagePullPolicy)
+	for _, port := range container.Ports {
+		podModel.PodPort = append(podModel.PodPort, &model.PodPort{
+			ContainerPort: port.ContainerPort,
+			Protocol:      string(port.Protocol),
+		})
+	}
+	for _, env := range container.Env {
+		if env.ValueFrom != nil {
+			continue
+		}
+		podModel.PodEnv = append(podModel.PodEnv, &model.PodEnv{
+			EnvKey:   env.Name,
+			EnvValue: env.Value,
+		})
+	}
+	// cpu 单位是核，内存单位是字节，和 getResource 保持一致
+	podModel.PodCpuMax = float32(container.Resources.Limits.Cpu().AsApproximateFloat64())
+	podModel.PodCpuMin = float32(container.Resources.Requests.Cpu().AsApproximateFloat64())
+	podModel.PodMemoryMax = float32(container.Resources.Limits.Memory().AsApproximateFloat64())
+	podModel.PodMemoryMin = float32(container.Resources.Requests.Memory().AsApproximateFloat64())
+	// 没有 limits 时使用 requests，否则校验 min > max 失败
+	if _, ok := container.Resources.Limits[corev1.ResourceCPU]; !ok {
+		podModel.PodCpuMax = podModel.PodCpuMin
+	}
+	if _, ok := container.Resources.Limits[corev1.ResourceMemory]; !ok {
+		podModel.PodMemoryMax = podModel.PodMemoryMin
+	}
+	return podModel, getUnsupportedFields(deployment, podModel)
+}
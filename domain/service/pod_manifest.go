@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// ManifestDocument manifest 中的一个文档，Err 不为空时 Pod 可能为空
+type ManifestDocument struct {
+	Index       int
+	Pod         *model.Pod
+	Unsupported []string
+	Err         error
+}
+
+// ParseManifest 按 --- 拆分文档，每个文档必须是 apps/v1 的 Deployment
+// 不认识的字段直接报错，能解析但无法用 PodInfo 表示的字段放在 Unsupported 中，由调用方决定是否创建
+func ParseManifest(request *pod.ApplyManifestRequest) ([]*ManifestDocument, error) {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(strings.NewReader(request.Manifest)))
+	var documents []*ManifestDocument
+	for {
+		data, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := strings.TrimSpace(string(data)); trimmed == "" || trimmed == "---" {
+			continue
+		}
+		document := &ManifestDocument{Index: len(documents)}
+		document.Pod, document.Unsupported, document.Err = parseDeployment(data, request)
+		documents = append(documents, document)
+	}
+}
+
+func parseDeployment(data []byte, request *pod.ApplyManifestRequest) (*model.Pod, []string, error) {
+	typeMeta := &metav1.TypeMeta{}
+	if err := yaml.Unmarshal(data, typeMeta); err != nil {
+		return nil, nil, err
+	}
+	if typeMeta.Kind != deploymentTypeMeta.Kind || typeMeta.APIVersion != deploymentTypeMeta.APIVersion {
+		return nil, nil, fmt.Errorf("unsupported kind %s %s, only %s %s is supported", typeMeta.APIVersion, typeMeta.Kind,
+			deploymentTypeMeta.APIVersion, deploymentTypeMeta.Kind)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.UnmarshalStrict(data, deployment); err != nil {
+		return nil, nil, err
+	}
+	if deployment.Namespace == "" {
+		deployment.Namespace = request.PodNamespace
+	}
+	if deployment.Name == "" || deployment.Namespace == "" {
+		return nil, nil, errors.New("metadata.name and metadata.namespace are required")
+	}
+	podModel, unsupported := ConvertDeployment(deployment)
+	podModel.PodCluster = model.ClusterOrDefault(request.PodCluster)
+	if podModel.PodTeamID == "" {
+		podModel.PodTeamID = request.PodTeamId
+	}
+	return podModel, unsupported, nil
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	metricsv "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+type IPodMetricsService interface {
+	GetPodMetrics(id int64) (*pod.PodMetrics, error)
+}
+
+type PodMetricsService struct {
+	PodRepository    repository.IPodRepository
+	K8sClientSet     kubernetes.Interface
+	MetricsClientSet metricsv.Interface
+}
+
+func NewPodMetricsService(podRepository repository.IPodRepository, clientSet kubernetes.Interface, metricsClientSet metricsv.Interface) IPodMetricsService {
+	return &PodMetricsService{
+		PodRepository:    podRepository,
+		K8sClientSet:     clientSet,
+		MetricsClientSet: metricsClientSet,
+	}
+}
+
+func (p PodMetricsService) GetPodMetrics(id int64) (*pod.PodMetrics, error) {
+	podModel, err := p.PodRepository.FindPodByID(id)
+	if err != nil {
+		return nil, err
+	}
+	result := &pod.PodMetrics{
+		Id:           podModel.ID,
+		PodNamespace: podModel.PodNamespace,
+		PodName:      podModel.PodName,
+		PodCpuMax:    podModel.PodCpuMax,
+		PodCpuMin:    podModel.PodCpuMin,
+		PodMemoryMax: podModel.PodMemoryMax,
+		PodMemoryMin: podModel.PodMemoryMin,
+	}
+
+	listOptions := metav1.ListOptions{LabelSelector: LabelAppName + "=" + podModel.PodName}
+	replicas, err := p.K8sClientSet.CoreV1().Pods(podModel.PodNamespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	// 副本名 -> 容器名 -> 配置的资源
+	resources := map[string]map[string]corev1.ResourceRequirements{}
+	for _, replica := range replicas.Items {
+		containers := map[string]corev1.ResourceRequirements{}
+		for _, container := range replica.Spec.Containers {
+			containers[container.Name] = container.Resources
+		}
+		resources[replica.Name] = containers
+	}
+
+	podMetricsList, err := p.MetricsClientSet.MetricsV1beta1().PodMetricses(podModel.PodNamespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, podMetrics := range podMetricsList.Items {
+		for _, container := range podMetrics.Containers {
+			requirements := resources[podMetrics.Name][container.Name]
+			containerMetrics := &pod.ContainerMetrics{
+				ReplicaName:   podMetrics.Name,
+				ContainerName: container.Name,
+				CpuUsage:      container.Usage.Cpu().AsApproximateFloat64(),
+				MemoryUsage:   container.Usage.Memory().AsApproximateFloat64(),
+				CpuRequest:    requirements.Requests.Cpu().AsApproximateFloat64(),
+				CpuLimit:      requirements.Limits.Cpu().AsApproximateFloat64(),
+				MemoryRequest: requirements.Requests.Memory().AsApproximateFloat64(),
+				MemoryLimit:   requirements.Limits.Memory().AsApproximateFloat64(),
+				Timestamp:     podMetrics.Timestamp.Unix(),
+			}
+			containerMetrics.CpuUtilization = getUtilization(containerMetrics.CpuUsage, containerMetrics.CpuLimit)
+			containerMetrics.MemoryUtilization = getUtilization(containerMetrics.MemoryUsage, containerMetrics.MemoryLimit)
+			result.Containers = append(result.Containers, containerMetrics)
+		}
+	}
+	return result, nil
+}
+
+func getUtilization(usage, limit float64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return usage / limit * 100
+}
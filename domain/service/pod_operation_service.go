@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"math"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 5
+	maxRetryBackoff    = 5 * time.Minute
+	// 超过这个时间还是 running 的操作认为 worker 已经退出，重新执行
+	staleOperationTimeout = 5 * time.Minute
+	dueOperationLimit     = 100
+)
+
+var operationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wepass_pod_operations_total",
+	Help: "应用到 k8s 的操作次数",
+}, []string{"type", "status"})
+
+type IPodOperationService interface {
+	// Run 定期执行到期的操作，Notify 之后会立即执行一次
+	Run(interval time.Duration, stopCh <-chan struct{})
+	Notify()
+	// Execute 立即执行一个 pending 的操作，返回执行之后的操作
+	Execute(id int64) (*model.PodOperation, error)
+	FindOperation(id int64) (*model.PodOperation, error)
+	// WaitOperation 等待操作结束，超时的时候返回还没有结束的操作，ctx 取消时返回 ctx 的错误
+	WaitOperation(ctx context.Context, id int64, timeout time.Duration) (*model.PodOperation, error)
+}
+
+type PodOperationService struct {
+	OperationRepository repository.IPodOperationRepository
+	PodDataService      IPodDataService
+	K8sClientSet        kubernetes.Interface
+	PodHistoryService   IPodHistoryService
+	MaxAttempts         int
+	notifyCh            chan struct{}
+}
+
+func NewPodOperationService(operationRepository repository.IPodOperationRepository, podDataService IPodDataService,
+	clientSet kubernetes.Interface, podHistoryService IPodHistoryService, maxAttempts int) IPodOperationService {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	return &PodOperationService{
+		OperationRepository: operationRepository,
+		PodDataService:      podDataService,
+		K8sClientSet:        clientSet,
+		PodHistoryService:   podHistoryService,
+		MaxAttempts:         maxAttempts,
+		notifyCh:            make(chan struct{}, 1),
+	}
+}
+
+func (p *PodOperationService) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.processDue()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-p.notifyCh:
+		}
+	}
+}
+
+func (p *PodOperationService) Notify() {
+	select {
+	case p.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *PodOperationService) processDue() {
+	if reset, err := p.OperationRepository.ResetStaleOperations(time.Now().Add(-staleOperationTimeout)); err != nil {
+		zap.S().Errorf("reset stale operations error %s", err.Error())
+	} else if reset > 0 {
+		zap.S().Warnf("reset %d stale operations", reset)
+	}
+	operations, err := p.OperationRepository.FindDueOperations(time.Now(), dueOperationLimit)
+	if err != nil {
+		zap.S().Errorf("find due operations error %s", err.Error())
+		return
+	}
+	for _, operation := range operations {
+		if _, err := p.Execute(operation.ID); err != nil {
+			zap.S().Errorf("execute operation %d error %s", operation.ID, err.Error())
+		}
+	}
+}
+
+func (p *PodOperationService) Execute(id int64) (*model.PodOperation, error) {
+	operation, err := p.OperationRepository.FindOperationByID(id)
+	if err != nil {
+		return nil, err
+	}
+	// 同一个 pod 的操作必须按顺序执行
+	blocked, err := p.OperationRepository.HasUnfinishedBefore(operation.PodID, operation.ID)
+	if err != nil || blocked {
+		return operation, err
+	}
+	claimed, err := p.OperationRepository.ClaimOperation(id)
+	if err != nil || !claimed {
+		return operation, err
+	}
+
+	operation.Status = model.OperationRunning
+	operation.Attempts++
+	applyErr := p.apply(operation)
+	switch {
+	case applyErr == nil:
+		operation.Status = model.OperationSucceed
+		operation.LastError = ""
+	case !isPermanent(applyErr) && operation.Attempts < p.MaxAttempts:
+		operation.Status = model.OperationPending
+		operation.LastError = applyErr.Error()
+		operation.NextRunAt = time.Now().Add(retryBackoff(operation.Attempts))
+		zap.S().Warnf("operation %d %s pod %d attempt %d error %s", operation.ID, operation.Type, operation.PodID,
+			operation.Attempts, applyErr.Error())
+	default:
+		operation.LastError = applyErr.Error()
+		if err := p.compensate(operation); err != nil {
+			operation.Status = model.OperationFailed
+			operation.LastError = fmt.Sprintf("%s; compensate error %s", applyErr.Error(), err.Error())
+		} else {
+			operation.Status = model.OperationCompensated
+		}
+		zap.S().Errorf("operation %d %s pod %d %s: %s", operation.ID, operation.Type, operation.PodID,
+			operation.Status, operation.LastError)
+	}
+	operationsTotal.WithLabelValues(operation.Type, operation.Status).Inc()
+	if err := p.OperationRepository.UpdateOperation(operation); err != nil {
+		return nil, err
+	}
+	if operation.Finished() {
+		p.PodHistoryService.RecordOperation(operation)
+	}
+	return operation, nil
+}
+
+func (p *PodOperationService) FindOperation(id int64) (*model.PodOperation, error) {
+	return p.OperationRepository.FindOperationByID(id)
+}
+
+func (p *PodOperationService) WaitOperation(ctx context.Context, id int64, timeout time.Duration) (*model.PodOperation, error) {
+	p.Notify()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var operation *model.PodOperation
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		var err error
+		if operation, err = p.OperationRepository.FindOperationByID(id); err != nil {
+			return false, err
+		}
+		return operation.Finished(), nil
+	}, waitCtx.Done())
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		// 调用方已经取消，不再等待
+		if ctx.Err() != nil {
+			return operation, ctx.Err()
+		}
+		return operation, nil
+	}
+	return operation, err
+}
+
+// hasUnfinishedOperations pod 还有没有结束的操作时 k8s 只能由 worker 修改，对账和导入都要跳过
+func hasUnfinishedOperations(operationRepository repository.IPodOperationRepository, podID int64) (bool, error) {
+	return operationRepository.HasUnfinishedBefore(podID, math.MaxInt64)
+}
+
+// checkManaged 同名的 Deployment 不是 wepass 创建或者导入的时候按已经存在处理，不能覆盖
+func checkManaged(live *appsv1.Deployment, name string) error {
+	if live.Labels[LabelManagedBy] == ManagedBy && live.Labels[LabelAppName] == name {
+		return nil
+	}
+	return fmt.Errorf("Pod %s 已经存在: %w", name,
+		k8serrors.NewAlreadyExists(schema.GroupResource{Group: "apps", Resource: "deployments"}, name))
+}
+
+func (p *PodOperationService) apply(operation *model.PodOperation) error {
+	podModel := &model.Pod{}
+	if err := json.Unmarshal([]byte(operation.Spec), podModel); err != nil {
+		return permanentError{err}
+	}
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(podModel, info); err != nil {
+		return permanentError{err}
+	}
+	switch operation.Type {
+	case model.OperationCreate:
+		err := p.PodDataService.CreateToK8s(info)
+		if k8serrors.IsAlreadyExists(err) {
+			// 上一次执行可能已经创建成功，只接管 wepass 自己创建的 Deployment
+			live, getErr := p.K8sClientSet.AppsV1().Deployments(info.PodNamespace).Get(context.TODO(), info.PodName, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			if err := checkManaged(live, info.PodName); err != nil {
+				return permanentError{err}
+			}
+			return p.PodDataService.UpdateToK8s(info)
+		}
+		return err
+	case model.OperationUpdate:
+		err := p.PodDataService.UpdateToK8s(info)
+		if k8serrors.IsNotFound(err) {
+			return p.PodDataService.CreateToK8s(info)
+		}
+		return err
+	case model.OperationDelete:
+		err := p.PodDataService.DeleteToK8s(podModel)
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	default:
+		return permanentError{fmt.Errorf("unknown operation type %s", operation.Type)}
+	}
+}
+
+// compensate 把数据库改回操作之前的状态，同一个 pod 后面的操作都基于失败的状态，一起取消
+func (p *PodOperationService) compensate(operation *model.PodOperation) error {
+	var err error
+	switch operation.Type {
+	case model.OperationCreate:
+		err = p.PodDataService.DeletePod(operation.PodID)
+	case model.OperationUpdate:
+		err = p.restorePrevious(operation)
+	case model.OperationDelete:
+		err = p.PodDataService.RestorePod(operation.PodID)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = p.OperationRepository.CancelOperationsAfter(operation.PodID, operation.ID,
+		fmt.Sprintf("operation %d %s", operation.ID, model.OperationCompensated))
+	return err
+}
+
+func (p *PodOperationService) restorePrevious(operation *model.PodOperation) error {
+	previous := &model.Pod{}
+	if err := json.Unmarshal([]byte(operation.Previous), previous); err != nil {
+		return err
+	}
+	current, err := p.PodDataService.FindPodByID(operation.PodID)
+	if err != nil {
+		return err
+	}
+	previous.Version = current.Version
+	return p.PodDataService.UpdatePod(previous)
+}
+
+// permanentError 重试也不会成功的错误，直接补偿
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+func isPermanent(err error) bool {
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		return true
+	}
+	return k8serrors.IsInvalid(err) || k8serrors.IsBadRequest(err) || k8serrors.IsForbidden(err) ||
+		k8serrors.IsMethodNotSupported(err) || k8serrors.IsRequestEntityTooLargeError(err)
+}
+
+// retryBackoff 指数退避，1s、2s、4s ... 最多 5 分钟
+func retryBackoff(attempts int) time.Duration {
+	backoff := time.Second << uint(attempts-1)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,465 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AnnotationOrphaned 标记带有 wepass 标签但数据库中已经没有记录的 Deployment
+const AnnotationOrphaned = "wepass.io/orphaned"
+
+var (
+	reconcileRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wepass_pod_reconcile_runs_total",
+		Help: "对账执行次数",
+	})
+	reconcileActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wepass_pod_reconcile_actions_total",
+		Help: "对账过程中执行的动作次数",
+	}, []string{"action"})
+	reconcileOrphans = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wepass_pod_reconcile_orphans",
+		Help: "最近一次对账发现的孤儿 Deployment 数量",
+	})
+	reconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "wepass_pod_reconcile_duration_seconds",
+		Help: "对账耗时",
+	})
+	reconcileLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wepass_pod_reconcile_last_success_timestamp_seconds",
+		Help: "最近一次成功对账的时间",
+	})
+)
+
+type IPodReconcileService interface {
+	// Run 按 interval 周期性对账，阻塞直到 stopCh 关闭
+	Run(interval time.Duration, stopCh <-chan struct{})
+	// Reconcile 执行一次对账
+	Reconcile() *pod.ReconcileReport
+	// Status 返回最近一次对账的结果
+	Status() *pod.ReconcileReport
+}
+
+type PodReconcileService struct {
+	PodRepository       repository.IPodRepository
+	OperationRepository repository.IPodOperationRepository
+	K8sClientSet        kubernetes.Interface
+	HistoryService      IPodHistoryService
+	dataService         *PodDataService
+	running             int32
+
+	mu         sync.RWMutex
+	lastReport *pod.ReconcileReport
+}
+
+func NewPodReconcileService(podRepository repository.IPodRepository, operationRepository repository.IPodOperationRepository,
+	clientSet kubernetes.Interface, historyService IPodHistoryService) IPodReconcileService {
+	return &PodReconcileService{
+		PodRepository:       podRepository,
+		OperationRepository: operationRepository,
+		K8sClientSet:        clientSet,
+		HistoryService:      historyService,
+		dataService:         &PodDataService{},
+		lastReport:          &pod.ReconcileReport{},
+	}
+}
+
+func (p *PodReconcileService) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.Reconcile()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *PodReconcileService) Status() *pod.ReconcileReport {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastReport
+}
+
+func (p *PodReconcileService) Reconcile() *pod.ReconcileReport {
+	// 上一轮还没结束时直接返回上一轮的结果
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return p.Status()
+	}
+	defer atomic.StoreInt32(&p.running, 0)
+
+	start := time.Now()
+	report := &pod.ReconcileReport{StartedAt: start.Unix()}
+	defer func() {
+		report.FinishedAt = time.Now().Unix()
+		reconcileRuns.Inc()
+		reconcileDuration.Observe(time.Since(start).Seconds())
+		if report.Error == "" {
+			reconcileLastSuccess.SetToCurrentTime()
+			reconcileOrphans.Set(float64(report.Orphaned))
+		}
+		p.mu.Lock()
+		p.lastReport = report
+		p.mu.Unlock()
+		p.HistoryService.RecordReconcile(report)
+		zap.S().Infof("reconcile finished checked %d created %d updated %d orphaned %d failed %d",
+			report.Checked, report.Created, report.Updated, report.Orphaned, report.Failed)
+	}()
+
+	podModels, err := p.PodRepository.FindAll()
+	if err != nil {
+		zap.S().Errorf("reconcile find pods error %s", err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	known := map[string]bool{}
+	for _, podModel := range podModels {
+		cluster := model.ClusterOrDefault(podModel.PodCluster)
+		known[cluster+"/"+podModel.PodNamespace+"/"+podModel.PodName] = true
+		report.Checked++
+		// 只有当前集群的 client，其他集群的 pod 不能对账
+		if !model.IsSupportedCluster(cluster) {
+			p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, "cluster "+cluster+" is not supported")
+			continue
+		}
+		p.reconcilePod(podModel, report)
+	}
+
+	// 删除操作还没有执行完的 pod，Deployment 还在集群中，不是孤儿
+	deleting := map[string]bool{}
+	deletedPods, err := p.PodRepository.FindDeletedPods("", "")
+	if err != nil {
+		zap.S().Errorf("reconcile find deleted pods error %s", err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	for _, deletedPod := range deletedPods {
+		pending, err := hasUnfinishedOperations(p.OperationRepository, deletedPod.ID)
+		if err != nil {
+			zap.S().Errorf("reconcile find operations of pod %d error %s", deletedPod.ID, err.Error())
+			report.Error = err.Error()
+			return report
+		}
+		if pending {
+			deleting[model.ClusterOrDefault(deletedPod.PodCluster)+"/"+deletedPod.PodNamespace+"/"+deletedPod.PodName] = true
+		}
+	}
+
+	deployments, err := p.K8sClientSet.AppsV1().Deployments(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: LabelManagedBy + "=" + ManagedBy,
+	})
+	if err != nil {
+		zap.S().Errorf("reconcile list deployments error %s", err.Error())
+		report.Error = err.Error()
+		return report
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		// clientSet 连接的是默认集群
+		key := model.DefaultCluster + "/" + deployment.Namespace + "/" + deployment.Name
+		if known[key] || deleting[key] {
+			continue
+		}
+		p.flagOrphan(deployment, report)
+	}
+	return report
+}
+
+func (p *PodReconcileService) reconcilePod(podModel *model.Pod, report *pod.ReconcileReport) {
+	// 先读取集群中的 Deployment，之后 worker 修改过时 patch 带的 resourceVersion 会冲突
+	live, err := p.K8sClientSet.AppsV1().Deployments(podModel.PodNamespace).Get(context.TODO(), podModel.PodName, metav1.GetOptions{})
+	missing := k8serrors.IsNotFound(err)
+	if err != nil && !missing {
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+		return
+	}
+	// 还有操作没有执行完时数据库和集群本来就不一致，等 worker 执行完再对账
+	pending, err := hasUnfinishedOperations(p.OperationRepository, podModel.ID)
+	if err != nil {
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+		return
+	}
+	if pending {
+		return
+	}
+	// FindAll 之后 worker 可能已经执行完新的操作，版本变了时等下一轮，避免用旧的数据覆盖
+	current, err := p.PodRepository.FindPodByID(podModel.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+	if err != nil {
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+		return
+	}
+	if current.Version != podModel.Version {
+		return
+	}
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(current, info); err != nil {
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+		return
+	}
+	desired := p.dataService.buildDeployment(info)
+
+	if missing {
+		if _, err := p.K8sClientSet.AppsV1().Deployments(podModel.PodNamespace).Create(context.TODO(), desired, metav1.CreateOptions{}); err != nil {
+			p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+			return
+		}
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_CREATED, podModel, "deployment missing, recreated")
+		return
+	}
+
+	drift := getDrift(desired, live)
+	imported := live.Annotations[AnnotationImported] == "true"
+	if imported {
+		drift, err = p.getImportedDrift(desired, live)
+		if err != nil {
+			p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+			return
+		}
+	}
+	if drift == "" {
+		return
+	}
+	patch, err := getRepairPatch(live, desired, imported)
+	if err != nil {
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+		return
+	}
+	if _, err := p.K8sClientSet.AppsV1().Deployments(podModel.PodNamespace).Patch(context.TODO(), podModel.PodName,
+		types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, podModel, err.Error())
+		return
+	}
+	p.record(report, pod.ReconcileAction_RECONCILE_ACTION_UPDATED, podModel, drift+" drifted, re-applied")
+}
+
+func (p *PodReconcileService) flagOrphan(deployment *appsv1.Deployment, report *pod.ReconcileReport) {
+	orphan := &model.Pod{PodCluster: model.DefaultCluster, PodName: deployment.Name, PodNamespace: deployment.Namespace}
+	if deployment.Annotations[AnnotationOrphaned] != "true" {
+		patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:"true"}}}`, AnnotationOrphaned)
+		if _, err := p.K8sClientSet.AppsV1().Deployments(deployment.Namespace).Patch(context.TODO(), deployment.Name,
+			types.MergePatchType, []byte(patch), metav1.PatchOptions{}); err != nil {
+			p.record(report, pod.ReconcileAction_RECONCILE_ACTION_FAILED, orphan, err.Error())
+			return
+		}
+	}
+	p.record(report, pod.ReconcileAction_RECONCILE_ACTION_ORPHANED, orphan, "managed deployment has no pod record")
+}
+
+func (p *PodReconcileService) record(report *pod.ReconcileReport, action pod.ReconcileAction, podModel *model.Pod, message string) {
+	switch action {
+	case pod.ReconcileAction_RECONCILE_ACTION_CREATED:
+		report.Created++
+	case pod.ReconcileAction_RECONCILE_ACTION_UPDATED:
+		report.Updated++
+	case pod.ReconcileAction_RECONCILE_ACTION_ORPHANED:
+		report.Orphaned++
+	case pod.ReconcileAction_RECONCILE_ACTION_FAILED:
+		report.Failed++
+		zap.S().Errorf("reconcile pod %d %s/%s/%s error %s", podModel.ID, model.ClusterOrDefault(podModel.PodCluster),
+			podModel.PodNamespace, podModel.PodName, message)
+	}
+	reconcileActions.WithLabelValues(action.String()).Inc()
+	report.Items = append(report.Items, &pod.ReconcileItem{
+		Action:       action,
+		PodId:        podModel.ID,
+		PodCluster:   model.ClusterOrDefault(podModel.PodCluster),
+		PodNamespace: podModel.PodNamespace,
+		PodName:      podModel.PodName,
+		Message:      message,
+	})
+}
+
+// getRepairPatch 只修改 wepass 管理的字段，其他人添加的字段保持不变
+// 带上 resourceVersion，对账期间被修改过时返回 Conflict，下一轮再对账
+func getRepairPatch(live, desired *appsv1.Deployment, imported bool) ([]byte, error) {
+	original, err := json.Marshal(live)
+	if err != nil {
+		return nil, err
+	}
+	modified, err := json.Marshal(repairDeployment(live, desired, imported))
+	if err != nil {
+		return nil, err
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatch(original, modified, appsv1.Deployment{})
+	if err != nil {
+		return nil, err
+	}
+	patchMap := map[string]interface{}{}
+	if err := json.Unmarshal(patch, &patchMap); err != nil {
+		return nil, err
+	}
+	metadata, ok := patchMap["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		patchMap["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = live.ResourceVersion
+	return json.Marshal(patchMap)
+}
+
+// repairDeployment 把 desired 中 wepass 管理的字段设置到 live 的副本上
+// 导入的 Deployment 保留 sidecar、valueFrom 的环境变量和其他资源，template 的标签在导入时没有修改，也不修改
+func repairDeployment(live, desired *appsv1.Deployment, imported bool) *appsv1.Deployment {
+	repaired := live.DeepCopy()
+	repaired.Labels = mergeLabels(repaired.Labels, desired.Labels)
+	if !imported {
+		repaired.Spec.Template.Labels = mergeLabels(repaired.Spec.Template.Labels, desired.Spec.Template.Labels)
+	}
+	repaired.Spec.Replicas = desired.Spec.Replicas
+	// Recreate 不能带 rollingUpdate，类型不一致时整个替换
+	if repaired.Spec.Strategy.Type != desired.Spec.Strategy.Type {
+		repaired.Spec.Strategy = desired.Spec.Strategy
+	}
+	repaired.Spec.Template.Spec.RestartPolicy = desired.Spec.Template.Spec.RestartPolicy
+
+	want := desired.Spec.Template.Spec.Containers[0]
+	containers := repaired.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		repaired.Spec.Template.Spec.Containers = []corev1.Container{want}
+		return repaired
+	}
+	if !imported {
+		containers = containers[:1]
+		repaired.Spec.Template.Spec.Containers = containers
+	}
+	container := &containers[0]
+	container.Image = want.Image
+	container.ImagePullPolicy = want.ImagePullPolicy
+	if !imported {
+		container.Resources = want.Resources
+		container.Env = want.Env
+		container.Ports = want.Ports
+		return repaired
+	}
+
+	container.Resources.Limits = mergeResources(container.Resources.Limits, want.Resources.Limits)
+	container.Resources.Requests = mergeResources(container.Resources.Requests, want.Resources.Requests)
+	env := append([]corev1.EnvVar{}, want.Env...)
+	for _, liveEnv := range container.Env {
+		if liveEnv.ValueFrom != nil {
+			env = append(env, liveEnv)
+		}
+	}
+	container.Env = env
+	var ports []corev1.ContainerPort
+	for _, wantPort := range want.Ports {
+		port := wantPort
+		for _, livePort := range container.Ports {
+			if livePort.ContainerPort == wantPort.ContainerPort && getPortProtocol(livePort) == wantPort.Protocol {
+				port = livePort
+				break
+			}
+		}
+		ports = append(ports, port)
+	}
+	container.Ports = ports
+	return repaired
+}
+
+func mergeLabels(labels, desired map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range desired {
+		merged[key] = value
+	}
+	return merged
+}
+
+func mergeResources(resources, desired corev1.ResourceList) corev1.ResourceList {
+	merged := corev1.ResourceList{}
+	for name, quantity := range resources {
+		merged[name] = quantity
+	}
+	for name, quantity := range desired {
+		merged[name] = quantity
+	}
+	return merged
+}
+
+// getPortProtocol 没有设置协议时是 TCP
+func getPortProtocol(port corev1.ContainerPort) corev1.Protocol {
+	if port.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// getImportedDrift 导入的 Deployment 可能有 wepass 不支持的字段，比如 sidecar 和 valueFrom 的环境变量
+// 先转换成 pod 再生成 Deployment，只比较 wepass 管理的字段
+func (p *PodReconcileService) getImportedDrift(desired, live *appsv1.Deployment) (string, error) {
+	converted, _ := ConvertDeployment(live)
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(converted, info); err != nil {
+		return "", err
+	}
+	return getDrift(desired, p.dataService.buildDeployment(info)), nil
+}
+
+// getDrift 比较 wepass 管理的字段，返回第一个不一致的字段名，一致时返回空字符串
+// 集群会给 Deployment 填充很多默认值，所以不能直接比较整个对象
+func getDrift(desired, live *appsv1.Deployment) string {
+	if getReplicas(desired) != getReplicas(live) {
+		return "replicas"
+	}
+	if desired.Spec.Strategy.Type != live.Spec.Strategy.Type {
+		return "strategy"
+	}
+	for key, value := range desired.Labels {
+		if live.Labels[key] != value {
+			return "labels"
+		}
+	}
+	for key, value := range desired.Spec.Template.Labels {
+		if live.Spec.Template.Labels[key] != value {
+			return "labels"
+		}
+	}
+	if desired.Spec.Template.Spec.RestartPolicy != live.Spec.Template.Spec.RestartPolicy {
+		return "restart policy"
+	}
+	if len(live.Spec.Template.Spec.Containers) != len(desired.Spec.Template.Spec.Containers) {
+		return "containers"
+	}
+	want, got := desired.Spec.Template.Spec.Containers[0], live.Spec.Template.Spec.Containers[0]
+	switch {
+	case want.Image != got.Image:
+		return "image"
+	case want.ImagePullPolicy != got.ImagePullPolicy:
+		return "image pull policy"
+	case !equality.Semantic.DeepEqual(want.Resources, got.Resources):
+		return "resources"
+	case len(want.Env) != len(got.Env) || (len(want.Env) > 0 && !equality.Semantic.DeepEqual(want.Env, got.Env)):
+		return "env"
+	case len(want.Ports) != len(got.Ports) || (len(want.Ports) > 0 && !equality.Semantic.DeepEqual(want.Ports, got.Ports)):
+		return "ports"
+	}
+	return ""
+}
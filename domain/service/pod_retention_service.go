@@ -0,0 +1,37 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	"time"
+)
+
+type IPodRetentionService interface {
+	// Run 按 interval 周期性清理超过 retention 的软删除 pod，阻塞直到 stopCh 关闭
+	Run(interval, retention time.Duration, stopCh <-chan struct{})
+}
+
+type PodRetentionService struct {
+	PodDataService IPodDataService
+}
+
+func NewPodRetentionService(podDataService IPodDataService) IPodRetentionService {
+	return &PodRetentionService{PodDataService: podDataService}
+}
+
+func (p PodRetentionService) Run(interval, retention time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := p.PodDataService.PurgeDeletedPods(time.Now().Add(-retention))
+		if err != nil {
+			zap.S().Errorf("purge deleted pods error %s", err.Error())
+		} else if purged > 0 {
+			zap.S().Infof("purge %d deleted pods older than %s", purged, retention)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
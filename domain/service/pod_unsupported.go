@@ -0,0 +1,182 @@
+package service
+
+import (
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	// 由 apiserver 设置的字段，和 pod 的配置无关
+	ignoredDeploymentPaths = map[string]bool{
+		"metadata.uid":               true,
+		"metadata.resourceVersion":   true,
+		"metadata.generation":        true,
+		"metadata.creationTimestamp": true,
+		"metadata.managedFields":     true,
+		"metadata.selfLink":          true,
+		"status":                     true,
+	}
+	// 由 kubectl、deployment controller 和 wepass 自己设置的注解
+	ignoredAnnotations = map[string]bool{
+		"deployment.kubernetes.io/revision":                true,
+		"kubectl.kubernetes.io/last-applied-configuration": true,
+		"kubectl.kubernetes.io/restartedAt":                true,
+		AnnotationImported:                                 true,
+		AnnotationOrphaned:                                 true,
+	}
+	envVarsType = reflect.TypeOf([]corev1.EnvVar{})
+)
+
+// getUnsupportedFields 用转换出来的 pod 重新生成 Deployment，和原来的 Deployment 逐个字段比较
+// 返回原来设置了、但是重新生成之后会改变或者丢失的字段，下次更新 pod 时这些配置会被覆盖
+func getUnsupportedFields(deployment *appsv1.Deployment, podModel *model.Pod) []string {
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(podModel, info); err != nil {
+		zap.S().Errorf("convert deployment %s/%s error %s", deployment.Namespace, deployment.Name, err.Error())
+		return []string{"spec"}
+	}
+	rebuilt := (&PodDataService{}).buildDeployment(info)
+	setDeploymentDefaults(rebuilt)
+	var unsupported []string
+	diffField("", reflect.ValueOf(*deployment), reflect.ValueOf(*rebuilt), &unsupported)
+	return unsupported
+}
+
+// setDeploymentDefaults 和 apiserver 填充的默认值一致，从集群中读到的 Deployment 都带有这些值
+func setDeploymentDefaults(deployment *appsv1.Deployment) {
+	spec := &deployment.Spec
+	revisionHistoryLimit, progressDeadlineSeconds := int32(10), int32(600)
+	spec.RevisionHistoryLimit = &revisionHistoryLimit
+	spec.ProgressDeadlineSeconds = &progressDeadlineSeconds
+	if spec.Strategy.Type == appsv1.RollingUpdateDeploymentStrategyType {
+		maxUnavailable, maxSurge := intstr.FromString("25%"), intstr.FromString("25%")
+		spec.Strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{MaxUnavailable: &maxUnavailable, MaxSurge: &maxSurge}
+	}
+	podSpec := &spec.Template.Spec
+	terminationGracePeriodSeconds := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	podSpec.TerminationGracePeriodSeconds = &terminationGracePeriodSeconds
+	podSpec.DNSPolicy = corev1.DNSClusterFirst
+	podSpec.SchedulerName = corev1.DefaultSchedulerName
+	podSpec.ServiceAccountName = "default"
+	podSpec.DeprecatedServiceAccount = "default"
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].TerminationMessagePath = corev1.TerminationMessagePathDefault
+		podSpec.Containers[i].TerminationMessagePolicy = corev1.TerminationMessageReadFile
+	}
+}
+
+// diffField 按 json 字段名生成路径，原来没有设置的字段不比较
+func diffField(path string, value, rebuilt reflect.Value, unsupported *[]string) {
+	if ignoredDeploymentPaths[path] || isUnset(value) {
+		return
+	}
+	switch typed := value.Interface().(type) {
+	case resource.Quantity:
+		if quantity, ok := rebuilt.Interface().(resource.Quantity); !ok || typed.Cmp(quantity) != 0 {
+			*unsupported = append(*unsupported, path)
+		}
+		return
+	case intstr.IntOrString, metav1.Time:
+		if !reflect.DeepEqual(typed, rebuilt.Interface()) {
+			*unsupported = append(*unsupported, path)
+		}
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		if rebuilt.IsNil() {
+			*unsupported = append(*unsupported, path)
+			return
+		}
+		diffField(path, value.Elem(), rebuilt.Elem(), unsupported)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || field.PkgPath != "" {
+				continue
+			}
+			// inline 的字段没有名称，比如 TypeMeta
+			fieldPath := path
+			if name != "" && path != "" {
+				fieldPath = path + "." + name
+			} else if name != "" {
+				fieldPath = name
+			}
+			diffField(fieldPath, value.Field(i), rebuilt.Field(i), unsupported)
+		}
+	case reflect.Map:
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, key := range keys {
+			if strings.HasSuffix(path, "annotations") && ignoredAnnotations[key.String()] {
+				continue
+			}
+			keyPath := fmt.Sprintf("%s[%v]", path, key)
+			rebuiltValue := rebuilt.MapIndex(key)
+			if !rebuiltValue.IsValid() {
+				*unsupported = append(*unsupported, keyPath)
+				continue
+			}
+			diffField(keyPath, value.MapIndex(key), rebuiltValue, unsupported)
+		}
+	case reflect.Slice:
+		if rebuilt.Len() == 0 {
+			*unsupported = append(*unsupported, path)
+			return
+		}
+		// 环境变量按名称比较，valueFrom 的环境变量转换时被跳过，后面的下标会错开
+		if value.Type() == envVarsType {
+			rebuiltEnvs := map[string]reflect.Value{}
+			for i := 0; i < rebuilt.Len(); i++ {
+				rebuiltEnvs[rebuilt.Index(i).FieldByName("Name").String()] = rebuilt.Index(i)
+			}
+			for i := 0; i < value.Len(); i++ {
+				name := value.Index(i).FieldByName("Name").String()
+				envPath := fmt.Sprintf("%s[%s]", path, name)
+				if rebuiltEnv, ok := rebuiltEnvs[name]; ok {
+					diffField(envPath, value.Index(i), rebuiltEnv, unsupported)
+				} else {
+					*unsupported = append(*unsupported, envPath)
+				}
+			}
+			return
+		}
+		for i := 0; i < value.Len(); i++ {
+			indexPath := fmt.Sprintf("%s[%d]", path, i)
+			if i >= rebuilt.Len() {
+				*unsupported = append(*unsupported, indexPath)
+				continue
+			}
+			diffField(indexPath, value.Index(i), rebuilt.Index(i), unsupported)
+		}
+	default:
+		if !reflect.DeepEqual(value.Interface(), rebuilt.Interface()) {
+			*unsupported = append(*unsupported, path)
+		}
+	}
+}
+
+// isUnset 空的 slice、map 和指向空结构体的指针也当作没有设置，比如 securityContext: {}
+func isUnset(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr:
+		return value.IsNil() || (value.Elem().Kind() == reflect.Struct && value.Elem().IsZero())
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
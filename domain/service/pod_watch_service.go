@@ -0,0 +1,280 @@
+package service
+
+import (
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const podEventBufferSize = 100
+
+type IPodWatchService interface {
+	// Run 启动 informer，阻塞直到 stopCh 关闭
+	Run(stopCh <-chan struct{})
+	// Subscribe 订阅事件，namespace 和 teamID 为空时表示不过滤，返回的函数用于取消订阅
+	Subscribe(namespace, teamID string) (<-chan *pod.PodEvent, func())
+}
+
+type podEventSubscriber struct {
+	namespace string
+	teamID    string
+	events    chan *pod.PodEvent
+}
+
+type PodWatchService struct {
+	K8sClientSet kubernetes.Interface
+	// 只关注带 wepass 标签的 Deployment、ReplicaSet 和 Pod
+	factory informers.SharedInformerFactory
+	// Event 本身没有标签，需要单独 watch 再根据关联对象过滤
+	eventFactory informers.SharedInformerFactory
+	synced       int32
+
+	mu          sync.RWMutex
+	nextID      int64
+	subscribers map[int64]*podEventSubscriber
+}
+
+func NewPodWatchService(clientSet kubernetes.Interface) IPodWatchService {
+	return &PodWatchService{
+		K8sClientSet: clientSet,
+		factory: informers.NewSharedInformerFactoryWithOptions(clientSet, 0,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = LabelManagedBy + "=" + ManagedBy
+			}),
+		),
+		eventFactory: informers.NewSharedInformerFactory(clientSet, 0),
+		subscribers:  map[int64]*podEventSubscriber{},
+	}
+}
+
+func (p *PodWatchService) Run(stopCh <-chan struct{}) {
+	p.factory.Apps().V1().Deployments().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    p.onDeploymentAdd,
+		UpdateFunc: p.onDeploymentUpdate,
+		DeleteFunc: p.onDeploymentDelete,
+	})
+	p.factory.Apps().V1().ReplicaSets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: p.onReplicaSetAdd,
+	})
+	p.factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: p.onPodUpdate,
+	})
+	p.eventFactory.Core().V1().Events().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: p.onEvent,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			p.onEvent(newObj)
+		},
+	})
+
+	p.factory.Start(stopCh)
+	p.eventFactory.Start(stopCh)
+	p.factory.WaitForCacheSync(stopCh)
+	p.eventFactory.WaitForCacheSync(stopCh)
+	// 初次同步产生的 add 事件是存量数据，不推送给订阅者
+	atomic.StoreInt32(&p.synced, 1)
+	zap.S().Info("pod watcher cache synced")
+	<-stopCh
+}
+
+func (p *PodWatchService) Subscribe(namespace, teamID string) (<-chan *pod.PodEvent, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	id := p.nextID
+	subscriber := &podEventSubscriber{
+		namespace: namespace,
+		teamID:    teamID,
+		events:    make(chan *pod.PodEvent, podEventBufferSize),
+	}
+	p.subscribers[id] = subscriber
+	var once sync.Once
+	return subscriber.events, func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			delete(p.subscribers, id)
+			close(subscriber.events)
+		})
+	}
+}
+
+func (p *PodWatchService) publish(event *pod.PodEvent) {
+	if atomic.LoadInt32(&p.synced) == 0 {
+		return
+	}
+	event.Timestamp = time.Now().Unix()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, subscriber := range p.subscribers {
+		if subscriber.namespace != "" && subscriber.namespace != event.PodNamespace {
+			continue
+		}
+		if subscriber.teamID != "" && subscriber.teamID != event.PodTeamId {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			// 订阅者消费太慢时直接丢弃，避免阻塞 informer
+			zap.S().Warnf("pod watcher subscriber buffer full, drop event %s %s/%s", event.Type, event.PodNamespace, event.PodName)
+		}
+	}
+}
+
+func (p *PodWatchService) newEvent(eventType pod.PodEventType, kind string, object metav1.Object) *pod.PodEvent {
+	labels := object.GetLabels()
+	return &pod.PodEvent{
+		Type:         eventType,
+		PodNamespace: object.GetNamespace(),
+		PodName:      labels[LabelAppName],
+		PodTeamId:    labels[LabelTeam],
+		ObjectKind:   kind,
+		ObjectName:   object.GetName(),
+	}
+}
+
+func (p *PodWatchService) onDeploymentAdd(obj interface{}) {
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	event := p.newEvent(pod.PodEventType_POD_EVENT_CREATED, "Deployment", deployment)
+	p.fillReplicas(event, deployment)
+	p.publish(event)
+}
+
+func (p *PodWatchService) onDeploymentUpdate(oldObj, newObj interface{}) {
+	oldDeployment, ok := oldObj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	deployment, ok := newObj.(*appsv1.Deployment)
+	if !ok || oldDeployment.ResourceVersion == deployment.ResourceVersion {
+		return
+	}
+	var eventType pod.PodEventType
+	switch {
+	case getReplicas(oldDeployment) != getReplicas(deployment):
+		eventType = pod.PodEventType_POD_EVENT_SCALED
+	case oldDeployment.Generation != deployment.Generation:
+		eventType = pod.PodEventType_POD_EVENT_ROLLOUT_PROGRESSING
+	case oldDeployment.Status.UpdatedReplicas != deployment.Status.UpdatedReplicas,
+		oldDeployment.Status.ReadyReplicas != deployment.Status.ReadyReplicas:
+		eventType = pod.PodEventType_POD_EVENT_ROLLOUT_PROGRESSING
+	default:
+		return
+	}
+	event := p.newEvent(eventType, "Deployment", deployment)
+	p.fillReplicas(event, deployment)
+	p.publish(event)
+}
+
+func (p *PodWatchService) onDeploymentDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	deployment, ok := obj.(*appsv1.Deployment)
+	if !ok {
+		return
+	}
+	p.publish(p.newEvent(pod.PodEventType_POD_EVENT_DELETED, "Deployment", deployment))
+}
+
+func (p *PodWatchService) onReplicaSetAdd(obj interface{}) {
+	replicaSet, ok := obj.(*appsv1.ReplicaSet)
+	if !ok {
+		return
+	}
+	// 每次滚动更新都会创建新的 ReplicaSet
+	event := p.newEvent(pod.PodEventType_POD_EVENT_ROLLOUT_PROGRESSING, "ReplicaSet", replicaSet)
+	event.Reason = "NewReplicaSet"
+	event.Message = "revision " + replicaSet.Annotations["deployment.kubernetes.io/revision"]
+	p.publish(event)
+}
+
+func (p *PodWatchService) onPodUpdate(oldObj, newObj interface{}) {
+	oldPod, ok := oldObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	newPod, ok := newObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	// 只在进入 CrashLoopBackOff 时推送一次
+	if getCrashLoopState(oldPod) != nil {
+		return
+	}
+	if waiting := getCrashLoopState(newPod); waiting != nil {
+		event := p.newEvent(pod.PodEventType_POD_EVENT_REPLICA_CRASHLOOPING, "Pod", newPod)
+		event.Reason = waiting.Reason
+		event.Message = waiting.Message
+		p.publish(event)
+	}
+}
+
+func (p *PodWatchService) onEvent(obj interface{}) {
+	k8sEvent, ok := obj.(*corev1.Event)
+	if !ok || k8sEvent.Type != corev1.EventTypeWarning {
+		return
+	}
+	object := p.findManagedObject(k8sEvent.InvolvedObject)
+	if object == nil {
+		return
+	}
+	event := p.newEvent(pod.PodEventType_POD_EVENT_WARNING, k8sEvent.InvolvedObject.Kind, object)
+	event.Reason = k8sEvent.Reason
+	event.Message = k8sEvent.Message
+	p.publish(event)
+}
+
+// findManagedObject 在缓存中查找事件关联的对象，找不到说明不是 wepass 管理的资源
+func (p *PodWatchService) findManagedObject(reference corev1.ObjectReference) metav1.Object {
+	var (
+		object metav1.Object
+		err    error
+	)
+	switch reference.Kind {
+	case "Deployment":
+		object, err = p.factory.Apps().V1().Deployments().Lister().Deployments(reference.Namespace).Get(reference.Name)
+	case "ReplicaSet":
+		object, err = p.factory.Apps().V1().ReplicaSets().Lister().ReplicaSets(reference.Namespace).Get(reference.Name)
+	case "Pod":
+		object, err = p.factory.Core().V1().Pods().Lister().Pods(reference.Namespace).Get(reference.Name)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return object
+}
+
+func (p *PodWatchService) fillReplicas(event *pod.PodEvent, deployment *appsv1.Deployment) {
+	event.Replicas = getReplicas(deployment)
+	event.ReadyReplicas = deployment.Status.ReadyReplicas
+}
+
+func getReplicas(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return *deployment.Spec.Replicas
+}
+
+func getCrashLoopState(p *corev1.Pod) *corev1.ContainerStateWaiting {
+	for _, status := range p.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+			return status.State.Waiting
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	"github.com/DuanNengxin/wepass-pod/domain/service"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+)
+
+const exportUsage = "usage: pod export [-id <pod id>] [-cluster <cluster>] [-namespace <namespace>] [-team <team id>] " +
+	"[-format yaml|kustomize|helm] [-chart <name>] [-out <dir>]"
+
+// runExport 执行 export 子命令，例如 pod -mode prod export -namespace wepass -format helm -out ./chart
+// 只读取数据库，不需要连接集群，yaml 格式没有指定 -out 时输出到标准输出
+func runExport(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	request := &pod.ExportPodsRequest{}
+	flags.Int64Var(&request.PodId, "id", 0, "pod id")
+	flags.StringVar(&request.PodCluster, "cluster", "", "集群，默认 default")
+	flags.StringVar(&request.PodNamespace, "namespace", "", "命名空间")
+	flags.StringVar(&request.PodTeamId, "team", "", "团队")
+	flags.StringVar(&request.Format, "format", service.ExportYAML, "yaml、kustomize 或者 helm")
+	flags.StringVar(&request.ChartName, "chart", "", "helm chart 的名称")
+	out := flags.String("out", "", "输出目录")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(exportUsage)
+	}
+
+	response, err := service.NewPodExportService(repository.NewPodRepository(db)).ExportPods(request)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		if len(response.Files) != 1 {
+			return fmt.Errorf("format %s writes %d files, -out is required", request.Format, len(response.Files))
+		}
+		_, err = fmt.Fprint(os.Stdout, response.Files[0].Content)
+		return err
+	}
+	for _, file := range response.Files {
+		path := filepath.Join(*out, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(file.Content), 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "exported %d pods to %s\n", response.PodCount, *out)
+	return nil
+}
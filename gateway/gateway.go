@@ -0,0 +1,553 @@
+package gateway
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/plugin"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/asim/go-micro/v3/client"
+	microErrors "github.com/asim/go-micro/v3/errors"
+	"github.com/asim/go-micro/v3/metadata"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 请求体最大 4MB
+const maxBodySize = 4 << 20
+
+//go:embed openapi.yaml
+var openAPIYAML []byte
+
+// handleFunc params 是路径中 {name} 对应的值，返回值序列化成 json 返回给调用方
+type handleFunc func(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error)
+
+type route struct {
+	method   string
+	segments []string
+	status   int
+	handle   handleFunc
+}
+
+// Gateway 把 PodService 的 rpc 转换成 REST 接口，通过 go-micro client 调用，审计、限流和监控的 wrapper 都会生效
+type Gateway struct {
+	PodService pod.PodService
+	routes     []*route
+	openAPI    []byte
+}
+
+// NewGateway openapi.yaml 无法转换成 json 时返回错误，不启动一个文档为空的网关
+func NewGateway(podService pod.PodService) (http.Handler, error) {
+	openAPI, err := yaml.YAMLToJSON(openAPIYAML)
+	if err != nil {
+		return nil, fmt.Errorf("convert openapi document error %w", err)
+	}
+	g := &Gateway{PodService: podService, openAPI: openAPI}
+	// 固定路径要在带参数的路径之前，比如 /v1/pods/watch 和 /v1/pods/{id}
+	g.handle(http.MethodGet, "/v1/pods", http.StatusOK, g.findPodAll)
+	g.handle(http.MethodPost, "/v1/pods", http.StatusCreated, g.addPod)
+	g.handle(http.MethodGet, "/v1/pods/watch", http.StatusOK, nil)
+	g.handle(http.MethodGet, "/v1/pods/{id}", http.StatusOK, g.findPodByID)
+	g.handle(http.MethodPatch, "/v1/pods/{id}", http.StatusOK, g.updatePod)
+	g.handle(http.MethodDelete, "/v1/pods/{id}", http.StatusOK, g.deletePod)
+	g.handle(http.MethodPost, "/v1/pods/{id}/restore", http.StatusOK, g.restorePod)
+	g.handle(http.MethodGet, "/v1/pods/{id}/metrics", http.StatusOK, g.getPodMetrics)
+	g.handle(http.MethodGet, "/v1/pods/{id}/events", http.StatusOK, g.listPodEvents)
+	g.handle(http.MethodGet, "/v1/pods/{id}/history", http.StatusOK, g.getPodHistory)
+	g.handle(http.MethodGet, "/v1/namespaces/{namespace}/pods/{name}", http.StatusOK, g.findPodByName)
+	g.handle(http.MethodGet, "/v1/deleted-pods", http.StatusOK, g.listDeletedPods)
+	g.handle(http.MethodGet, "/v1/operations/{id}", http.StatusOK, g.getPodOperation)
+	g.handle(http.MethodGet, "/v1/reconcile", http.StatusOK, g.reconcileStatus)
+	g.handle(http.MethodPost, "/v1/imports", http.StatusOK, g.importPods)
+	g.handle(http.MethodGet, "/v1/audit-logs", http.StatusOK, g.queryAudit)
+	g.handle(http.MethodGet, "/v1/exports", http.StatusOK, g.exportPods)
+	g.handle(http.MethodPost, "/v1/manifests", http.StatusOK, g.applyManifest)
+	g.handle(http.MethodPost, "/v1/batch/apply", http.StatusOK, g.batchApply)
+	g.handle(http.MethodPost, "/v1/batch/delete", http.StatusOK, g.batchDelete)
+	return g, nil
+}
+
+func (g *Gateway) handle(method, path string, status int, handle handleFunc) {
+	g.routes = append(g.routes, &route{
+		method:   method,
+		segments: strings.Split(strings.Trim(path, "/"), "/"),
+		status:   status,
+		handle:   handle,
+	})
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/openapi.yaml":
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(openAPIYAML)
+		return
+	case "/openapi.json":
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(g.openAPI)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var allowed []string
+	for _, rt := range g.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		ctx := withActor(r)
+		if rt.handle == nil {
+			g.watchPods(ctx, w, r)
+			return
+		}
+		result, err := rt.handle(ctx, r, params)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, rt.status, result)
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, common.MethodNotAllowed("method %s not allowed", r.Method))
+		return
+	}
+	writeError(w, common.NotFound("path %s not found", r.URL.Path))
+}
+
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range rt.segments {
+		if strings.HasPrefix(segment, "{") {
+			params[strings.Trim(segment, "{}")] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// withActor 把操作人放到 metadata 中，审计日志会记录下来
+func withActor(r *http.Request) context.Context {
+	ctx := r.Context()
+	if actor := r.Header.Get(plugin.ActorHeader); actor != "" {
+		ctx = metadata.Set(ctx, plugin.ActorHeader, actor)
+	}
+	return ctx
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		zap.S().Errorf("gateway write response error %s", err.Error())
+	}
+}
+
+// writeError go-micro 的错误码就是 http 状态码，body 是 detail 中带错误码的 common.Error
+func writeError(w http.ResponseWriter, err error) {
+	microErr := microErrors.FromError(common.MicroError(err))
+	status := int(microErr.Code)
+	if status < http.StatusBadRequest || status > 599 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, common.ParseMicroError(microErr))
+}
+
+func decodeBody(r *http.Request, value interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return common.InvalidArgument("read body error %s", err.Error())
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return common.InvalidArgument("invalid json body").WithField("body", err.Error())
+	}
+	return nil
+}
+
+func pathID(params map[string]string) (int64, error) {
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, common.InvalidArgument("invalid id %s", params["id"]).WithField("id", "must be a positive integer")
+	}
+	return id, nil
+}
+
+func queryInt(query url.Values, key string) (int64, error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, common.InvalidArgument("invalid %s %s", key, value).WithField(key, "must be an integer")
+	}
+	return number, nil
+}
+
+func queryBool(query url.Values, key string) (bool, error) {
+	value := query.Get(key)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, common.InvalidArgument("invalid %s %s", key, value).WithField(key, "must be a boolean")
+	}
+	return b, nil
+}
+
+func (g *Gateway) findPodAll(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	query := r.URL.Query()
+	pageSize, err := queryInt(query, "page_size")
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.FindPodAll(ctx, &pod.FindAll{
+		PodCluster:    query.Get("pod_cluster"),
+		PodNamespace:  query.Get("pod_namespace"),
+		PodTeamId:     query.Get("pod_team_id"),
+		NamePrefix:    query.Get("name_prefix"),
+		Image:         query.Get("image"),
+		LabelSelector: query.Get("label_selector"),
+		PageToken:     query.Get("page_token"),
+		PageSize:      int32(pageSize),
+		OrderBy:       query.Get("order_by"),
+	})
+}
+
+func (g *Gateway) addPod(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	info := &pod.PodInfo{}
+	if err := decodeBody(r, info); err != nil {
+		return nil, err
+	}
+	return g.PodService.AddPod(ctx, info, waitOption(info))
+}
+
+// waitOption 等待滚动更新时不能用 client 默认的超时时间
+func waitOption(info *pod.PodInfo) client.CallOption {
+	if !info.Wait {
+		return func(*client.CallOptions) {}
+	}
+	return timeoutOption(info.WaitTimeoutSeconds)
+}
+
+// timeoutOption 比服务端等待的时间多 30 秒，默认等待 300 秒
+func timeoutOption(seconds int32) client.CallOption {
+	timeout := int64(seconds)
+	if timeout <= 0 {
+		timeout = 300
+	}
+	return client.WithRequestTimeout(time.Duration(timeout+30) * time.Second)
+}
+
+func (g *Gateway) findPodByID(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.FindPodByID(ctx, &pod.PodID{Id: id})
+}
+
+func (g *Gateway) findPodByName(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	return g.PodService.FindPodByName(ctx, &pod.FindPodByNameRequest{
+		PodCluster:   r.URL.Query().Get("pod_cluster"),
+		PodNamespace: params["namespace"],
+		PodName:      params["name"],
+	})
+}
+
+// updatePod 按 json merge patch 的方式合并到当前的 pod 上，数组整体替换，null 表示清空
+// 版本号放在 body 的 resource_version 或者 If-Match 中，都没有时返回 428，不会覆盖别人同时做的修改
+func (g *Gateway) updatePod(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	patch := map[string]interface{}{}
+	if err := decodeBody(r, &patch); err != nil {
+		return nil, err
+	}
+	if err := patchVersion(r, patch); err != nil {
+		return nil, err
+	}
+	current, err := g.PodService.FindPodByID(ctx, &pod.PodID{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	merged := map[string]interface{}{}
+	data, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = value
+	}
+	info := &pod.PodInfo{}
+	if data, err = json.Marshal(merged); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, common.InvalidArgument("invalid patch").WithField("body", err.Error())
+	}
+	info.Id = id
+	return g.PodService.UpdatePod(ctx, info, waitOption(info))
+}
+
+// patchVersion 把 If-Match 中的版本号放到 patch 中，If-Match 可以是 "3" 或者 3，和 body 中的版本号不一致时报错
+func patchVersion(r *http.Request, patch map[string]interface{}) error {
+	ifMatch := strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+	version, inBody := patch["resource_version"]
+	if version == nil {
+		inBody = false
+	}
+	if ifMatch == "" {
+		if !inBody {
+			return common.PreconditionRequired("resource_version is required").
+				WithField("resource_version", "set resource_version in the body or the If-Match header")
+		}
+		return nil
+	}
+	headerVersion, err := strconv.ParseInt(ifMatch, 10, 64)
+	if err != nil {
+		return common.InvalidArgument("invalid If-Match %s", r.Header.Get("If-Match")).
+			WithField("If-Match", "must be the resource_version of the pod")
+	}
+	if inBody && fmt.Sprint(version) != strconv.FormatInt(headerVersion, 10) {
+		return common.InvalidArgument("If-Match %d does not match resource_version %v", headerVersion, version).
+			WithField("resource_version", "must match the If-Match header")
+	}
+	patch["resource_version"] = headerVersion
+	return nil
+}
+
+func (g *Gateway) deletePod(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.DeletePod(ctx, &pod.PodID{Id: id})
+}
+
+func (g *Gateway) restorePod(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.RestorePod(ctx, &pod.PodID{Id: id})
+}
+
+func (g *Gateway) getPodMetrics(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.GetPodMetrics(ctx, &pod.PodID{Id: id})
+}
+
+func (g *Gateway) listPodEvents(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	persist, err := queryBool(r.URL.Query(), "persist_warnings")
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.ListPodEvents(ctx, &pod.ListPodEventsRequest{Id: id, PersistWarnings: persist})
+}
+
+func (g *Gateway) getPodHistory(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(r.URL.Query(), "limit")
+	if err != nil {
+		return nil, err
+	}
+	request := &pod.GetPodHistoryRequest{Id: id, Limit: int32(limit)}
+	// types 可以重复传，也可以用逗号分隔
+	for _, value := range r.URL.Query()["types"] {
+		for _, historyType := range strings.Split(value, ",") {
+			if historyType != "" {
+				request.Types = append(request.Types, historyType)
+			}
+		}
+	}
+	return g.PodService.GetPodHistory(ctx, request)
+}
+
+func (g *Gateway) listDeletedPods(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	query := r.URL.Query()
+	return g.PodService.ListDeletedPods(ctx, &pod.ListDeletedPodsRequest{
+		PodNamespace: query.Get("pod_namespace"),
+		PodTeamId:    query.Get("pod_team_id"),
+	})
+}
+
+func (g *Gateway) getPodOperation(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	id, err := pathID(params)
+	if err != nil {
+		return nil, err
+	}
+	return g.PodService.GetPodOperation(ctx, &pod.OperationID{Id: id})
+}
+
+func (g *Gateway) reconcileStatus(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	return g.PodService.ReconcileStatus(ctx, &pod.ReconcileStatusRequest{})
+}
+
+func (g *Gateway) importPods(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	request := &pod.ImportPodsRequest{}
+	if err := decodeBody(r, request); err != nil {
+		return nil, err
+	}
+	return g.PodService.ImportPods(ctx, request)
+}
+
+func (g *Gateway) queryAudit(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	query := r.URL.Query()
+	request := &pod.QueryAuditRequest{PodTeamId: query.Get("pod_team_id")}
+	var err error
+	if request.PodId, err = queryInt(query, "pod_id"); err != nil {
+		return nil, err
+	}
+	if request.StartTime, err = queryInt(query, "start_time"); err != nil {
+		return nil, err
+	}
+	if request.EndTime, err = queryInt(query, "end_time"); err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(query, "limit")
+	if err != nil {
+		return nil, err
+	}
+	request.Limit = int32(limit)
+	return g.PodService.QueryAudit(ctx, request)
+}
+
+func (g *Gateway) exportPods(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	query := r.URL.Query()
+	request := &pod.ExportPodsRequest{
+		PodCluster:   query.Get("pod_cluster"),
+		PodNamespace: query.Get("pod_namespace"),
+		PodTeamId:    query.Get("pod_team_id"),
+		Format:       query.Get("format"),
+		ChartName:    query.Get("chart_name"),
+	}
+	var err error
+	if request.PodId, err = queryInt(query, "pod_id"); err != nil {
+		return nil, err
+	}
+	return g.PodService.ExportPods(ctx, request)
+}
+
+// applyManifest body 是 Deployment 的 yaml 或者 json 原文，其他参数放在 query 中
+func (g *Gateway) applyManifest(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, common.InvalidArgument("read body error %s", err.Error())
+	}
+	query := r.URL.Query()
+	request := &pod.ApplyManifestRequest{
+		Manifest:     string(data),
+		PodCluster:   query.Get("pod_cluster"),
+		PodNamespace: query.Get("pod_namespace"),
+		PodTeamId:    query.Get("pod_team_id"),
+	}
+	if request.AllowUnsupported, err = queryBool(query, "allow_unsupported"); err != nil {
+		return nil, err
+	}
+	return g.PodService.ApplyManifest(ctx, request)
+}
+
+func (g *Gateway) batchApply(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	request := &pod.BatchApplyRequest{}
+	if err := decodeBody(r, request); err != nil {
+		return nil, err
+	}
+	return g.PodService.BatchApply(ctx, request, timeoutOption(request.TimeoutSeconds))
+}
+
+func (g *Gateway) batchDelete(ctx context.Context, r *http.Request, params map[string]string) (interface{}, error) {
+	request := &pod.BatchDeleteRequest{}
+	if err := decodeBody(r, request); err != nil {
+		return nil, err
+	}
+	return g.PodService.BatchDelete(ctx, request, timeoutOption(request.TimeoutSeconds))
+}
+
+// watchPods 用 server-sent events 推送 pod 事件，直到调用方断开连接
+func (g *Gateway) watchPods(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming not supported"))
+		return
+	}
+	query := r.URL.Query()
+	stream, err := g.PodService.WatchPods(ctx, &pod.WatchPodsRequest{
+		PodNamespace: query.Get("pod_namespace"),
+		PodTeamId:    query.Get("pod_team_id"),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = stream.Close()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() == nil {
+				zap.S().Errorf("gateway watch pods error %s", err.Error())
+			}
+			return
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			zap.S().Errorf("gateway marshal pod event error %s", err.Error())
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type.String(), data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
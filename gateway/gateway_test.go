@@ -0,0 +1,255 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/DuanNengxin/wepass-pod/common"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/asim/go-micro/v3/client"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakePodService 只实现测试用到的方法，其他方法调用时 panic
+type fakePodService struct {
+	pod.PodService
+	pods    map[int64]*pod.PodInfo
+	updated *pod.PodInfo
+}
+
+func newFakePodService() *fakePodService {
+	return &fakePodService{pods: map[int64]*pod.PodInfo{
+		1: {
+			Id:              1,
+			PodCluster:      "default",
+			PodNamespace:    "wepass",
+			PodName:         "web",
+			PodImage:        "nginx:1.25",
+			PodReplicas:     2,
+			PodEnv:          []*pod.PodEnv{{EnvKey: "LOG_LEVEL", EnvValue: "debug"}},
+			PodLabel:        []*pod.PodLabel{{LabelKey: "env", LabelValue: "prod"}},
+			ResourceVersion: 3,
+		},
+	}}
+}
+
+// FindPodByID 和真正的 client 一样返回 go-micro 错误
+func (f *fakePodService) FindPodByID(ctx context.Context, in *pod.PodID, opts ...client.CallOption) (*pod.PodInfo, error) {
+	info, ok := f.pods[in.Id]
+	if !ok {
+		return nil, common.MicroError(common.NotFound("pod %d not found", in.Id))
+	}
+	return info, nil
+}
+
+func (f *fakePodService) UpdatePod(ctx context.Context, in *pod.PodInfo, opts ...client.CallOption) (*pod.Response, error) {
+	if current := f.pods[in.Id]; current.ResourceVersion != in.ResourceVersion {
+		return nil, common.MicroError(common.Conflict("pod %s changed", current.PodName).
+			WithMetadata("current_version", "3"))
+	}
+	f.updated = in
+	return &pod.Response{Msg: "ok", ResourceVersion: in.ResourceVersion + 1}, nil
+}
+
+// serve 发送请求并把返回的 json 解析到 value 中
+func serve(t *testing.T, handler http.Handler, request *http.Request, value interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if value != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), value); err != nil {
+			t.Fatalf("%s %s response %q is not json %s", request.Method, request.URL, recorder.Body.String(), err)
+		}
+	}
+	return recorder
+}
+
+func newTestGateway(t *testing.T, podService pod.PodService) http.Handler {
+	t.Helper()
+	handler, err := NewGateway(podService)
+	if err != nil {
+		t.Fatalf("NewGateway error %s", err)
+	}
+	return handler
+}
+
+// collectRefs 找出文档中所有的 $ref
+func collectRefs(value interface{}, refs *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if ref, ok := child.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+				continue
+			}
+			collectRefs(child, refs)
+		}
+	case []interface{}:
+		for _, child := range v {
+			collectRefs(child, refs)
+		}
+	}
+}
+
+func TestOpenAPIDocumentParses(t *testing.T) {
+	handler, err := NewGateway(nil)
+	if err != nil {
+		t.Fatalf("NewGateway error %s", err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json status %d", recorder.Code)
+	}
+	document := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil {
+		t.Fatalf("openapi.json is not valid json %s", err)
+	}
+	paths, _ := document["paths"].(map[string]interface{})
+	// 每个路由都要有文档，返回的状态码也要在文档中，watch 在 /v1/pods/watch 下
+	routes := map[string]bool{}
+	for _, rt := range handler.(*Gateway).routes {
+		path := "/" + strings.Join(rt.segments, "/")
+		routes[rt.method+" "+path] = true
+		operations, _ := paths[path].(map[string]interface{})
+		operation, ok := operations[strings.ToLower(rt.method)].(map[string]interface{})
+		if !ok {
+			t.Fatalf("route %s %s is not documented", rt.method, path)
+		}
+		responses, _ := operation["responses"].(map[string]interface{})
+		if _, ok := responses[strconv.Itoa(rt.status)]; !ok {
+			t.Fatalf("route %s %s status %d is not documented", rt.method, path, rt.status)
+		}
+	}
+	// 文档中的接口都要有路由，文档本身由 ServeHTTP 直接返回
+	for path, item := range paths {
+		if path == "/openapi.yaml" || path == "/openapi.json" {
+			continue
+		}
+		for method := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			if !routes[strings.ToUpper(method)+" "+path] {
+				t.Fatalf("documented %s %s has no route", strings.ToUpper(method), path)
+			}
+		}
+	}
+
+	var refs []string
+	collectRefs(document, &refs)
+	if len(refs) == 0 {
+		t.Fatal("openapi document has no $ref")
+	}
+	for _, ref := range refs {
+		var node interface{} = document
+		for _, segment := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			object, ok := node.(map[string]interface{})
+			if !ok {
+				node = nil
+				break
+			}
+			node = object[segment]
+		}
+		if node == nil {
+			t.Fatalf("unresolved $ref %s", ref)
+		}
+	}
+}
+
+func TestRoutesAndErrors(t *testing.T) {
+	handler := newTestGateway(t, newFakePodService())
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   common.ErrorCode
+	}{
+		{http.MethodGet, "/v1/pods/1", http.StatusOK, ""},
+		{http.MethodGet, "/v1/pods/2", http.StatusNotFound, common.CodeNotFound},
+		{http.MethodGet, "/v1/pods/abc", http.StatusBadRequest, common.CodeInvalidArgument},
+		{http.MethodGet, "/v1/unknown", http.StatusNotFound, common.CodeNotFound},
+		{http.MethodPut, "/v1/pods/1", http.StatusMethodNotAllowed, common.CodeMethodNotAllowed},
+	}
+	for _, test := range tests {
+		body := map[string]interface{}{}
+		recorder := serve(t, handler, httptest.NewRequest(test.method, test.path, nil), &body)
+		if recorder.Code != test.status {
+			t.Fatalf("%s %s status %d, want %d", test.method, test.path, recorder.Code, test.status)
+		}
+		if test.code != "" && body["code"] != string(test.code) {
+			t.Fatalf("%s %s code %v, want %s", test.method, test.path, body["code"], test.code)
+		}
+	}
+
+	recorder := serve(t, handler, httptest.NewRequest(http.MethodPut, "/v1/pods/1", nil), nil)
+	if allow := recorder.Header().Get("Allow"); allow != "GET, PATCH, DELETE" {
+		t.Fatalf("Allow %q, want GET, PATCH, DELETE", allow)
+	}
+	info := &pod.PodInfo{}
+	serve(t, handler, httptest.NewRequest(http.MethodGet, "/v1/pods/1", nil), info)
+	if info.PodName != "web" || info.ResourceVersion != 3 {
+		t.Fatalf("GET /v1/pods/1 returned %s version %d", info.PodName, info.ResourceVersion)
+	}
+}
+
+func TestUpdatePodMergesPatch(t *testing.T) {
+	podService := newFakePodService()
+	handler := newTestGateway(t, podService)
+	body := `{"pod_replicas": 5, "pod_env": null, "resource_version": 3}`
+	recorder := serve(t, handler, httptest.NewRequest(http.MethodPatch, "/v1/pods/1", strings.NewReader(body)), nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PATCH status %d body %s", recorder.Code, recorder.Body.String())
+	}
+	updated := podService.updated
+	if updated.Id != 1 || updated.PodReplicas != 5 || updated.PodEnv != nil || updated.PodImage != "nginx:1.25" {
+		t.Fatalf("merged pod %+v", updated)
+	}
+	if !reflect.DeepEqual(updated.PodLabel, podService.pods[1].PodLabel) {
+		t.Fatalf("labels %v, want the current labels", updated.PodLabel)
+	}
+}
+
+func TestUpdatePodRequiresVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		ifMatch string
+		status  int
+		code    common.ErrorCode
+	}{
+		{"missing", `{"pod_replicas": 5}`, "", http.StatusPreconditionRequired, common.CodePreconditionRequired},
+		{"null", `{"pod_replicas": 5, "resource_version": null}`, "", http.StatusPreconditionRequired, common.CodePreconditionRequired},
+		{"if-match", `{"pod_replicas": 5}`, `"3"`, http.StatusOK, ""},
+		{"stale if-match", `{"pod_replicas": 5}`, `"2"`, http.StatusConflict, common.CodeConflict},
+		{"invalid if-match", `{"pod_replicas": 5}`, `"abc"`, http.StatusBadRequest, common.CodeInvalidArgument},
+		{"mismatch", `{"pod_replicas": 5, "resource_version": 3}`, `"2"`, http.StatusBadRequest, common.CodeInvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podService := newFakePodService()
+			handler := newTestGateway(t, podService)
+			request := httptest.NewRequest(http.MethodPatch, "/v1/pods/1", strings.NewReader(test.body))
+			if test.ifMatch != "" {
+				request.Header.Set("If-Match", test.ifMatch)
+			}
+			body := map[string]interface{}{}
+			recorder := serve(t, handler, request, &body)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d, body %s", recorder.Code, test.status, recorder.Body.String())
+			}
+			if test.code != "" {
+				if body["code"] != string(test.code) {
+					t.Fatalf("code %v, want %s", body["code"], test.code)
+				}
+				if podService.updated != nil {
+					t.Fatal("UpdatePod called for a rejected patch")
+				}
+			}
+		})
+	}
+}
@@ -2,116 +2,554 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/DuanNengxin/wepass-pod/common"
 	"github.com/DuanNengxin/wepass-pod/domain/model"
 	"github.com/DuanNengxin/wepass-pod/domain/service"
 	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/DuanNengxin/wepass-pod/validation"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strconv"
+	"time"
 )
 
+// 没有指定 wait_timeout_seconds 时等待滚动更新的时间
+const defaultRolloutTimeout = 5 * time.Minute
+
 type PodHandler struct {
-	PodDataService service.IPodDataService
+	PodDataService      service.IPodDataService
+	PodWatchService     service.IPodWatchService
+	PodReconcileService service.IPodReconcileService
+	PodImportService    service.IPodImportService
+	PodMetricsService   service.IPodMetricsService
+	PodEventService     service.IPodEventService
+	AuditService        service.IAuditService
+	PodOperationService service.IPodOperationService
+	PodHistoryService   service.IPodHistoryService
+	PodExportService    service.IPodExportService
+	PodBatchService     service.IPodBatchService
 }
 
 func (p PodHandler) AddPod(ctx context.Context, info *pod.PodInfo, response *pod.Response) error {
+	info.PodCluster = model.ClusterOrDefault(info.PodCluster)
+	if err := validation.ToError(validation.ValidatePodInfo(info)); err != nil {
+		return common.MicroError(err)
+	}
 	podModel := &model.Pod{}
 	err := common.SwapTo(info, podModel)
 	if err != nil {
 		zap.S().Errorf("AddPod swap error %s", err.Error())
-		response.Msg = err.Error()
-		return err
+		return common.MicroError(common.Wrap(common.CodeInvalidArgument, err))
 	}
 
-	err = p.PodDataService.CreateToK8s(info)
-	if err != nil {
-		zap.S().Errorf("AddPod create to k8s error %s", err.Error())
-		response.Msg = err.Error()
-		return err
+	if _, err := p.PodDataService.FindPodByName(podModel.PodCluster, podModel.PodNamespace, podModel.PodName); err == nil {
+		return common.MicroError(&model.AlreadyExistsError{Kind: "pod", Cluster: podModel.PodCluster,
+			Namespace: podModel.PodNamespace, Name: podModel.PodName})
 	}
-	podID, err := p.PodDataService.AddPod(podModel)
+	if info.DryRun {
+		return p.dryRun(podModel, response)
+	}
+	operation, err := p.PodDataService.SubmitCreate(podModel)
 	if err != nil {
 		zap.S().Errorf("AddPod PodDataService error %s", err.Error())
-		response.Msg = err.Error()
-		return err
+		return common.MicroError(err)
+	}
+	info.Id = podModel.ID
+	response.ResourceVersion = podModel.Version
+	p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, nil, podModel)
+	zap.S().Infof("AddPod success pod id %d operation %d", podModel.ID, operation.ID)
+	return p.applyOperation(ctx, info, operation, response)
+}
+
+// dryRun 按 worker 应用时的方式生成 Deployment，只提交 server-side dry run，不写数据库也不记录历史
+func (p PodHandler) dryRun(podModel *model.Pod, response *pod.Response) error {
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(podModel, info); err != nil {
+		return common.MicroError(err)
+	}
+	manifests, err := p.PodDataService.DryRunToK8s(info)
+	if err != nil {
+		zap.S().Errorf("DryRun pod %s/%s error %s", info.PodNamespace, info.PodName, err.Error())
+		return common.MicroError(err)
 	}
-	zap.S().Infof("AddPod success pod id %d", podID)
+	response.Manifests = manifests
 	return nil
 }
 
+// applyOperation 默认只通知 worker 执行操作，设置了 wait 时等待操作执行完成，再等待滚动更新完成
+func (p PodHandler) applyOperation(ctx context.Context, info *pod.PodInfo, operation *model.PodOperation, response *pod.Response) error {
+	response.OperationId = operation.ID
+	action := fmt.Sprintf("%s deployment operation %d", operation.Type, operation.ID)
+	if !info.Wait {
+		p.PodOperationService.Notify()
+		service.RecordK8sOutcome(ctx, action+" "+model.OperationPending, nil)
+		return nil
+	}
+	operation, err := p.PodOperationService.WaitOperation(ctx, operation.ID, waitTimeout(info))
+	if err != nil {
+		zap.S().Errorf("wait operation %d error %s", response.OperationId, err.Error())
+		return common.MicroError(err)
+	}
+	if operation.Status != model.OperationSucceed {
+		err = fmt.Errorf("operation %d %s: %s", operation.ID, operation.Status, operation.LastError)
+		service.RecordK8sOutcome(ctx, action, err)
+		// 超时的时候操作还在重试，其他情况已经补偿或者失败
+		code := common.CodeInternal
+		if !operation.Finished() {
+			code = common.CodeUnavailable
+		}
+		return common.MicroError(common.Wrap(code, err).
+			WithMetadata("operation_id", strconv.FormatInt(operation.ID, 10)).
+			WithMetadata("operation_status", operation.Status))
+	}
+	service.RecordK8sOutcome(ctx, action, nil)
+	return p.waitForRollout(ctx, info, response)
+}
+
+func waitTimeout(info *pod.PodInfo) time.Duration {
+	if info.WaitTimeoutSeconds > 0 {
+		return time.Duration(info.WaitTimeoutSeconds) * time.Second
+	}
+	return defaultRolloutTimeout
+}
+
+// waitForRollout 设置了 wait 时阻塞到滚动更新完成，失败时返回 Unavailable
+// 返回错误时 go-micro 不返回 response，完整的滚动状态和 response 中的版本号、操作放在 metadata 中
+func (p PodHandler) waitForRollout(ctx context.Context, info *pod.PodInfo, response *pod.Response) error {
+	if !info.Wait {
+		return nil
+	}
+	status, err := p.PodDataService.WaitForRollout(ctx, info.PodNamespace, info.PodName, waitTimeout(info))
+	if err != nil {
+		zap.S().Errorf("wait rollout %s error %s", info.PodName, err.Error())
+		return common.MicroError(err)
+	}
+	response.Rollout = status
+	if !status.Completed {
+		zap.S().Errorf("rollout %s failed %s %s", info.PodName, status.Reason, status.Message)
+		return common.MicroError(rolloutError(info, status, response))
+	}
+	return nil
+}
+
+func rolloutError(info *pod.PodInfo, status *pod.RolloutStatus, response *pod.Response) *common.Error {
+	return common.Unavailable("rollout %s failed %s: %s", info.PodName, status.Reason, status.Message).
+		WithMetadata("rollout_completed", strconv.FormatBool(status.Completed)).
+		WithMetadata("rollout_reason", status.Reason).
+		WithMetadata("rollout_message", status.Message).
+		WithMetadata("rollout_replicas", strconv.FormatInt(int64(status.Replicas), 10)).
+		WithMetadata("rollout_updated_replicas", strconv.FormatInt(int64(status.UpdatedReplicas), 10)).
+		WithMetadata("rollout_ready_replicas", strconv.FormatInt(int64(status.ReadyReplicas), 10)).
+		WithMetadata("rollout_available_replicas", strconv.FormatInt(int64(status.AvailableReplicas), 10)).
+		WithMetadata("rollout_observed_generation", strconv.FormatInt(status.ObservedGeneration, 10)).
+		WithMetadata("operation_id", strconv.FormatInt(response.OperationId, 10)).
+		WithMetadata("resource_version", strconv.FormatInt(response.ResourceVersion, 10))
+}
+
 func (p PodHandler) DeletePod(ctx context.Context, id *pod.PodID, response *pod.Response) error {
 	podModel, err := p.PodDataService.FindPodByID(id.GetId())
 	if err != nil {
 		zap.S().Errorf("find pod %d error %s", id.GetId(), err.Error())
-		response.Msg = err.Error()
-		return err
-	}
-	if err := p.PodDataService.DeleteToK8s(podModel); err != nil {
-		zap.S().Errorf("delete pod %d %s error %s", id.GetId(), podModel.PodName, err.Error())
-		response.Msg = err.Error()
-		return err
+		return common.MicroError(err)
 	}
-	if err := p.PodDataService.DeletePod(id.GetId()); err != nil {
+	operation, err := p.PodDataService.SubmitDelete(podModel)
+	if err != nil {
 		zap.S().Errorf("db delete pod %d error %s", id.GetId(), err.Error())
-		response.Msg = err.Error()
+		return common.MicroError(err)
 	}
-	return nil
+	p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, podModel, nil)
+	return p.applyOperation(ctx, &pod.PodInfo{}, operation, response)
 }
 
 func (p PodHandler) FindPodByID(ctx context.Context, id *pod.PodID, info *pod.PodInfo) error {
 	podModel, err := p.PodDataService.FindPodByID(id.GetId())
 	if err != nil {
 		zap.S().Errorf("FindPodByID pod id %d error %s", id.GetId(), err.Error())
-		return err
+		return common.MicroError(err)
 	}
 	err = common.SwapTo(podModel, info)
 	if err != nil {
 		zap.S().Errorf("FindPodByID swap to error %s", err.Error())
-		return err
+		return common.MicroError(err)
+	}
+	return nil
+}
+
+func (p PodHandler) FindPodByName(ctx context.Context, request *pod.FindPodByNameRequest, info *pod.PodInfo) error {
+	podModel, err := p.PodDataService.FindPodByName(model.ClusterOrDefault(request.PodCluster), request.PodNamespace, request.PodName)
+	if err != nil {
+		zap.S().Errorf("FindPodByName pod %s/%s error %s", request.PodNamespace, request.PodName, err.Error())
+		return common.MicroError(err)
+	}
+	if err := common.SwapTo(podModel, info); err != nil {
+		zap.S().Errorf("FindPodByName swap to error %s", err.Error())
+		return common.MicroError(err)
 	}
 	return nil
 }
 
 func (p PodHandler) UpdatePod(ctx context.Context, info *pod.PodInfo, response *pod.Response) error {
-	err := p.PodDataService.UpdateToK8s(info)
+	if err := validation.ToError(validation.ValidatePodInfo(info)); err != nil {
+		return common.MicroError(err)
+	}
+	// 先检查版本号，避免用过期的数据覆盖集群中的 Deployment
+	current, err := p.PodDataService.FindPodByID(info.Id)
 	if err != nil {
-		zap.S().Errorf("UpdatePod create to k8s error %s", err.Error())
-		response.Msg = err.Error()
-		return err
+		zap.S().Errorf("UpdatePod find pod %d error %s", info.Id, err.Error())
+		return common.MicroError(err)
+	}
+	if current.Version != info.ResourceVersion {
+		return common.MicroError(&model.ConflictError{Kind: "pod", Name: current.PodName, CurrentVersion: strconv.FormatInt(current.Version, 10)})
+	}
+	if err := validation.ToError(validation.ValidatePodUpdate(info, current)); err != nil {
+		return common.MicroError(err)
 	}
 
+	info.PodCluster = model.ClusterOrDefault(info.PodCluster)
 	podModel := &model.Pod{}
 	err = common.SwapTo(info, podModel)
 	if err != nil {
 		zap.S().Errorf("UpdatePod swap error %s", err.Error())
-		response.Msg = err.Error()
-		return err
+		return common.MicroError(common.Wrap(common.CodeInvalidArgument, err))
+	}
+	if info.DryRun {
+		response.ResourceVersion = current.Version
+		return p.dryRun(podModel, response)
 	}
 
-	err = p.PodDataService.UpdatePod(podModel)
+	operation, err := p.PodDataService.SubmitUpdate(podModel, current)
 	if err != nil {
 		zap.S().Errorf("UpdatePod PodDataService error %s", err.Error())
-		response.Msg = err.Error()
-		return err
+		return common.MicroError(err)
 	}
-	zap.S().Infof("UpdatePod success pod id %d", info.Id)
-	return nil
+	response.ResourceVersion = podModel.Version
+	p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, current, podModel)
+	zap.S().Infof("UpdatePod success pod id %d operation %d", info.Id, operation.ID)
+	return p.applyOperation(ctx, info, operation, response)
 }
 
 func (p PodHandler) FindPodAll(ctx context.Context, all *pod.FindAll, infos *pod.PodInfos) error {
-	podModels, err := p.PodDataService.FindAll()
+	page, err := p.PodDataService.FindPage(&model.PodFilter{
+		PodCluster:    all.PodCluster,
+		PodNamespace:  all.PodNamespace,
+		PodTeamID:     all.PodTeamId,
+		NamePrefix:    all.NamePrefix,
+		Image:         all.Image,
+		LabelSelector: all.LabelSelector,
+		PageToken:     all.PageToken,
+		PageSize:      int(all.PageSize),
+		OrderBy:       all.OrderBy,
+	})
 	if err != nil {
-		zap.S().Errorf("FindPodByID pods error %s", err.Error())
-		return err
+		zap.S().Errorf("FindPodAll pods error %s", err.Error())
+		return common.MicroError(err)
 	}
+	infos.NextPageToken = page.NextPageToken
+	infos.TotalCount = page.TotalCount
 
-	for _, podModel := range podModels {
+	for _, podModel := range page.Pods {
 		podInfo := &pod.PodInfo{}
 		err := common.SwapTo(podModel, podInfo)
 		if err != nil {
 			zap.S().Errorf("FindPodAll swap error %s", err.Error())
-			return err
+			return common.MicroError(err)
+		}
+		infos.PodInfos = append(infos.PodInfos, podInfo)
+	}
+	return nil
+}
+
+func (p PodHandler) WatchPods(ctx context.Context, request *pod.WatchPodsRequest, stream pod.PodService_WatchPodsStream) error {
+	defer stream.Close()
+	events, cancel := p.PodWatchService.Subscribe(request.GetPodNamespace(), request.GetPodTeamId())
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(event); err != nil {
+				zap.S().Errorf("WatchPods send event error %s", err.Error())
+				return common.MicroError(err)
+			}
+		}
+	}
+}
+
+func (p PodHandler) ReconcileStatus(ctx context.Context, request *pod.ReconcileStatusRequest, report *pod.ReconcileReport) error {
+	return common.MicroError(common.SwapTo(p.PodReconcileService.Status(), report))
+}
+
+func (p PodHandler) ImportPods(ctx context.Context, request *pod.ImportPodsRequest, response *pod.ImportPodsResponse) error {
+	results, err := p.PodImportService.ImportPods(request)
+	if err != nil {
+		zap.S().Errorf("ImportPods namespace %s error %s", request.PodNamespace, err.Error())
+		return common.MicroError(err)
+	}
+	response.Results = results
+	return nil
+}
+
+func (p PodHandler) GetPodMetrics(ctx context.Context, id *pod.PodID, metrics *pod.PodMetrics) error {
+	podMetrics, err := p.PodMetricsService.GetPodMetrics(id.GetId())
+	if err != nil {
+		zap.S().Errorf("GetPodMetrics pod id %d error %s", id.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	return common.MicroError(common.SwapTo(podMetrics, metrics))
+}
+
+func (p PodHandler) ListPodEvents(ctx context.Context, request *pod.ListPodEventsRequest, events *pod.ClusterEvents) error {
+	podEvents, err := p.PodEventService.ListPodEvents(request.GetId(), request.GetPersistWarnings())
+	if err != nil {
+		zap.S().Errorf("ListPodEvents pod id %d error %s", request.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	events.Events = podEvents
+	return nil
+}
+
+func (p PodHandler) ListDeletedPods(ctx context.Context, request *pod.ListDeletedPodsRequest, infos *pod.PodInfos) error {
+	podModels, err := p.PodDataService.FindDeletedPods(request.GetPodNamespace(), request.GetPodTeamId())
+	if err != nil {
+		zap.S().Errorf("ListDeletedPods error %s", err.Error())
+		return common.MicroError(err)
+	}
+	for _, podModel := range podModels {
+		podInfo := &pod.PodInfo{}
+		if err := common.SwapTo(podModel, podInfo); err != nil {
+			zap.S().Errorf("ListDeletedPods swap error %s", err.Error())
+			return common.MicroError(err)
 		}
+		podInfo.DeletedAt = podModel.DeletedAt.Time.Unix()
 		infos.PodInfos = append(infos.PodInfos, podInfo)
 	}
+	infos.TotalCount = int64(len(infos.PodInfos))
+	return nil
+}
+
+// RestorePod 从回收站恢复 pod，按保存的配置重新创建 Deployment
+func (p PodHandler) RestorePod(ctx context.Context, id *pod.PodID, response *pod.Response) error {
+	podModel, err := p.PodDataService.FindDeletedPodByID(id.GetId())
+	if err != nil {
+		zap.S().Errorf("RestorePod find deleted pod %d error %s", id.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	if _, err := p.PodDataService.FindPodByName(podModel.PodCluster, podModel.PodNamespace, podModel.PodName); err == nil {
+		return common.MicroError(&model.AlreadyExistsError{Kind: "pod", Cluster: podModel.PodCluster,
+			Namespace: podModel.PodNamespace, Name: podModel.PodName})
+	}
+	operation, err := p.PodDataService.SubmitRestore(podModel)
+	if err != nil {
+		zap.S().Errorf("RestorePod db restore pod %d error %s", id.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, nil, podModel)
+	zap.S().Infof("RestorePod success pod id %d operation %d", id.GetId(), operation.ID)
+	return p.applyOperation(ctx, &pod.PodInfo{}, operation, response)
+}
+
+func (p PodHandler) QueryAudit(ctx context.Context, request *pod.QueryAuditRequest, logs *pod.AuditLogs) error {
+	filter := &model.AuditFilter{
+		PodTeamID: request.PodTeamId,
+		PodID:     request.PodId,
+		Limit:     int(request.Limit),
+	}
+	if request.StartTime > 0 {
+		filter.Start = time.Unix(request.StartTime, 0)
+	}
+	if request.EndTime > 0 {
+		filter.End = time.Unix(request.EndTime, 0)
+	}
+	auditLogs, err := p.AuditService.Query(filter)
+	if err != nil {
+		zap.S().Errorf("QueryAudit error %s", err.Error())
+		return common.MicroError(err)
+	}
+	for _, auditLog := range auditLogs {
+		logs.Logs = append(logs.Logs, &pod.AuditLog{
+			Id:           auditLog.ID,
+			Actor:        auditLog.Actor,
+			Rpc:          auditLog.RPC,
+			PodId:        auditLog.PodID,
+			PodName:      auditLog.PodName,
+			PodNamespace: auditLog.PodNamespace,
+			PodTeamId:    auditLog.PodTeamID,
+			Before:       auditLog.Before,
+			After:        auditLog.After,
+			Diff:         auditLog.Diff,
+			K8SOutcome:   auditLog.K8sOutcome,
+			Error:        auditLog.Error,
+			CreatedAt:    auditLog.CreatedAt.Unix(),
+		})
+	}
+	return nil
+}
+
+func (p PodHandler) GetPodOperation(ctx context.Context, id *pod.OperationID, response *pod.PodOperation) error {
+	operation, err := p.PodOperationService.FindOperation(id.GetId())
+	if err != nil {
+		zap.S().Errorf("GetPodOperation operation id %d error %s", id.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	response.Id = operation.ID
+	response.PodId = operation.PodID
+	response.Type = operation.Type
+	response.Status = operation.Status
+	response.Attempts = int32(operation.Attempts)
+	response.LastError = operation.LastError
+	response.NextRunAt = operation.NextRunAt.Unix()
+	response.CreatedAt = operation.CreatedAt.Unix()
+	response.UpdatedAt = operation.UpdatedAt.Unix()
+	return nil
+}
+
+func (p PodHandler) GetPodHistory(ctx context.Context, request *pod.GetPodHistoryRequest, history *pod.PodHistory) error {
+	// 已经删除的 pod 也可以查询历史
+	podModel, err := p.PodDataService.FindPodByID(request.GetId())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		podModel, err = p.PodDataService.FindDeletedPodByID(request.GetId())
+	}
+	if err != nil {
+		zap.S().Errorf("GetPodHistory find pod %d error %s", request.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	filter := &model.PodHistoryFilter{
+		PodID:        podModel.ID,
+		PodCluster:   podModel.PodCluster,
+		PodNamespace: podModel.PodNamespace,
+		PodName:      podModel.PodName,
+		// k8s 事件的时间只精确到秒
+		Since: podModel.CreatedAt.Truncate(time.Second),
+		Types: request.GetTypes(),
+		Limit: int(request.GetLimit()),
+	}
+	if podModel.DeletedAt.Valid {
+		filter.Until = podModel.DeletedAt.Time
+	}
+	histories, err := p.PodHistoryService.GetPodHistory(filter)
+	if err != nil {
+		zap.S().Errorf("GetPodHistory pod id %d error %s", request.GetId(), err.Error())
+		return common.MicroError(err)
+	}
+	for _, entry := range histories {
+		history.Entries = append(history.Entries, &pod.PodHistoryEntry{
+			Id:           entry.ID,
+			PodId:        entry.PodID,
+			PodNamespace: entry.PodNamespace,
+			PodName:      entry.PodName,
+			Type:         entry.Type,
+			Reason:       entry.Reason,
+			Message:      entry.Message,
+			Detail:       entry.Detail,
+			Timestamp:    entry.Timestamp.Unix(),
+		})
+	}
+	return nil
+}
+
+func (p PodHandler) ExportPods(ctx context.Context, request *pod.ExportPodsRequest, response *pod.ExportPodsResponse) error {
+	exported, err := p.PodExportService.ExportPods(request)
+	if err != nil {
+		zap.S().Errorf("ExportPods namespace %s team %s error %s", request.PodNamespace, request.PodTeamId, err.Error())
+		return common.MicroError(err)
+	}
+	response.Files = exported.Files
+	response.PodCount = exported.PodCount
+	return nil
+}
+
+// ApplyManifest 每个文档按 AddPod 的流程创建，结果按文档返回，所有文档提交后统一通知 worker
+func (p PodHandler) ApplyManifest(ctx context.Context, request *pod.ApplyManifestRequest, response *pod.ApplyManifestResponse) error {
+	documents, err := service.ParseManifest(request)
+	if err != nil {
+		zap.S().Errorf("ApplyManifest parse error %s", err.Error())
+		return common.MicroError(common.Wrap(common.CodeInvalidArgument, err).WithField("manifest", err.Error()))
+	}
+	if len(documents) == 0 {
+		return common.MicroError(common.InvalidArgument("manifest is empty").WithField("manifest", "at least one Deployment is required"))
+	}
+	submitted := false
+	for _, document := range documents {
+		result := p.applyDocument(document, request.AllowUnsupported)
+		submitted = submitted || result.Created
+		response.Results = append(response.Results, result)
+	}
+	if submitted {
+		p.PodOperationService.Notify()
+	}
+	return nil
+}
+
+func (p PodHandler) applyDocument(document *service.ManifestDocument, allowUnsupported bool) *pod.ManifestResult {
+	result := &pod.ManifestResult{Index: int32(document.Index), Unsupported: document.Unsupported}
+	if document.Pod != nil {
+		result.PodNamespace, result.PodName = document.Pod.PodNamespace, document.Pod.PodName
+	}
+	if document.Err != nil {
+		result.Error = document.Err.Error()
+		return result
+	}
+	if len(document.Unsupported) > 0 && !allowUnsupported {
+		result.Error = "deployment has unsupported fields"
+		return result
+	}
+	podModel := document.Pod
+	info := &pod.PodInfo{}
+	if err := common.SwapTo(podModel, info); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if errs := validation.ValidatePodInfo(info); len(errs) > 0 {
+		result.Error = errs.ToAggregate().Error()
+		return result
+	}
+	if existing, err := p.PodDataService.FindPodByName(podModel.PodCluster, podModel.PodNamespace, podModel.PodName); err == nil {
+		result.PodId = existing.ID
+		result.Error = "pod already exists"
+		return result
+	}
+	operation, err := p.PodDataService.SubmitCreate(podModel)
+	if err != nil {
+		zap.S().Errorf("ApplyManifest document %d error %s", document.Index, err.Error())
+		result.Error = err.Error()
+		return result
+	}
+	result.PodId = podModel.ID
+	result.OperationId = operation.ID
+	result.Created = true
+	p.PodHistoryService.RecordSpecChange(operation.Type, operation.ID, nil, podModel)
+	zap.S().Infof("ApplyManifest document %d pod id %d operation %d", document.Index, podModel.ID, operation.ID)
+	return result
+}
+
+func (p PodHandler) BatchApply(ctx context.Context, request *pod.BatchApplyRequest, response *pod.BatchResponse) error {
+	result, err := p.PodBatchService.BatchApply(ctx, request)
+	if err != nil {
+		zap.S().Errorf("BatchApply error %s", err.Error())
+		return common.MicroError(err)
+	}
+	zap.S().Infof("BatchApply %d pods succeeded %d failed %d rolled back %t", len(request.PodInfos),
+		result.Succeeded, result.Failed, result.RolledBack)
+	response.Results, response.Succeeded, response.Failed, response.RolledBack = result.Results, result.Succeeded,
+		result.Failed, result.RolledBack
+	return nil
+}
+
+func (p PodHandler) BatchDelete(ctx context.Context, request *pod.BatchDeleteRequest, response *pod.BatchResponse) error {
+	result, err := p.PodBatchService.BatchDelete(ctx, request)
+	if err != nil {
+		zap.S().Errorf("BatchDelete error %s", err.Error())
+		return common.MicroError(err)
+	}
+	zap.S().Infof("BatchDelete %d pods succeeded %d failed %d rolled back %t", len(request.Ids),
+		result.Succeeded, result.Failed, result.RolledBack)
+	response.Results, response.Succeeded, response.Failed, response.RolledBack = result.Results, result.Succeeded,
+		result.Failed, result.RolledBack
 	return nil
 }
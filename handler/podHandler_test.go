@@ -0,0 +1,1488 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	"github.com/DuanNengxin/wepass-pod/domain/service"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	microErrors "github.com/asim/go-micro/v3/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnv 用内存仓库和 fake clientset 组装 PodHandler，操作由测试同步执行
+type testEnv struct {
+	handler          PodHandler
+	repository       *repository.MemoryPodRepository
+	clientSet        *fake.Clientset
+	operationService service.IPodOperationService
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	podRepository := repository.NewMemoryPodRepository()
+	clientSet := fake.NewSimpleClientset()
+	dataService := service.NewPodDataService(podRepository, clientSet)
+	operationService := service.NewPodOperationService(podRepository, dataService, clientSet, service.NewPodHistoryService(nil, nil, nil), 1)
+	return &testEnv{
+		handler: PodHandler{
+			PodDataService:      dataService,
+			PodOperationService: operationService,
+			PodHistoryService:   service.NewPodHistoryService(nil, nil, nil),
+			PodImportService:    service.NewPodImportService(podRepository, podRepository, clientSet),
+			PodReconcileService: service.NewPodReconcileService(podRepository, podRepository, clientSet, service.NewPodHistoryService(nil, nil, nil)),
+			PodExportService:    service.NewPodExportService(podRepository),
+			PodBatchService:     service.NewPodBatchService(dataService, operationService, service.NewPodHistoryService(nil, nil, nil)),
+		},
+		repository:       podRepository,
+		clientSet:        clientSet,
+		operationService: operationService,
+	}
+}
+
+// execute 同步执行操作，代替后台的 worker
+func (e *testEnv) execute(t *testing.T, id int64, status string) *model.PodOperation {
+	t.Helper()
+	operation, err := e.operationService.Execute(id)
+	if err != nil {
+		t.Fatalf("execute operation %d error %s", id, err)
+	}
+	if operation.Status != status {
+		t.Fatalf("operation %d status %s, want %s, last error %s", id, operation.Status, status, operation.LastError)
+	}
+	return operation
+}
+
+func (e *testEnv) addPod(t *testing.T, info *pod.PodInfo) *pod.Response {
+	t.Helper()
+	response := &pod.Response{}
+	if err := e.handler.AddPod(context.TODO(), info, response); err != nil {
+		t.Fatalf("AddPod error %s", err)
+	}
+	e.execute(t, response.OperationId, model.OperationSucceed)
+	return response
+}
+
+func (e *testEnv) deployment(t *testing.T, namespace, name string) *appsv1.Deployment {
+	t.Helper()
+	deployment, err := e.clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment %s/%s error %s", namespace, name, err)
+	}
+	return deployment
+}
+
+// newTestPodInfo PodInfo 中每个字段都设置成非默认值
+func newTestPodInfo() *pod.PodInfo {
+	return &pod.PodInfo{
+		PodCluster:    "default",
+		PodNamespace:  "wepass",
+		PodName:       "web",
+		PodTeamId:     "team-a",
+		PodCpuMax:     1,
+		PodCpuMin:     0.5,
+		PodReplicas:   3,
+		PodMemoryMax:  268435456,
+		PodMemoryMin:  134217728,
+		PodPullPolicy: "IfNotPresent",
+		PodRestart:    "Always",
+		PodType:       "Recreate",
+		PodImage:      "nginx:1.25",
+		PodPort: []*pod.PodPort{
+			{ContainerPort: 80, Protocol: "TCP"},
+			{ContainerPort: 53, Protocol: "UDP"},
+		},
+		PodEnv: []*pod.PodEnv{
+			{EnvKey: "LOG_LEVEL", EnvValue: "debug"},
+			{EnvKey: "REGION", EnvValue: "cn-north"},
+		},
+		PodLabel: []*pod.PodLabel{
+			{LabelKey: "env", LabelValue: "prod"},
+		},
+	}
+}
+
+// assertDeployment 检查 Deployment 和 PodInfo 中的每个字段都一致
+func assertDeployment(t *testing.T, deployment *appsv1.Deployment, info *pod.PodInfo) {
+	t.Helper()
+	if deployment.Name != info.PodName || deployment.Namespace != info.PodNamespace {
+		t.Fatalf("deployment %s/%s, want %s/%s", deployment.Namespace, deployment.Name, info.PodNamespace, info.PodName)
+	}
+	wantLabels := map[string]string{
+		service.LabelAppName:   info.PodName,
+		service.LabelManagedBy: service.ManagedBy,
+		service.LabelTeam:      info.PodTeamId,
+	}
+	for _, label := range info.PodLabel {
+		wantLabels[label.LabelKey] = label.LabelValue
+	}
+	if !reflect.DeepEqual(deployment.Labels, wantLabels) {
+		t.Fatalf("deployment labels %v, want %v", deployment.Labels, wantLabels)
+	}
+	if !reflect.DeepEqual(deployment.Spec.Template.Labels, wantLabels) {
+		t.Fatalf("template labels %v, want %v", deployment.Spec.Template.Labels, wantLabels)
+	}
+	wantSelector := map[string]string{service.LabelAppName: info.PodName}
+	if !reflect.DeepEqual(deployment.Spec.Selector.MatchLabels, wantSelector) {
+		t.Fatalf("selector %v, want %v", deployment.Spec.Selector.MatchLabels, wantSelector)
+	}
+	if deployment.Spec.Replicas == nil || *deployment.Spec.Replicas != info.PodReplicas {
+		t.Fatalf("replicas %v, want %d", deployment.Spec.Replicas, info.PodReplicas)
+	}
+	wantStrategy := appsv1.RollingUpdateDeploymentStrategyType
+	if info.PodType == "Recreate" {
+		wantStrategy = appsv1.RecreateDeploymentStrategyType
+	}
+	if deployment.Spec.Strategy.Type != wantStrategy {
+		t.Fatalf("strategy %s, want %s", deployment.Spec.Strategy.Type, wantStrategy)
+	}
+
+	podSpec := deployment.Spec.Template.Spec
+	if podSpec.RestartPolicy != corev1.RestartPolicy(info.PodRestart) {
+		t.Fatalf("restart policy %s, want %s", podSpec.RestartPolicy, info.PodRestart)
+	}
+	if len(podSpec.Containers) != 1 {
+		t.Fatalf("%d containers, want 1", len(podSpec.Containers))
+	}
+	container := podSpec.Containers[0]
+	if container.Name != info.PodName || container.Image != info.PodImage {
+		t.Fatalf("container %s image %s, want %s image %s", container.Name, container.Image, info.PodName, info.PodImage)
+	}
+	if container.ImagePullPolicy != corev1.PullPolicy(info.PodPullPolicy) {
+		t.Fatalf("image pull policy %s, want %s", container.ImagePullPolicy, info.PodPullPolicy)
+	}
+
+	var wantPorts []corev1.ContainerPort
+	for _, port := range info.PodPort {
+		wantPorts = append(wantPorts, corev1.ContainerPort{
+			Name:          "port-" + strconv.Itoa(int(port.ContainerPort)),
+			ContainerPort: port.ContainerPort,
+			Protocol:      corev1.Protocol(port.Protocol),
+		})
+	}
+	if !reflect.DeepEqual(container.Ports, wantPorts) {
+		t.Fatalf("ports %v, want %v", container.Ports, wantPorts)
+	}
+	var wantEnv []corev1.EnvVar
+	for _, env := range info.PodEnv {
+		wantEnv = append(wantEnv, corev1.EnvVar{Name: env.EnvKey, Value: env.EnvValue})
+	}
+	if !reflect.DeepEqual(container.Env, wantEnv) {
+		t.Fatalf("env %v, want %v", container.Env, wantEnv)
+	}
+
+	assertQuantity(t, "cpu limit", container.Resources.Limits[corev1.ResourceCPU], float64(info.PodCpuMax))
+	assertQuantity(t, "cpu request", container.Resources.Requests[corev1.ResourceCPU], float64(info.PodCpuMin))
+	assertQuantity(t, "memory limit", container.Resources.Limits[corev1.ResourceMemory], float64(info.PodMemoryMax))
+	assertQuantity(t, "memory request", container.Resources.Requests[corev1.ResourceMemory], float64(info.PodMemoryMin))
+}
+
+func assertQuantity(t *testing.T, name string, quantity resource.Quantity, want float64) {
+	t.Helper()
+	if got := quantity.AsApproximateFloat64(); got != want {
+		t.Fatalf("%s %v, want %v", name, got, want)
+	}
+}
+
+// assertError 检查返回的 go-micro 错误的状态码和 detail 中的错误码
+func assertError(t *testing.T, err error, status int32, code common.ErrorCode) *common.Error {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected %s error", code)
+	}
+	if got := microErrors.FromError(err).Code; got != status {
+		t.Fatalf("status %d, want %d: %s", got, status, err)
+	}
+	typed := common.ParseMicroError(err)
+	if typed.Code != code {
+		t.Fatalf("error code %s, want %s: %s", typed.Code, code, err)
+	}
+	return typed
+}
+
+func TestAddPodCreatesDeployment(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	response := env.addPod(t, info)
+	if info.Id == 0 || response.ResourceVersion != 1 || response.OperationId == 0 {
+		t.Fatalf("unexpected response id %d version %d operation %d", info.Id, response.ResourceVersion, response.OperationId)
+	}
+	assertDeployment(t, env.deployment(t, info.PodNamespace, info.PodName), info)
+
+	found := &pod.PodInfo{}
+	if err := env.handler.FindPodByID(context.TODO(), &pod.PodID{Id: info.Id}, found); err != nil {
+		t.Fatalf("FindPodByID error %s", err)
+	}
+	if found.PodCluster != model.DefaultCluster || found.ResourceVersion != 1 || len(found.PodPort) != 2 ||
+		len(found.PodEnv) != 2 || len(found.PodLabel) != 1 {
+		t.Fatalf("unexpected pod %+v", found)
+	}
+}
+
+func TestWaitForRolloutReturnsStatusInMetadata(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	response := env.addPod(t, info)
+	deployment := env.deployment(t, info.PodNamespace, info.PodName)
+	deployment.Status = appsv1.DeploymentStatus{
+		ObservedGeneration: deployment.Generation,
+		Replicas:           3,
+		UpdatedReplicas:    3,
+		ReadyReplicas:      1,
+		AvailableReplicas:  1,
+		Conditions: []appsv1.DeploymentCondition{{
+			Type:    appsv1.DeploymentProgressing,
+			Status:  corev1.ConditionFalse,
+			Reason:  "ProgressDeadlineExceeded",
+			Message: "web has timed out progressing",
+		}},
+	}
+	if _, err := env.clientSet.AppsV1().Deployments(info.PodNamespace).UpdateStatus(context.TODO(), deployment, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update deployment status error %s", err)
+	}
+
+	info.Wait = true
+	err := env.handler.waitForRollout(context.TODO(), info, response)
+	typed := assertError(t, err, http.StatusServiceUnavailable, common.CodeUnavailable)
+	want := map[string]string{
+		"rollout_completed":           "false",
+		"rollout_reason":              "ProgressDeadlineExceeded",
+		"rollout_message":             "web has timed out progressing",
+		"rollout_replicas":            "3",
+		"rollout_updated_replicas":    "3",
+		"rollout_ready_replicas":      "1",
+		"rollout_available_replicas":  "1",
+		"rollout_observed_generation": strconv.FormatInt(deployment.Generation, 10),
+		"operation_id":                strconv.FormatInt(response.OperationId, 10),
+		"resource_version":            "1",
+	}
+	if !reflect.DeepEqual(typed.Metadata, want) {
+		t.Fatalf("metadata %v, want %v", typed.Metadata, want)
+	}
+}
+
+func TestAddPodDefaultsPolicies(t *testing.T) {
+	env := newTestEnv(t)
+	info := &pod.PodInfo{PodNamespace: "wepass", PodName: "worker", PodImage: "busybox", PodReplicas: 1}
+	env.addPod(t, info)
+
+	deployment := env.deployment(t, "wepass", "worker")
+	if deployment.Spec.Strategy.Type != appsv1.RollingUpdateDeploymentStrategyType {
+		t.Fatalf("strategy %s, want RollingUpdate", deployment.Spec.Strategy.Type)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if container.ImagePullPolicy != corev1.PullAlways || deployment.Spec.Template.Spec.RestartPolicy != corev1.RestartPolicyAlways {
+		t.Fatalf("pull policy %s restart policy %s, want Always", container.ImagePullPolicy, deployment.Spec.Template.Spec.RestartPolicy)
+	}
+	if len(container.Ports) != 0 || len(container.Env) != 0 {
+		t.Fatalf("unexpected ports %v env %v", container.Ports, container.Env)
+	}
+}
+
+func TestAddPodDuplicateName(t *testing.T) {
+	env := newTestEnv(t)
+	env.addPod(t, newTestPodInfo())
+
+	err := env.handler.AddPod(context.TODO(), newTestPodInfo(), &pod.Response{})
+	assertError(t, err, http.StatusConflict, common.CodeAlreadyExists)
+
+	// 不同命名空间下可以同名
+	other := newTestPodInfo()
+	other.PodNamespace = "other"
+	env.addPod(t, other)
+	env.deployment(t, "other", other.PodName)
+	// 只有一个 clientset，其他集群的同名 pod 会覆盖这个集群的 Deployment
+	otherCluster := newTestPodInfo()
+	otherCluster.PodCluster = "backup"
+	err = env.handler.AddPod(context.TODO(), otherCluster, &pod.Response{})
+	typed := assertError(t, err, http.StatusBadRequest, common.CodeInvalidArgument)
+	if len(typed.Fields) != 1 || typed.Fields[0].Field != "pod_cluster" {
+		t.Fatalf("fields %v, want pod_cluster", typed.Fields)
+	}
+}
+
+func TestUpdatePodUpdatesDeployment(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	response := env.addPod(t, info)
+
+	info.ResourceVersion = response.ResourceVersion
+	info.PodTeamId = "team-b"
+	info.PodCpuMax, info.PodCpuMin = 2, 1
+	info.PodReplicas = 5
+	info.PodMemoryMax, info.PodMemoryMin = 536870912, 268435456
+	info.PodPullPolicy = "Never"
+	info.PodType = "Rolling"
+	info.PodImage = "nginx:1.26"
+	info.PodPort = []*pod.PodPort{{ContainerPort: 8080, Protocol: "SCTP"}}
+	info.PodEnv = []*pod.PodEnv{{EnvKey: "REGION", EnvValue: "cn-south"}}
+	info.PodLabel = []*pod.PodLabel{{LabelKey: "tier", LabelValue: "web"}}
+	updated := &pod.Response{}
+	if err := env.handler.UpdatePod(context.TODO(), info, updated); err != nil {
+		t.Fatalf("UpdatePod error %s", err)
+	}
+	if updated.ResourceVersion != 2 {
+		t.Fatalf("resource version %d, want 2", updated.ResourceVersion)
+	}
+	env.execute(t, updated.OperationId, model.OperationSucceed)
+
+	deployment := env.deployment(t, info.PodNamespace, info.PodName)
+	assertDeployment(t, deployment, info)
+	if _, ok := deployment.Labels["env"]; ok {
+		t.Fatalf("removed label env still on deployment %v", deployment.Labels)
+	}
+}
+
+func TestUpdatePodStaleVersion(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	env.addPod(t, info)
+
+	info.ResourceVersion = 1
+	info.PodImage = "nginx:1.26"
+	first := &pod.Response{}
+	if err := env.handler.UpdatePod(context.TODO(), info, first); err != nil {
+		t.Fatalf("UpdatePod error %s", err)
+	}
+	env.execute(t, first.OperationId, model.OperationSucceed)
+
+	info.PodImage = "nginx:1.27"
+	stale := &pod.Response{}
+	conflict := assertError(t, env.handler.UpdatePod(context.TODO(), info, stale), http.StatusConflict, common.CodeConflict)
+	if conflict.Metadata["current_version"] != "2" {
+		t.Fatalf("conflict current version %s, want 2", conflict.Metadata["current_version"])
+	}
+	if image := env.deployment(t, info.PodNamespace, info.PodName).Spec.Template.Spec.Containers[0].Image; image != "nginx:1.26" {
+		t.Fatalf("image %s, want nginx:1.26", image)
+	}
+}
+
+func TestDeleteAndRestorePod(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	env.addPod(t, info)
+
+	deleted := &pod.Response{}
+	if err := env.handler.DeletePod(context.TODO(), &pod.PodID{Id: info.Id}, deleted); err != nil {
+		t.Fatalf("DeletePod error %s", err)
+	}
+	env.execute(t, deleted.OperationId, model.OperationSucceed)
+	_, err := env.clientSet.AppsV1().Deployments(info.PodNamespace).Get(context.TODO(), info.PodName, metav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		t.Fatalf("deployment should be deleted, got error %v", err)
+	}
+	trash := &pod.PodInfos{}
+	if err := env.handler.ListDeletedPods(context.TODO(), &pod.ListDeletedPodsRequest{}, trash); err != nil {
+		t.Fatalf("ListDeletedPods error %s", err)
+	}
+	if len(trash.PodInfos) != 1 || trash.PodInfos[0].Id != info.Id {
+		t.Fatalf("unexpected deleted pods %v", trash.PodInfos)
+	}
+
+	restored := &pod.Response{}
+	if err := env.handler.RestorePod(context.TODO(), &pod.PodID{Id: info.Id}, restored); err != nil {
+		t.Fatalf("RestorePod error %s", err)
+	}
+	env.execute(t, restored.OperationId, model.OperationSucceed)
+	assertDeployment(t, env.deployment(t, info.PodNamespace, info.PodName), info)
+}
+
+func TestAddPodCompensatesWhenK8sRejects(t *testing.T) {
+	env := newTestEnv(t)
+	reject := true
+	env.clientSet.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return reject, nil, k8serrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "web",
+			field.ErrorList{field.Invalid(field.NewPath("spec", "replicas"), 3, "rejected")})
+	})
+	info := newTestPodInfo()
+	response := &pod.Response{}
+	if err := env.handler.AddPod(context.TODO(), info, response); err != nil {
+		t.Fatalf("AddPod error %s", err)
+	}
+	env.execute(t, response.OperationId, model.OperationCompensated)
+
+	assertError(t, env.handler.FindPodByID(context.TODO(), &pod.PodID{Id: info.Id}, &pod.PodInfo{}),
+		http.StatusNotFound, common.CodeNotFound)
+	if _, err := env.repository.FindDeletedPodByID(info.Id); err != nil {
+		t.Fatalf("compensated pod should be in trash, error %s", err)
+	}
+	// 补偿之后名称可以重新使用
+	reject = false
+	env.addPod(t, newTestPodInfo())
+}
+
+// dryRunReactor fake clientset 不支持 dry run，直接返回提交的对象，不保存
+func dryRunReactor(action k8stesting.Action) (bool, runtime.Object, error) {
+	return true, action.(interface{ GetObject() runtime.Object }).GetObject(), nil
+}
+
+func TestAddPodDryRun(t *testing.T) {
+	env := newTestEnv(t)
+	env.clientSet.PrependReactor("create", "deployments", dryRunReactor)
+	info := newTestPodInfo()
+	info.DryRun = true
+	response := &pod.Response{}
+	if err := env.handler.AddPod(context.TODO(), info, response); err != nil {
+		t.Fatalf("AddPod error %s", err)
+	}
+	if response.OperationId != 0 || len(response.Manifests) != 1 {
+		t.Fatalf("unexpected dry run response %v", response)
+	}
+	manifest := response.Manifests[0]
+	if manifest.Kind != "Deployment" || manifest.Action != service.ManifestCreate {
+		t.Fatalf("manifest %s %s, want Deployment create", manifest.Kind, manifest.Action)
+	}
+	for _, want := range []string{"apiVersion: apps/v1", "kind: Deployment", "image: nginx:1.25"} {
+		if !strings.Contains(manifest.Yaml, want) {
+			t.Fatalf("manifest yaml missing %q:\n%s", want, manifest.Yaml)
+		}
+	}
+	if !strings.Contains(manifest.Diff, "+  replicas: 3") {
+		t.Fatalf("unexpected diff:\n%s", manifest.Diff)
+	}
+	if _, err := env.repository.FindPodByName(info.PodCluster, info.PodNamespace, info.PodName); err == nil {
+		t.Fatalf("dry run should not write the pod")
+	}
+	if _, err := env.clientSet.AppsV1().Deployments(info.PodNamespace).Get(context.TODO(), info.PodName, metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("dry run should not create the deployment, got error %v", err)
+	}
+}
+
+func TestAddPodDryRunRefusesUnmanagedDeployment(t *testing.T) {
+	env := newTestEnv(t)
+	unmanaged := newImportDeployment("web")
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Create(context.TODO(), unmanaged, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create deployment error %s", err)
+	}
+	info := newTestPodInfo()
+	info.DryRun = true
+	dryRunErr := assertError(t, env.handler.AddPod(context.TODO(), info, &pod.Response{}), http.StatusConflict, common.CodeAlreadyExists)
+
+	// worker 执行同样的创建时返回同样的错误
+	info.DryRun = false
+	response := &pod.Response{}
+	if err := env.handler.AddPod(context.TODO(), info, response); err != nil {
+		t.Fatalf("AddPod error %s", err)
+	}
+	operation := env.execute(t, response.OperationId, model.OperationCompensated)
+	if operation.LastError != dryRunErr.Message {
+		t.Fatalf("worker error %q, want the dry run error %q", operation.LastError, dryRunErr.Message)
+	}
+}
+
+func TestUpdatePodDryRun(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	env.addPod(t, info)
+	env.clientSet.PrependReactor("update", "deployments", dryRunReactor)
+
+	info.ResourceVersion = 1
+	info.DryRun = true
+	unchanged := &pod.Response{}
+	if err := env.handler.UpdatePod(context.TODO(), info, unchanged); err != nil {
+		t.Fatalf("UpdatePod error %s", err)
+	}
+	if manifest := unchanged.Manifests[0]; manifest.Action != service.ManifestUnchanged || manifest.Diff != "" {
+		t.Fatalf("manifest %s, want unchanged, diff:\n%s", manifest.Action, manifest.Diff)
+	}
+
+	info.PodImage = "nginx:1.26"
+	changed := &pod.Response{}
+	if err := env.handler.UpdatePod(context.TODO(), info, changed); err != nil {
+		t.Fatalf("UpdatePod error %s", err)
+	}
+	manifest := changed.Manifests[0]
+	if manifest.Action != service.ManifestUpdate || changed.ResourceVersion != 1 {
+		t.Fatalf("manifest %s version %d, want update version 1", manifest.Action, changed.ResourceVersion)
+	}
+	if !strings.Contains(manifest.Diff, "-        image: nginx:1.25") || !strings.Contains(manifest.Diff, "+        image: nginx:1.26") {
+		t.Fatalf("unexpected diff:\n%s", manifest.Diff)
+	}
+	current, err := env.repository.FindPodByID(info.Id)
+	if err != nil || current.Version != 1 || current.PodImage != "nginx:1.25" {
+		t.Fatalf("dry run should not update the pod %v error %v", current, err)
+	}
+	if image := env.deployment(t, info.PodNamespace, info.PodName).Spec.Template.Spec.Containers[0].Image; image != "nginx:1.25" {
+		t.Fatalf("image %s, want nginx:1.25", image)
+	}
+}
+
+func TestExportPods(t *testing.T) {
+	env := newTestEnv(t)
+	web := newTestPodInfo()
+	env.addPod(t, web)
+	api := newTestPodInfo()
+	api.PodName = "api"
+	env.addPod(t, api)
+	other := newTestPodInfo()
+	other.PodNamespace = "other"
+	env.addPod(t, other)
+
+	plain := &pod.ExportPodsResponse{}
+	if err := env.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{PodNamespace: "wepass"}, plain); err != nil {
+		t.Fatalf("ExportPods error %s", err)
+	}
+	if plain.PodCount != 2 || len(plain.Files) != 1 || strings.Count(plain.Files[0].Content, "kind: Deployment") != 2 {
+		t.Fatalf("unexpected yaml export %d pods:\n%v", plain.PodCount, plain.Files)
+	}
+	// 导出的 Deployment 和 worker 创建的一致
+	documents := strings.Split(plain.Files[0].Content, "---\n")
+	for i, info := range []*pod.PodInfo{api, web} {
+		deployment := &appsv1.Deployment{}
+		if err := yaml.Unmarshal([]byte(documents[i]), deployment); err != nil {
+			t.Fatalf("unmarshal document %d error %s", i, err)
+		}
+		assertDeployment(t, deployment, info)
+	}
+
+	kustomize := &pod.ExportPodsResponse{}
+	if err := env.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{PodTeamId: "team-a", Format: "kustomize"}, kustomize); err != nil {
+		t.Fatalf("ExportPods error %s", err)
+	}
+	if len(kustomize.Files) != 4 || kustomize.Files[0].Path != "kustomization.yaml" ||
+		!strings.Contains(kustomize.Files[0].Content, "- other-web.yaml") {
+		t.Fatalf("unexpected kustomize export %v", kustomize.Files)
+	}
+
+	helm := &pod.ExportPodsResponse{}
+	if err := env.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{PodId: web.Id, Format: "helm"}, helm); err != nil {
+		t.Fatalf("ExportPods error %s", err)
+	}
+	if len(helm.Files) != 3 || !strings.Contains(helm.Files[0].Content, "name: web") ||
+		!strings.Contains(helm.Files[1].Content, "image: nginx:1.25") || !strings.Contains(helm.Files[1].Content, `memory: "268435456"`) {
+		t.Fatalf("unexpected helm export %v", helm.Files)
+	}
+
+	assertError(t, env.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{}, &pod.ExportPodsResponse{}),
+		http.StatusBadRequest, common.CodeInvalidArgument)
+	assertError(t, env.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{PodNamespace: "wepass", Format: "zip"}, &pod.ExportPodsResponse{}),
+		http.StatusBadRequest, common.CodeInvalidArgument)
+	assertError(t, env.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{PodNamespace: "missing"}, &pod.ExportPodsResponse{}),
+		http.StatusNotFound, common.CodeNotFound)
+}
+
+func TestApplyManifestRoundTripsExport(t *testing.T) {
+	source := newTestEnv(t)
+	info := newTestPodInfo()
+	source.addPod(t, info)
+	exported := &pod.ExportPodsResponse{}
+	if err := source.handler.ExportPods(context.TODO(), &pod.ExportPodsRequest{PodId: info.Id}, exported); err != nil {
+		t.Fatalf("ExportPods error %s", err)
+	}
+	manifest := exported.Files[0].Content + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: with-volume
+spec:
+  selector:
+    matchLabels:
+      app-name: with-volume
+  template:
+    spec:
+      volumes:
+        - name: data
+          emptyDir: {}
+      containers:
+        - name: with-volume
+          image: nginx:1.25
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: typo
+spec:
+  replica: 2
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`
+
+	env := newTestEnv(t)
+	response := &pod.ApplyManifestResponse{}
+	request := &pod.ApplyManifestRequest{Manifest: manifest, PodNamespace: "wepass", PodTeamId: "team-b"}
+	if err := env.handler.ApplyManifest(context.TODO(), request, response); err != nil {
+		t.Fatalf("ApplyManifest error %s", err)
+	}
+	if len(response.Results) != 4 {
+		t.Fatalf("results %v, want 4", response.Results)
+	}
+	created := response.Results[0]
+	if !created.Created || created.Error != "" || len(created.Unsupported) != 0 {
+		t.Fatalf("unexpected result %v", created)
+	}
+	env.execute(t, created.OperationId, model.OperationSucceed)
+	assertDeployment(t, env.deployment(t, info.PodNamespace, info.PodName), info)
+
+	if volume := response.Results[1]; volume.Created || len(volume.Unsupported) != 1 ||
+		volume.Unsupported[0] != "spec.template.spec.volumes" || volume.PodNamespace != "wepass" {
+		t.Fatalf("unexpected result %v", volume)
+	}
+	if typo := response.Results[2]; typo.Created || !strings.Contains(typo.Error, "replica") {
+		t.Fatalf("unexpected result %v", typo)
+	}
+	if other := response.Results[3]; other.Created || !strings.Contains(other.Error, "Service") {
+		t.Fatalf("unexpected result %v", other)
+	}
+
+	// 再次提交时已经存在的 pod 不会重复创建，允许丢弃字段后创建 with-volume
+	request.AllowUnsupported = true
+	again := &pod.ApplyManifestResponse{}
+	if err := env.handler.ApplyManifest(context.TODO(), request, again); err != nil {
+		t.Fatalf("ApplyManifest error %s", err)
+	}
+	if existing := again.Results[0]; existing.Created || existing.PodId != created.PodId {
+		t.Fatalf("unexpected result %v", existing)
+	}
+	volume := again.Results[1]
+	if !volume.Created {
+		t.Fatalf("unexpected result %v", volume)
+	}
+	env.execute(t, volume.OperationId, model.OperationSucceed)
+	podModel, err := env.repository.FindPodByID(volume.PodId)
+	if err != nil || podModel.PodTeamID != "team-b" {
+		t.Fatalf("unexpected pod %v error %v", podModel, err)
+	}
+
+	assertError(t, env.handler.ApplyManifest(context.TODO(), &pod.ApplyManifestRequest{Manifest: "---\n"}, &pod.ApplyManifestResponse{}),
+		http.StatusBadRequest, common.CodeInvalidArgument)
+}
+
+// rejectDeployment k8s 拒绝指定名称的 Deployment
+func (e *testEnv) rejectDeployment(verb, name string) {
+	e.clientSet.PrependReactor(verb, "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if object, ok := action.(interface{ GetObject() runtime.Object }); ok && object.GetObject().(*appsv1.Deployment).Name != name {
+			return false, nil, nil
+		}
+		if deleteAction, ok := action.(k8stesting.DeleteAction); ok && deleteAction.GetName() != name {
+			return false, nil, nil
+		}
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, name,
+			errors.New("rejected"))
+	})
+}
+
+// newBatchItems 创建 api，把 web 的镜像改成 nginx:1.26，创建会被拒绝的 bad
+func newBatchItems(web *pod.PodInfo) []*pod.PodInfo {
+	api := newTestPodInfo()
+	api.PodName = "api"
+	update := newTestPodInfo()
+	update.Id, update.ResourceVersion, update.PodImage = web.Id, 1, "nginx:1.26"
+	bad := newTestPodInfo()
+	bad.PodName = "bad"
+	return []*pod.PodInfo{api, update, bad}
+}
+
+func assertBatchStatus(t *testing.T, response *pod.BatchResponse, statuses ...string) {
+	t.Helper()
+	if len(response.Results) != len(statuses) {
+		t.Fatalf("results %v, want %d", response.Results, len(statuses))
+	}
+	for i, status := range statuses {
+		if response.Results[i].Status != status {
+			t.Fatalf("result %d %v, want status %s", i, response.Results[i], status)
+		}
+	}
+}
+
+// recordingHistoryService 记录结束的操作
+type recordingHistoryService struct {
+	service.IPodHistoryService
+	operations []*model.PodOperation
+}
+
+func (r *recordingHistoryService) RecordOperation(operation *model.PodOperation) {
+	r.operations = append(r.operations, operation)
+}
+
+func TestExecuteRecordsOperationOutcome(t *testing.T) {
+	env := newTestEnv(t)
+	env.rejectDeployment("create", "bad")
+	history := &recordingHistoryService{IPodHistoryService: service.NewPodHistoryService(nil, nil, nil)}
+	operationService := service.NewPodOperationService(env.repository, env.handler.PodDataService, env.clientSet, history, 1)
+
+	for _, name := range []string{"web", "bad"} {
+		info := newTestPodInfo()
+		info.PodName = name
+		response := &pod.Response{}
+		if err := env.handler.AddPod(context.TODO(), info, response); err != nil {
+			t.Fatalf("AddPod error %s", err)
+		}
+		if _, err := operationService.Execute(response.OperationId); err != nil {
+			t.Fatalf("execute operation error %s", err)
+		}
+	}
+	if len(history.operations) != 2 || history.operations[0].Status != model.OperationSucceed ||
+		history.operations[1].Status != model.OperationCompensated || history.operations[1].LastError == "" {
+		t.Fatalf("recorded operations %+v, want succeeded and compensated", history.operations)
+	}
+}
+
+func TestBatchApplyPartialFailure(t *testing.T) {
+	env := newTestEnv(t)
+	web := newTestPodInfo()
+	env.addPod(t, web)
+	env.rejectDeployment("create", "bad")
+
+	response := &pod.BatchResponse{}
+	request := &pod.BatchApplyRequest{PodInfos: newBatchItems(web), Concurrency: 2}
+	if err := env.handler.BatchApply(context.TODO(), request, response); err != nil {
+		t.Fatalf("BatchApply error %s", err)
+	}
+	assertBatchStatus(t, response, service.BatchSucceeded, service.BatchSucceeded, service.BatchFailed)
+	if response.Succeeded != 2 || response.Failed != 1 || response.RolledBack {
+		t.Fatalf("unexpected summary %v", response)
+	}
+	env.deployment(t, "wepass", "api")
+	if image := env.deployment(t, "wepass", "web").Spec.Template.Spec.Containers[0].Image; image != "nginx:1.26" {
+		t.Fatalf("image %s, want nginx:1.26", image)
+	}
+	if response.Results[1].ResourceVersion != 2 {
+		t.Fatalf("resource version %d, want 2", response.Results[1].ResourceVersion)
+	}
+	// 被拒绝的项已经补偿
+	if _, err := env.repository.FindPodByName("default", "wepass", "bad"); err == nil {
+		t.Fatalf("rejected pod should be compensated")
+	}
+}
+
+func TestBatchApplyAtomicRollsBack(t *testing.T) {
+	env := newTestEnv(t)
+	web := newTestPodInfo()
+	env.addPod(t, web)
+	env.rejectDeployment("create", "bad")
+
+	response := &pod.BatchResponse{}
+	request := &pod.BatchApplyRequest{PodInfos: newBatchItems(web), Atomic: true}
+	if err := env.handler.BatchApply(context.TODO(), request, response); err != nil {
+		t.Fatalf("BatchApply error %s", err)
+	}
+	assertBatchStatus(t, response, service.BatchRolledBack, service.BatchRolledBack, service.BatchFailed)
+	if !response.RolledBack || response.Succeeded != 0 {
+		t.Fatalf("unexpected summary %v", response)
+	}
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Get(context.TODO(), "api", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("created deployment should be rolled back, got error %v", err)
+	}
+	if _, err := env.repository.FindPodByName("default", "wepass", "api"); err == nil {
+		t.Fatalf("created pod should be rolled back")
+	}
+	if image := env.deployment(t, "wepass", "web").Spec.Template.Spec.Containers[0].Image; image != "nginx:1.25" {
+		t.Fatalf("image %s, want nginx:1.25", image)
+	}
+	current, err := env.repository.FindPodByID(web.Id)
+	if err != nil || current.PodImage != "nginx:1.25" || current.Version != 3 {
+		t.Fatalf("unexpected pod %v error %v", current, err)
+	}
+}
+
+func TestBatchApplyAtomicSkipsWhenCheckFails(t *testing.T) {
+	env := newTestEnv(t)
+	web := newTestPodInfo()
+	env.addPod(t, web)
+
+	items := newBatchItems(web)
+	items[1].ResourceVersion = 5
+	response := &pod.BatchResponse{}
+	if err := env.handler.BatchApply(context.TODO(), &pod.BatchApplyRequest{PodInfos: items, Atomic: true}, response); err != nil {
+		t.Fatalf("BatchApply error %s", err)
+	}
+	assertBatchStatus(t, response, service.BatchSkipped, service.BatchFailed, service.BatchSkipped)
+	if _, err := env.repository.FindPodByName("default", "wepass", "api"); err == nil {
+		t.Fatalf("skipped pod should not be created")
+	}
+	assertError(t, env.handler.BatchApply(context.TODO(), &pod.BatchApplyRequest{}, &pod.BatchResponse{}),
+		http.StatusBadRequest, common.CodeInvalidArgument)
+}
+
+func TestBatchDeleteAtomicRestores(t *testing.T) {
+	env := newTestEnv(t)
+	web := newTestPodInfo()
+	env.addPod(t, web)
+	api := newTestPodInfo()
+	api.PodName = "api"
+	env.addPod(t, api)
+	env.rejectDeployment("delete", "api")
+
+	response := &pod.BatchResponse{}
+	request := &pod.BatchDeleteRequest{Ids: []int64{web.Id, api.Id, 100}, Atomic: true}
+	if err := env.handler.BatchDelete(context.TODO(), request, response); err != nil {
+		t.Fatalf("BatchDelete error %s", err)
+	}
+	// 不存在的 pod 检查失败，其他项都不会提交
+	assertBatchStatus(t, response, service.BatchSkipped, service.BatchSkipped, service.BatchFailed)
+
+	request.Ids = request.Ids[:2]
+	response = &pod.BatchResponse{}
+	if err := env.handler.BatchDelete(context.TODO(), request, response); err != nil {
+		t.Fatalf("BatchDelete error %s", err)
+	}
+	assertBatchStatus(t, response, service.BatchRolledBack, service.BatchFailed)
+	env.deployment(t, "wepass", "web")
+	env.deployment(t, "wepass", "api")
+	for _, id := range request.Ids {
+		if _, err := env.repository.FindPodByID(id); err != nil {
+			t.Fatalf("pod %d should be restored, error %s", id, err)
+		}
+	}
+}
+
+func TestBatchApplyAtomicRollsBackTimedOutItems(t *testing.T) {
+	env := newTestEnv(t)
+	// slow 一直返回可以重试的错误，超时的时候还没有完成
+	env.clientSet.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.CreateAction).GetObject().(*appsv1.Deployment).Name != "slow" {
+			return false, nil, nil
+		}
+		return true, nil, k8serrors.NewServerTimeout(schema.GroupResource{Group: "apps", Resource: "deployments"}, "create", 1)
+	})
+	dataService := env.handler.PodDataService
+	operationService := service.NewPodOperationService(env.repository, dataService, env.clientSet, service.NewPodHistoryService(nil, nil, nil), 3)
+	batchService := service.NewPodBatchService(dataService, operationService, service.NewPodHistoryService(nil, nil, nil))
+
+	api := newTestPodInfo()
+	api.PodName = "api"
+	slow := newTestPodInfo()
+	slow.PodName = "slow"
+	response, err := batchService.BatchApply(context.TODO(),
+		&pod.BatchApplyRequest{PodInfos: []*pod.PodInfo{api, slow}, Atomic: true, TimeoutSeconds: 1})
+	if err != nil {
+		t.Fatalf("BatchApply error %s", err)
+	}
+	// slow 的回滚排在它后面，由 worker 执行
+	assertBatchStatus(t, response, service.BatchRolledBack, service.BatchPending)
+	if !response.RolledBack || response.Succeeded != 0 || response.Results[1].RollbackOperationId == 0 {
+		t.Fatalf("unexpected summary %v, want the timed out item rolled back", response)
+	}
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Get(context.TODO(), "api", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("created deployment should be rolled back, got error %v", err)
+	}
+}
+
+// failingFindRepository 查询数据库时失败
+type failingFindRepository struct {
+	repository.IPodRepository
+}
+
+func (f failingFindRepository) FindPodByName(cluster, namespace, name string) (*model.Pod, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func TestBatchApplyFailsWhenTheNameCheckFails(t *testing.T) {
+	env := newTestEnv(t)
+	dataService := service.NewPodDataService(failingFindRepository{env.repository}, env.clientSet)
+	batchService := service.NewPodBatchService(dataService, env.operationService, service.NewPodHistoryService(nil, nil, nil))
+
+	response, err := batchService.BatchApply(context.TODO(), &pod.BatchApplyRequest{PodInfos: []*pod.PodInfo{newTestPodInfo()}})
+	if err != nil {
+		t.Fatalf("BatchApply error %s", err)
+	}
+	assertBatchStatus(t, response, service.BatchFailed)
+	if !strings.Contains(response.Results[0].Error, "database unavailable") || response.Results[0].OperationId != 0 {
+		t.Fatalf("result %v, want the lookup error and nothing submitted", response.Results[0])
+	}
+}
+
+func TestFindPodAllFiltersAndPages(t *testing.T) {
+	env := newTestEnv(t)
+	for _, name := range []string{"api", "web", "worker"} {
+		info := newTestPodInfo()
+		info.PodName = name
+		if name == "worker" {
+			info.PodLabel = []*pod.PodLabel{{LabelKey: "env", LabelValue: "dev"}}
+		}
+		env.addPod(t, info)
+	}
+
+	infos := &pod.PodInfos{}
+	if err := env.handler.FindPodAll(context.TODO(), &pod.FindAll{LabelSelector: "env=prod", OrderBy: "-pod_name", PageSize: 1}, infos); err != nil {
+		t.Fatalf("FindPodAll error %s", err)
+	}
+	if infos.TotalCount != 2 || len(infos.PodInfos) != 1 || infos.PodInfos[0].PodName != "web" || infos.NextPageToken == "" {
+		t.Fatalf("unexpected first page %+v", infos)
+	}
+	next := &pod.PodInfos{}
+	if err := env.handler.FindPodAll(context.TODO(), &pod.FindAll{LabelSelector: "env=prod", OrderBy: "-pod_name", PageSize: 1,
+		PageToken: infos.NextPageToken}, next); err != nil {
+		t.Fatalf("FindPodAll error %s", err)
+	}
+	if len(next.PodInfos) != 1 || next.PodInfos[0].PodName != "api" || next.NextPageToken != "" {
+		t.Fatalf("unexpected second page %+v", next)
+	}
+}
+
+func TestAddPodReturnsAllFieldErrors(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	info.PodName = "Web"
+	info.PodReplicas = 0
+	info.PodImage = ""
+	info.PodCpuMin = 2
+	info.PodPort[1].ContainerPort = 0
+	info.PodEnv[1].EnvKey = "LOG_LEVEL"
+	invalid := assertError(t, env.handler.AddPod(context.TODO(), info, &pod.Response{}), http.StatusBadRequest, common.CodeInvalidArgument)
+	var fields []string
+	for _, violation := range invalid.Fields {
+		fields = append(fields, violation.Field)
+	}
+	want := []string{"pod_name", "pod_image", "pod_replicas", "pod_cpu_min", "pod_port[1].container_port", "pod_env[1].env_key"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("field violations %v, want %v", fields, want)
+	}
+	if len(env.clientSet.Actions()) != 0 {
+		t.Fatalf("invalid pod should not reach k8s, actions %v", env.clientSet.Actions())
+	}
+
+	// 更新时同样校验，不会修改数据库
+	env.addPod(t, newTestPodInfo())
+	update := newTestPodInfo()
+	update.Id, update.ResourceVersion, update.PodRestart = 1, 1, "Never"
+	assertError(t, env.handler.UpdatePod(context.TODO(), update, &pod.Response{}), http.StatusBadRequest, common.CodeInvalidArgument)
+}
+
+func TestFindPodAllInvalidArguments(t *testing.T) {
+	env := newTestEnv(t)
+	for _, request := range []*pod.FindAll{
+		{LabelSelector: "env in ("},
+		{LabelSelector: "replicas>3"},
+		{OrderBy: "pod_image"},
+		{PageToken: "not-a-token"},
+	} {
+		err := env.handler.FindPodAll(context.TODO(), request, &pod.PodInfos{})
+		invalid := assertError(t, err, http.StatusBadRequest, common.CodeInvalidArgument)
+		if len(invalid.Fields) != 1 {
+			t.Fatalf("request %+v field violations %v, want 1", request, invalid.Fields)
+		}
+	}
+}
+
+// newImportDeployment 不是由 wepass 创建的 Deployment，selector 和 wepass 的一致
+func newImportDeployment(name string) *appsv1.Deployment {
+	replicas := int32(2)
+	labels := map[string]string{service.LabelAppName: name, "env": "prod"}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "wepass", Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{service.LabelAppName: name}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  name,
+						Image: "nginx:1.25",
+						Resources: corev1.ResourceRequirements{
+							Limits: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("1"),
+								corev1.ResourceMemory: resource.MustParse("256Mi"),
+							},
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("500m"),
+								corev1.ResourceMemory: resource.MustParse("128Mi"),
+							},
+						},
+					}},
+					RestartPolicy: corev1.RestartPolicyAlways,
+				},
+			},
+		},
+	}
+}
+
+func TestImportPodsValidatesPods(t *testing.T) {
+	env := newTestEnv(t)
+	valid := newImportDeployment("web")
+	invalid := newImportDeployment("api")
+	invalid.Spec.Template.Spec.Containers[0].Image = ""
+	for _, deployment := range []*appsv1.Deployment{valid, invalid} {
+		if _, err := env.clientSet.AppsV1().Deployments("wepass").Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("create deployment error %s", err)
+		}
+	}
+	env.clientSet.ClearActions()
+
+	response := &pod.ImportPodsResponse{}
+	if err := env.handler.ImportPods(context.TODO(), &pod.ImportPodsRequest{PodNamespace: "wepass", PodTeamId: "team-a"}, response); err != nil {
+		t.Fatalf("ImportPods error %s", err)
+	}
+	results := map[string]*pod.ImportResult{}
+	for _, result := range response.Results {
+		results[result.PodName] = result
+	}
+	if !results["web"].Imported || results["web"].Error != "" {
+		t.Fatalf("web import result %+v", results["web"])
+	}
+	if results["api"].Imported || !strings.Contains(results["api"].Error, "pod_image") {
+		t.Fatalf("api import result %+v, want a pod_image error", results["api"])
+	}
+	if _, err := env.repository.FindPodByName("default", "wepass", "api"); err == nil {
+		t.Fatal("invalid deployment was imported")
+	}
+	for _, action := range env.clientSet.Actions() {
+		if action.GetVerb() == "patch" && action.(k8stesting.PatchAction).GetName() == "api" {
+			t.Fatal("invalid deployment was patched")
+		}
+	}
+}
+
+// importDeployments 在集群中创建 Deployment 后导入
+func (e *testEnv) importDeployments(t *testing.T, deployments ...*appsv1.Deployment) map[string]*pod.ImportResult {
+	t.Helper()
+	for _, deployment := range deployments {
+		if _, err := e.clientSet.AppsV1().Deployments("wepass").Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("create deployment error %s", err)
+		}
+	}
+	response := &pod.ImportPodsResponse{}
+	if err := e.handler.ImportPods(context.TODO(), &pod.ImportPodsRequest{PodNamespace: "wepass", PodTeamId: "team-a"}, response); err != nil {
+		t.Fatalf("ImportPods error %s", err)
+	}
+	results := map[string]*pod.ImportResult{}
+	for _, result := range response.Results {
+		results[result.PodName] = result
+	}
+	return results
+}
+
+func TestImportPodsRefusesUnmanageableDeployments(t *testing.T) {
+	env := newTestEnv(t)
+	selector := newImportDeployment("api")
+	selector.Spec.Selector.MatchLabels["tier"] = "backend"
+	selector.Spec.Template.Labels["tier"] = "backend"
+	noLimits := newImportDeployment("worker")
+	noLimits.Spec.Template.Spec.Containers[0].Resources.Limits = nil
+	results := env.importDeployments(t, selector, noLimits)
+
+	if results["api"].Imported || !strings.Contains(results["api"].Error, "spec.selector") {
+		t.Fatalf("api import result %+v, want a selector error", results["api"])
+	}
+	want := []string{"spec.template.spec.containers[0].resources.limits[cpu]", "spec.template.spec.containers[0].resources.limits[memory]"}
+	if !reflect.DeepEqual(results["worker"].Unsupported, want) {
+		t.Fatalf("worker unsupported %v, want %v", results["worker"].Unsupported, want)
+	}
+	// 没有 limits 时使用 requests
+	worker, err := env.repository.FindPodByName("default", "wepass", "worker")
+	if err != nil || !results["worker"].Imported {
+		t.Fatalf("worker import result %+v error %v", results["worker"], err)
+	}
+	if worker.PodCpuMax != worker.PodCpuMin || worker.PodMemoryMax != worker.PodMemoryMin {
+		t.Fatalf("worker limits %v/%v, want the requests %v/%v", worker.PodCpuMax, worker.PodMemoryMax, worker.PodCpuMin, worker.PodMemoryMin)
+	}
+	if _, err := env.repository.FindPodByName("default", "wepass", "api"); err == nil {
+		t.Fatal("refused deployment was written to the database")
+	}
+}
+
+// failingCreateRepository 写入数据库时失败
+type failingCreateRepository struct {
+	repository.IPodRepository
+}
+
+func (f failingCreateRepository) CreatePod(pod *model.Pod) (int64, error) {
+	return 0, errors.New("database unavailable")
+}
+
+func TestImportPodsRestoresLabelsWhenInsertFails(t *testing.T) {
+	env := newTestEnv(t)
+	deployment := newImportDeployment("web")
+	deployment.Labels[service.LabelTeam] = "team-b"
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create deployment error %s", err)
+	}
+	importService := service.NewPodImportService(failingCreateRepository{env.repository}, env.repository, env.clientSet)
+	results, err := importService.ImportPods(&pod.ImportPodsRequest{PodNamespace: "wepass"})
+	if err != nil {
+		t.Fatalf("ImportPods error %s", err)
+	}
+	if len(results) != 1 || results[0].Imported || results[0].Error == "" {
+		t.Fatalf("import results %+v, want an error", results)
+	}
+	live := env.deployment(t, "wepass", "web")
+	if !reflect.DeepEqual(live.Labels, deployment.Labels) {
+		t.Fatalf("labels %v, want the original %v", live.Labels, deployment.Labels)
+	}
+	if _, ok := live.Annotations[service.AnnotationImported]; ok {
+		t.Fatalf("annotations %v, want no imported annotation", live.Annotations)
+	}
+}
+
+func TestReconcileIgnoresUnmanagedFieldsOfImportedPods(t *testing.T) {
+	env := newTestEnv(t)
+	deployment := newImportDeployment("web")
+	spec := &deployment.Spec.Template.Spec
+	spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "LOG_LEVEL", Value: "debug"},
+		{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+	}
+	spec.Containers = append(spec.Containers, corev1.Container{Name: "proxy", Image: "envoy:1.28"})
+	results := env.importDeployments(t, deployment)
+	if !results["web"].Imported {
+		t.Fatalf("web import result %+v", results["web"])
+	}
+	if env.deployment(t, "wepass", "web").Annotations[service.AnnotationImported] != "true" {
+		t.Fatal("imported deployment is not marked")
+	}
+
+	report := env.handler.PodReconcileService.Reconcile()
+	if report.Error != "" || report.Updated != 0 || report.Failed != 0 || report.Created != 0 {
+		t.Fatalf("reconcile report %+v, want no changes", report)
+	}
+	if containers := env.deployment(t, "wepass", "web").Spec.Template.Spec.Containers; len(containers) != 2 {
+		t.Fatalf("%d containers after reconcile, want the sidecar kept", len(containers))
+	}
+}
+
+func TestReconcilePatchesOnlyManagedFields(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	env.addPod(t, info)
+	live := env.deployment(t, "wepass", "web")
+	live.Annotations = map[string]string{"team.io/owner": "alice"}
+	live.Spec.Template.Spec.Containers[0].Image = "nginx:latest"
+	live.Spec.Template.Spec.Containers[0].LivenessProbe = &corev1.Probe{InitialDelaySeconds: 5}
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Update(context.TODO(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update deployment error %s", err)
+	}
+
+	report := env.handler.PodReconcileService.Reconcile()
+	if report.Updated != 1 || report.Failed != 0 {
+		t.Fatalf("reconcile report %+v, want 1 update", report)
+	}
+	if item := report.Items[0]; item.PodCluster != "default" || item.PodName != "web" || !strings.Contains(item.Message, "image") {
+		t.Fatalf("reconcile item %+v", item)
+	}
+	repaired := env.deployment(t, "wepass", "web")
+	assertDeployment(t, repaired, info)
+	if repaired.Annotations["team.io/owner"] != "alice" || repaired.Spec.Template.Spec.Containers[0].LivenessProbe == nil {
+		t.Fatalf("reconcile removed fields wepass does not manage %+v", repaired)
+	}
+}
+
+func TestReconcileRepairsImportedPods(t *testing.T) {
+	env := newTestEnv(t)
+	deployment := newImportDeployment("web")
+	spec := &deployment.Spec.Template.Spec
+	spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+	}
+	spec.Containers = append(spec.Containers, corev1.Container{Name: "proxy", Image: "envoy:1.28"})
+	results := env.importDeployments(t, deployment)
+	if !results["web"].Imported {
+		t.Fatalf("web import result %+v", results["web"])
+	}
+	live := env.deployment(t, "wepass", "web")
+	live.Spec.Template.Spec.Containers[0].Image = "nginx:latest"
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Update(context.TODO(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update deployment error %s", err)
+	}
+
+	if report := env.handler.PodReconcileService.Reconcile(); report.Updated != 1 || report.Failed != 0 {
+		t.Fatalf("reconcile report %+v, want 1 update", report)
+	}
+	repaired := env.deployment(t, "wepass", "web")
+	containers := repaired.Spec.Template.Spec.Containers
+	if len(containers) != 2 || containers[0].Image != "nginx:1.25" || len(containers[0].Env) != 1 || containers[0].Env[0].ValueFrom == nil {
+		t.Fatalf("repaired containers %+v", containers)
+	}
+	if _, ok := repaired.Spec.Template.Labels[service.LabelManagedBy]; ok {
+		t.Fatal("reconcile changed the template labels of an imported deployment")
+	}
+}
+
+func TestReconcileSkipsPodsWithPendingOperations(t *testing.T) {
+	env := newTestEnv(t)
+	env.addPod(t, newTestPodInfo())
+	deleted := &pod.Response{}
+	if err := env.handler.DeletePod(context.TODO(), &pod.PodID{Id: 1}, deleted); err != nil {
+		t.Fatalf("DeletePod error %s", err)
+	}
+	api := newTestPodInfo()
+	api.PodName = "api"
+	if err := env.handler.AddPod(context.TODO(), api, &pod.Response{}); err != nil {
+		t.Fatalf("AddPod error %s", err)
+	}
+
+	report := env.handler.PodReconcileService.Reconcile()
+	if report.Error != "" || report.Created != 0 || report.Orphaned != 0 || report.Failed != 0 {
+		t.Fatalf("reconcile report %+v, want pods with pending operations skipped", report)
+	}
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Get(context.TODO(), "api", metav1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Fatalf("reconcile created a deployment the worker has not created yet, error %v", err)
+	}
+	if _, ok := env.deployment(t, "wepass", "web").Annotations[service.AnnotationOrphaned]; ok {
+		t.Fatal("reconcile flagged a deployment the worker has not deleted yet")
+	}
+
+	results := env.importDeployments(t)
+	if web := results["web"]; web.Imported || !strings.Contains(web.Error, "being deleted") {
+		t.Fatalf("web import result %+v, want the pending delete to block the import", web)
+	}
+}
+
+func TestWaitStopsWhenContextIsCancelled(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	response := &pod.Response{}
+	if err := env.handler.AddPod(context.TODO(), info, response); err != nil {
+		t.Fatalf("AddPod error %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	start := time.Now()
+	if _, err := env.operationService.WaitOperation(ctx, response.OperationId, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitOperation error %v, want context.Canceled", err)
+	}
+	env.execute(t, response.OperationId, model.OperationSucceed)
+	if _, err := env.handler.PodDataService.WaitForRollout(ctx, info.PodNamespace, info.PodName, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitForRollout error %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("waiting took %s after the context was cancelled", elapsed)
+	}
+}
+
+func TestApplyManifestReportsEveryDroppedField(t *testing.T) {
+	env := newTestEnv(t)
+	manifest := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  annotations:
+    team.io/owner: alice
+    deployment.kubernetes.io/revision: "3"
+spec:
+  replicas: 2
+  minReadySeconds: 5
+  progressDeadlineSeconds: 300
+  revisionHistoryLimit: 3
+  paused: true
+  selector:
+    matchLabels:
+      app-name: web
+  template:
+    metadata:
+      labels:
+        app-name: web
+        tier: frontend
+      annotations:
+        prometheus.io/scrape: "true"
+    spec:
+      hostNetwork: true
+      terminationGracePeriodSeconds: 60
+      priorityClassName: high
+      dnsPolicy: Default
+      containers:
+        - name: app
+          image: nginx:1.25
+          workingDir: /srv
+          lifecycle:
+            preStop:
+              exec:
+                command: ["sleep", "5"]
+          env:
+            - name: POD_IP
+              valueFrom:
+                fieldRef:
+                  fieldPath: status.podIP
+            - name: LOG_LEVEL
+              value: debug
+          resources:
+            limits:
+              cpu: "1"
+              memory: 256Mi
+            requests:
+              cpu: 500m
+              memory: 128Mi
+`
+	response := &pod.ApplyManifestResponse{}
+	request := &pod.ApplyManifestRequest{Manifest: manifest, PodNamespace: "wepass", PodTeamId: "team-a"}
+	if err := env.handler.ApplyManifest(context.TODO(), request, response); err != nil {
+		t.Fatalf("ApplyManifest error %s", err)
+	}
+	want := []string{
+		"metadata.annotations[team.io/owner]",
+		"spec.template.metadata.labels[tier]",
+		"spec.template.metadata.annotations[prometheus.io/scrape]",
+		"spec.template.spec.containers[0].name",
+		"spec.template.spec.containers[0].workingDir",
+		"spec.template.spec.containers[0].env[POD_IP]",
+		"spec.template.spec.containers[0].lifecycle",
+		"spec.template.spec.terminationGracePeriodSeconds",
+		"spec.template.spec.dnsPolicy",
+		"spec.template.spec.hostNetwork",
+		"spec.template.spec.priorityClassName",
+		"spec.minReadySeconds",
+		"spec.revisionHistoryLimit",
+		"spec.paused",
+		"spec.progressDeadlineSeconds",
+	}
+	result := response.Results[0]
+	if result.Created || !reflect.DeepEqual(result.Unsupported, want) {
+		t.Fatalf("unsupported %v, want %v", result.Unsupported, want)
+	}
+}
+
+func TestConvertDeploymentIgnoresServerDefaults(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	info.PodType = "Rolling"
+	env.addPod(t, info)
+	// apiserver 填充的默认值和状态
+	live := env.deployment(t, "wepass", "web")
+	live.UID, live.ResourceVersion, live.Generation = "uid", "7", 2
+	live.Annotations = map[string]string{"deployment.kubernetes.io/revision": "2"}
+	revisionHistoryLimit, progressDeadlineSeconds, gracePeriod := int32(10), int32(600), int64(30)
+	live.Spec.RevisionHistoryLimit, live.Spec.ProgressDeadlineSeconds = &revisionHistoryLimit, &progressDeadlineSeconds
+	maxSurge := intstr.FromString("25%")
+	live.Spec.Strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{MaxSurge: &maxSurge, MaxUnavailable: &maxSurge}
+	podSpec := &live.Spec.Template.Spec
+	podSpec.TerminationGracePeriodSeconds = &gracePeriod
+	podSpec.DNSPolicy, podSpec.SchedulerName = corev1.DNSClusterFirst, corev1.DefaultSchedulerName
+	podSpec.SecurityContext = &corev1.PodSecurityContext{}
+	podSpec.Containers[0].TerminationMessagePath = corev1.TerminationMessagePathDefault
+	podSpec.Containers[0].TerminationMessagePolicy = corev1.TerminationMessageReadFile
+	live.Status.Replicas = 3
+
+	if _, unsupported := service.ConvertDeployment(live); len(unsupported) != 0 {
+		t.Fatalf("unsupported %v for a deployment created by wepass", unsupported)
+	}
+}
+
+func TestStrictImportRefusesFieldsUpdatePodWouldOverwrite(t *testing.T) {
+	env := newTestEnv(t)
+	renamed := newImportDeployment("web")
+	renamed.Spec.Template.Spec.Containers[0].Name = "app"
+	labelled := newImportDeployment("api")
+	labelled.Spec.Template.Labels = map[string]string{service.LabelAppName: "api", "tier": "backend"}
+	for _, deployment := range []*appsv1.Deployment{renamed, labelled} {
+		if _, err := env.clientSet.AppsV1().Deployments("wepass").Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("create deployment error %s", err)
+		}
+	}
+	response := &pod.ImportPodsResponse{}
+	if err := env.handler.ImportPods(context.TODO(), &pod.ImportPodsRequest{PodNamespace: "wepass", PodTeamId: "team-a", Strict: true}, response); err != nil {
+		t.Fatalf("ImportPods error %s", err)
+	}
+	want := map[string]string{"web": "spec.template.spec.containers[0].name", "api": "spec.template.metadata.labels[tier]"}
+	for _, result := range response.Results {
+		if result.Imported || !reflect.DeepEqual(result.Unsupported, []string{want[result.PodName]}) {
+			t.Fatalf("%s strict import result %+v, want %s reported", result.PodName, result, want[result.PodName])
+		}
+	}
+	if pods, _ := env.repository.FindAll(); len(pods) != 0 {
+		t.Fatalf("strict import wrote %d pods", len(pods))
+	}
+}
+
+func TestUpdatePodRejectsIdentityChanges(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	response := env.addPod(t, info)
+
+	for _, test := range []struct {
+		field  string
+		modify func(info *pod.PodInfo)
+	}{
+		{"pod_name", func(info *pod.PodInfo) { info.PodName = "web-2" }},
+		{"pod_namespace", func(info *pod.PodInfo) { info.PodNamespace = "other" }},
+	} {
+		update := newTestPodInfo()
+		update.Id, update.ResourceVersion = info.Id, response.ResourceVersion
+		test.modify(update)
+		invalid := assertError(t, env.handler.UpdatePod(context.TODO(), update, &pod.Response{}), http.StatusBadRequest, common.CodeInvalidArgument)
+		if len(invalid.Fields) != 1 || invalid.Fields[0].Field != test.field {
+			t.Fatalf("fields %v, want %s", invalid.Fields, test.field)
+		}
+
+		batch := &pod.BatchResponse{}
+		if err := env.handler.BatchApply(context.TODO(), &pod.BatchApplyRequest{PodInfos: []*pod.PodInfo{update}}, batch); err != nil {
+			t.Fatalf("BatchApply error %s", err)
+		}
+		if result := batch.Results[0]; result.Status != service.BatchFailed || !strings.Contains(result.Error, test.field) {
+			t.Fatalf("batch result %+v, want %s rejected", result, test.field)
+		}
+	}
+	if current, _ := env.repository.FindPodByID(info.Id); current.Version != response.ResourceVersion {
+		t.Fatalf("pod version %d, want the rename rejected", current.Version)
+	}
+}
+
+// staleFindAllRepository FindAll 返回旧的数据，模拟对账开始之后 worker 又执行完了操作
+type staleFindAllRepository struct {
+	repository.IPodRepository
+	pods []*model.Pod
+}
+
+func (s staleFindAllRepository) FindAll() ([]*model.Pod, error) {
+	return s.pods, nil
+}
+
+func TestReconcileSkipsPodsChangedAfterTheSnapshot(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	response := env.addPod(t, info)
+	stale, err := env.repository.FindPodByID(info.Id)
+	if err != nil {
+		t.Fatalf("find pod error %s", err)
+	}
+	info.ResourceVersion, info.PodImage = response.ResourceVersion, "nginx:1.26"
+	updated := &pod.Response{}
+	if err := env.handler.UpdatePod(context.TODO(), info, updated); err != nil {
+		t.Fatalf("UpdatePod error %s", err)
+	}
+	env.execute(t, updated.OperationId, model.OperationSucceed)
+
+	reconcileService := service.NewPodReconcileService(staleFindAllRepository{env.repository, []*model.Pod{stale}},
+		env.repository, env.clientSet, service.NewPodHistoryService(nil, nil, nil))
+	if report := reconcileService.Reconcile(); report.Updated != 0 || report.Failed != 0 {
+		t.Fatalf("reconcile report %+v, want the stale pod skipped", report)
+	}
+	if image := env.deployment(t, "wepass", "web").Spec.Template.Spec.Containers[0].Image; image != "nginx:1.26" {
+		t.Fatalf("image %s, want the update kept", image)
+	}
+}
+
+func TestReconcileRepairsStrategyAndLabels(t *testing.T) {
+	env := newTestEnv(t)
+	info := newTestPodInfo()
+	env.addPod(t, info)
+	live := env.deployment(t, "wepass", "web")
+	live.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RollingUpdateDeploymentStrategyType}
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Update(context.TODO(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update deployment error %s", err)
+	}
+	if report := env.handler.PodReconcileService.Reconcile(); report.Updated != 1 || !strings.Contains(report.Items[0].Message, "strategy") {
+		t.Fatalf("reconcile report %+v, want the strategy repaired", report)
+	}
+
+	live = env.deployment(t, "wepass", "web")
+	live.Labels["env"] = "staging"
+	if _, err := env.clientSet.AppsV1().Deployments("wepass").Update(context.TODO(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update deployment error %s", err)
+	}
+	if report := env.handler.PodReconcileService.Reconcile(); report.Updated != 1 || !strings.Contains(report.Items[0].Message, "labels") {
+		t.Fatalf("reconcile report %+v, want the labels repaired", report)
+	}
+	assertDeployment(t, env.deployment(t, "wepass", "web"), info)
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/DuanNengxin/wepass-pod/config"
 	"github.com/DuanNengxin/wepass-pod/domain/repository"
 	service2 "github.com/DuanNengxin/wepass-pod/domain/service"
+	"github.com/DuanNengxin/wepass-pod/gateway"
 	"github.com/DuanNengxin/wepass-pod/handler"
+	"github.com/DuanNengxin/wepass-pod/migration"
 	"github.com/DuanNengxin/wepass-pod/plugin"
 	pod "github.com/DuanNengxin/wepass-pod/proto"
 	"github.com/afex/hystrix-go/hystrix"
@@ -22,9 +24,11 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+	metricsv "k8s.io/metrics/pkg/client/clientset/versioned"
 	"net"
 	"net/http"
 	"path/filepath"
+	"time"
 )
 
 var (
@@ -34,7 +38,7 @@ var (
 )
 
 func init() {
-	flag.BoolVar(&migrate, "migrate", false, "数据库迁移")
+	flag.BoolVar(&migrate, "migrate", false, "启动前执行所有还没有执行的数据库迁移")
 	flag.StringVar(&mode, "mode", "dev", "启动模式")
 }
 
@@ -48,8 +52,27 @@ func main() {
 		),
 	)
 
-	db := common.InitMysql(migrate)
+	db := common.InitDatabase(migrate)
 	common.InitLogger(mode)
+
+	// 数据库迁移子命令，执行完直接退出
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(db, flag.Args()[1:]); err != nil {
+			zap.S().Fatal(err)
+		}
+		return
+	}
+	// 导出子命令，把 pod 导出成 yaml、kustomize 或者 helm chart
+	if flag.Arg(0) == "export" {
+		if err := runExport(db, flag.Args()[1:]); err != nil {
+			zap.S().Fatal(err)
+		}
+		return
+	}
+	// 数据库版本和程序不一致时拒绝启动
+	if err := migration.NewMigrator(db).Check(); err != nil {
+		zap.S().Fatal(err)
+	}
 	tracer, i, err := common.NewTracer("wepass-pod", fmt.Sprintf("%s:%s", config.Config().Tracer.Host, config.Config().Tracer.Port))
 	if err != nil {
 		return
@@ -98,6 +121,27 @@ func main() {
 		zap.S().Fatal(err.Error())
 	}
 
+	// metrics-server 客户端，用于查询 pod 实际资源使用量
+	metricsClientSet, err := metricsv.NewForConfig(k8sConfig)
+	if err != nil {
+		zap.S().Fatal(err.Error())
+	}
+
+	podRepository := repository.NewPodRepository(db)
+	// 对账需要最新的数据，不使用缓存
+	uncachedPodRepository := podRepository
+	// 缓存 pod 查询，没有 redis 时使用内存缓存
+	if cacheConfig := config.Config().Cache; cacheConfig != nil && cacheConfig.Enabled && cacheConfig.TTL > 0 {
+		cache := repository.NewMemoryCache()
+		if redisClient := common.InitRedis(); redisClient != nil {
+			cache = repository.NewRedisCache(redisClient)
+		}
+		podRepository = repository.NewCachedPodRepository(podRepository, cache, time.Duration(cacheConfig.TTL)*time.Second)
+	}
+	podDataService := service2.NewPodDataService(podRepository, clientSet)
+	podOperationRepository := repository.NewPodOperationRepository(db)
+	auditService := service2.NewAuditService(repository.NewAuditRepository(db))
+
 	srv := micro.NewService(
 		micro.Name("go.micro.service.pod"),
 		micro.Version("v1.0"),
@@ -107,13 +151,85 @@ func main() {
 		micro.WrapHandler(ratelimit.NewHandlerWrapper(1000)),                          // 服务端限流
 		micro.WrapClient(plugin.NewHystrixClientWrapper()),                            // 客户端熔断，只作为客户端的时候起作用
 		micro.WrapHandler(wrapperPrometheus.NewHandlerWrapper()),                      // 添加prometheus监控
+		// 记录审计日志
+		micro.WrapHandler(plugin.NewAuditHandlerWrapper(auditService, podDataService)),
 	)
 	// 初始化服务
 	srv.Init()
 
-	podDataService := service2.NewPodDataService(repository.NewPodRepository(db), clientSet)
+	// 启动 informer，用于推送 pod 生命周期事件
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	podWatchService := service2.NewPodWatchService(clientSet)
+	go podWatchService.Run(stopCh)
+
+	// pod 历史记录保存在 mongodb 中，连接失败时不记录
+	var podHistoryRepository repository.IPodHistoryRepository
+	historyConfig := config.Config().History
+	if historyConfig != nil && historyConfig.Enabled {
+		if mongoDB, err := common.InitMongo(); err != nil {
+			zap.S().Errorf("connect mongodb error %s, pod history disabled", err.Error())
+		} else {
+			podHistoryRepository = repository.NewPodHistoryRepository(mongoDB)
+		}
+	}
+	var historyTTL map[string]int
+	if historyConfig != nil {
+		historyTTL = historyConfig.TTL
+	}
+	podHistoryService := service2.NewPodHistoryService(podHistoryRepository, podWatchService, historyTTL)
+	go podHistoryService.Run(stopCh)
+
+	// 定期对账数据库和集群
+	podReconcileService := service2.NewPodReconcileService(uncachedPodRepository, podOperationRepository, clientSet, podHistoryService)
+	if reconcileConfig := config.Config().Reconcile; reconcileConfig != nil && reconcileConfig.Enabled && reconcileConfig.Interval > 0 {
+		go podReconcileService.Run(time.Duration(reconcileConfig.Interval)*time.Second, stopCh)
+	}
+
+	// 定期清理回收站
+	if retentionConfig := config.Config().Retention; retentionConfig != nil && retentionConfig.Days > 0 && retentionConfig.Interval > 0 {
+		go service2.NewPodRetentionService(podDataService).Run(time.Duration(retentionConfig.Interval)*time.Second,
+			time.Duration(retentionConfig.Days)*24*time.Hour, stopCh)
+	}
+
+	// 把数据库中待执行的操作应用到 k8s
+	operationInterval, operationAttempts := 5*time.Second, 0
+	if operationConfig := config.Config().Operation; operationConfig != nil {
+		if operationConfig.Interval > 0 {
+			operationInterval = time.Duration(operationConfig.Interval) * time.Second
+		}
+		operationAttempts = operationConfig.Attempts
+	}
+	podOperationService := service2.NewPodOperationService(podOperationRepository, podDataService, clientSet, podHistoryService, operationAttempts)
+	go podOperationService.Run(operationInterval, stopCh)
+
 	// 创建服务句柄
-	_ = pod.RegisterPodServiceHandler(srv.Server(), &handler.PodHandler{PodDataService: podDataService})
+	_ = pod.RegisterPodServiceHandler(srv.Server(), &handler.PodHandler{
+		PodDataService:      podDataService,
+		PodWatchService:     podWatchService,
+		PodReconcileService: podReconcileService,
+		PodImportService:    service2.NewPodImportService(podRepository, podOperationRepository, clientSet),
+		PodMetricsService:   service2.NewPodMetricsService(podRepository, clientSet, metricsClientSet),
+		PodEventService:     service2.NewPodEventService(podRepository, repository.NewPodEventRepository(db), clientSet),
+		AuditService:        auditService,
+		PodOperationService: podOperationService,
+		PodHistoryService:   podHistoryService,
+		PodExportService:    service2.NewPodExportService(podRepository),
+		PodBatchService:     service2.NewPodBatchService(podDataService, podOperationService, podHistoryService),
+	})
+
+	// REST 接口，通过 client 调用自己，wrapper 都会生效
+	if gatewayConfig := config.Config().Gateway; gatewayConfig != nil && gatewayConfig.Enabled && gatewayConfig.Port > 0 {
+		podGateway, err := gateway.NewGateway(pod.NewPodService("go.micro.service.pod", srv.Client()))
+		if err != nil {
+			zap.S().Fatal(err)
+		}
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", gatewayConfig.Port), podGateway); err != nil {
+				zap.S().Errorf("gateway listen error %s", err.Error())
+			}
+		}()
+	}
 
 	if err := srv.Run(); err != nil {
 		zap.S().Fatal(err)
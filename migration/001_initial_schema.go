@@ -0,0 +1,134 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// 第一个版本的表结构，已经用 -migrate(AutoMigrate) 建过表的数据库只补齐缺少的字段和索引
+func init() {
+	register(&Migration{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range initialTables() {
+				if tx.Migrator().HasTable(table) {
+					if err := tx.Migrator().AutoMigrate(table); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := tx.Migrator().CreateTable(table); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(initialTables()...)
+		},
+	})
+}
+
+func initialTables() []interface{} {
+	return []interface{}{
+		&pod001{}, &podPort001{}, &podEnv001{}, &podLabel001{}, &podEventRecord001{}, &auditLog001{}, &podOperation001{},
+	}
+}
+
+type pod001 struct {
+	ID            int64  `gorm:"primaryKey"`
+	PodName       string `gorm:"index:idx_pod_namespace_name,priority:2;size:191;not null"`
+	PodNamespace  string `gorm:"index:idx_pod_namespace_name,priority:1;size:191"`
+	PodTeamID     string `gorm:"index;size:191"`
+	PodCpuMax     float32
+	PodCpuMin     float32
+	PodReplicas   int32
+	PodMemoryMax  float32
+	PodMemoryMin  float32
+	PodPullPolicy string `gorm:"default:always"`
+	PodRestart    string `gorm:"default:always"`
+	PodType       string
+	PodImage      string
+	Version       int64          `gorm:"not null;default:1"`
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
+}
+
+func (pod001) TableName() string { return "pods" }
+
+type podPort001 struct {
+	ID            int64 `gorm:"primaryKey"`
+	PodID         int64
+	ContainerPort int32
+	Protocol      string
+}
+
+func (podPort001) TableName() string { return "pod_ports" }
+
+type podEnv001 struct {
+	ID       int64 `gorm:"primaryKey"`
+	PodID    int64
+	EnvKey   string
+	EnvValue string
+}
+
+func (podEnv001) TableName() string { return "pod_envs" }
+
+type podLabel001 struct {
+	ID         int64  `gorm:"primaryKey"`
+	PodID      int64  `gorm:"index"`
+	LabelKey   string `gorm:"index:idx_pod_label,priority:1;size:317"`
+	LabelValue string `gorm:"index:idx_pod_label,priority:2;size:63"`
+}
+
+func (podLabel001) TableName() string { return "pod_labels" }
+
+type podEventRecord001 struct {
+	ID             int64  `gorm:"primaryKey"`
+	PodID          int64  `gorm:"index;not null"`
+	EventUID       string `gorm:"uniqueIndex;size:64;not null"`
+	Type           string
+	Reason         string
+	Message        string `gorm:"type:text"`
+	ObjectKind     string
+	ObjectName     string
+	Count          int32
+	FirstTimestamp time.Time
+	LastTimestamp  time.Time
+}
+
+func (podEventRecord001) TableName() string { return "pod_event_records" }
+
+type auditLog001 struct {
+	ID           int64  `gorm:"primaryKey"`
+	Actor        string `gorm:"size:191"`
+	RPC          string `gorm:"size:64"`
+	PodID        int64  `gorm:"index"`
+	PodName      string
+	PodNamespace string
+	PodTeamID    string    `gorm:"index;size:191"`
+	Before       string    `gorm:"type:text"`
+	After        string    `gorm:"type:text"`
+	Diff         string    `gorm:"type:text"`
+	K8sOutcome   string    `gorm:"type:text"`
+	Error        string    `gorm:"type:text"`
+	CreatedAt    time.Time `gorm:"index"`
+}
+
+func (auditLog001) TableName() string { return "audit_logs" }
+
+type podOperation001 struct {
+	ID        int64  `gorm:"primaryKey"`
+	PodID     int64  `gorm:"index"`
+	Type      string `gorm:"size:16"`
+	Status    string `gorm:"index:idx_operation_status,priority:1;size:16"`
+	Spec      string `gorm:"type:text"`
+	Previous  string `gorm:"type:text"`
+	Attempts  int
+	LastError string    `gorm:"type:text"`
+	NextRunAt time.Time `gorm:"index:idx_operation_status,priority:2"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (podOperation001) TableName() string { return "pod_operations" }
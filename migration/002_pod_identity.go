@@ -0,0 +1,66 @@
+package migration
+
+import "gorm.io/gorm"
+
+// pod 名称改成在 (集群, 命名空间) 内唯一，回收站中的 pod 用 deleted_id 区分
+func init() {
+	register(&Migration{
+		Version: 2,
+		Name:    "pod_identity",
+		Up: func(tx *gorm.DB) error {
+			migrator := tx.Migrator()
+			for _, column := range []string{"PodCluster", "DeletedID"} {
+				if !migrator.HasColumn(&pod002{}, column) {
+					if err := migrator.AddColumn(&pod002{}, column); err != nil {
+						return err
+					}
+				}
+			}
+			if err := tx.Unscoped().Model(&pod002{}).Where("deleted_at IS NOT NULL").
+				Update("deleted_id", gorm.Expr("id")).Error; err != nil {
+				return err
+			}
+			if migrator.HasIndex(&pod001{}, "idx_pod_namespace_name") {
+				if err := migrator.DropIndex(&pod001{}, "idx_pod_namespace_name"); err != nil {
+					return err
+				}
+			}
+			// 已经有重复的 pod 时这里会失败，需要先处理重复数据
+			return migrator.CreateIndex(&pod002{}, "idx_pod_identity")
+		},
+		Down: func(tx *gorm.DB) error {
+			migrator := tx.Migrator()
+			if err := migrator.DropIndex(&pod002{}, "idx_pod_identity"); err != nil {
+				return err
+			}
+			for _, column := range []string{"DeletedID", "PodCluster"} {
+				if err := migrator.DropColumn(&pod002{}, column); err != nil {
+					return err
+				}
+			}
+			return migrator.CreateIndex(&pod001{}, "idx_pod_namespace_name")
+		},
+	})
+}
+
+type pod002 struct {
+	ID            int64  `gorm:"primaryKey"`
+	PodCluster    string `gorm:"uniqueIndex:idx_pod_identity,priority:1;size:191;not null;default:default"`
+	PodNamespace  string `gorm:"uniqueIndex:idx_pod_identity,priority:2;size:191"`
+	PodName       string `gorm:"uniqueIndex:idx_pod_identity,priority:3;size:191;not null"`
+	PodTeamID     string `gorm:"index;size:191"`
+	PodCpuMax     float32
+	PodCpuMin     float32
+	PodReplicas   int32
+	PodMemoryMax  float32
+	PodMemoryMin  float32
+	PodPullPolicy string `gorm:"default:always"`
+	PodRestart    string `gorm:"default:always"`
+	PodType       string
+	PodImage      string
+	Version       int64          `gorm:"not null;default:1"`
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
+	DeletedID     int64          `gorm:"uniqueIndex:idx_pod_identity,priority:4;not null;default:0"`
+}
+
+func (pod002) TableName() string { return "pods" }
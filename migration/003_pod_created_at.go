@@ -0,0 +1,33 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// pod 增加创建时间，已有的 pod 设置为 1970-01-01，查询历史时不按创建时间过滤
+func init() {
+	register(&Migration{
+		Version: 3,
+		Name:    "pod_created_at",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&pod003{}, "CreatedAt") {
+				if err := tx.Migrator().AddColumn(&pod003{}, "CreatedAt"); err != nil {
+					return err
+				}
+			}
+			return tx.Unscoped().Model(&pod003{}).Where("created_at IS NULL").
+				Update("created_at", time.Unix(0, 0).UTC()).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&pod003{}, "CreatedAt")
+		},
+	})
+}
+
+type pod003 struct {
+	ID        int64 `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+func (pod003) TableName() string { return "pods" }
@@ -0,0 +1,46 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+	"strings"
+)
+
+// pod_team_id 从整数改成字符串，团队 ID 不再要求是数字，已有的数字 ID 转成对应的字符串
+// 001 建的表本来就是字符串，回滚时不改回整数
+func init() {
+	register(&Migration{
+		Version: 4,
+		Name:    "pod_team_id_string",
+		Up: func(tx *gorm.DB) error {
+			isInteger, err := podTeamIDIsInteger(tx)
+			if err != nil || !isInteger {
+				return err
+			}
+			return tx.Migrator().AlterColumn(&pod004{}, "PodTeamID")
+		},
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	})
+}
+
+// podTeamIDIsInteger 用 -migrate(AutoMigrate) 建的表 pod_team_id 是 bigint，001 建的表已经是字符串
+func podTeamIDIsInteger(tx *gorm.DB) (bool, error) {
+	columnTypes, err := tx.Migrator().ColumnTypes(&pod004{})
+	if err != nil {
+		return false, err
+	}
+	for _, columnType := range columnTypes {
+		if columnType.Name() == "pod_team_id" {
+			return strings.Contains(strings.ToLower(columnType.DatabaseTypeName()), "int"), nil
+		}
+	}
+	return false, nil
+}
+
+type pod004 struct {
+	ID        int64  `gorm:"primaryKey"`
+	PodTeamID string `gorm:"index;size:191"`
+}
+
+func (pod004) TableName() string { return "pods" }
@@ -0,0 +1,199 @@
+package migration
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// Migration 一次数据库结构的修改，Up 和 Down 在同一个事务中执行并记录到 schema_migrations
+// 迁移中使用当时的表结构快照，不要直接引用 model，model 之后的修改不能影响已经发布的迁移
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration 已经执行过的迁移
+type SchemaMigration struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:191"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Status 一个迁移的执行状态
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrations 按版本号排序，新增迁移时追加到末尾
+var migrations []*Migration
+
+func register(migration *Migration) {
+	migrations = append(migrations, migration)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+}
+
+type Migrator struct {
+	db *gorm.DB
+}
+
+func NewMigrator(db *gorm.DB) *Migrator {
+	return &Migrator{db: db}
+}
+
+// Latest 当前程序需要的数据库版本
+func (m *Migrator) Latest() int64 {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Current 数据库当前的版本，还没有执行过迁移时是 0
+func (m *Migrator) Current() (int64, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+func (m *Migrator) Status() ([]*Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*Status
+	for _, migration := range migrations {
+		status := &Status{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Up 执行所有还没有执行的迁移
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down 回滚最近执行的一个迁移
+func (m *Migrator) Down() error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return nil
+	}
+	var target int64
+	for _, migration := range migrations {
+		if migration.Version < current {
+			target = migration.Version
+		}
+	}
+	return m.To(target)
+}
+
+// To 升级或者回滚到指定版本，0 表示回滚所有迁移
+func (m *Migrator) To(version int64) error {
+	if version != 0 && m.find(version) == nil {
+		return fmt.Errorf("migration version %d not found", version)
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+			if err := m.run(migration, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; ok && migration.Version > version {
+			if err := m.run(migration, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check 数据库版本和程序需要的版本不一致时返回错误，启动服务之前调用
+func (m *Migrator) Check() error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+	latest := m.Latest()
+	switch {
+	case current < latest:
+		return fmt.Errorf("database schema version %d is older than required version %d, run migrate up", current, latest)
+	case current > latest:
+		return fmt.Errorf("database schema version %d is newer than this binary supports %d", current, latest)
+	}
+	return nil
+}
+
+func (m *Migrator) run(migration *Migration, up bool) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if up {
+			if err := migration.Up(tx); err != nil {
+				return fmt.Errorf("migrate up %d %s error %w", migration.Version, migration.Name, err)
+			}
+			return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+		}
+		if err := migration.Down(tx); err != nil {
+			return fmt.Errorf("migrate down %d %s error %w", migration.Version, migration.Name, err)
+		}
+		return tx.Delete(&SchemaMigration{}, migration.Version).Error
+	})
+}
+
+func (m *Migrator) applied() (map[int64]*SchemaMigration, error) {
+	if !m.db.Migrator().HasTable(&SchemaMigration{}) {
+		if err := m.db.Migrator().CreateTable(&SchemaMigration{}); err != nil {
+			return nil, err
+		}
+	}
+	var records []*SchemaMigration
+	if err := m.db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := map[int64]*SchemaMigration{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"context"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/service"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/asim/go-micro/v3/metadata"
+	"github.com/asim/go-micro/v3/server"
+	"go.uber.org/zap"
+)
+
+// ActorHeader 调用方通过 metadata 传递的操作人
+const ActorHeader = "X-Wepass-Actor"
+
+// auditTarget 一次请求修改的 pod，before 在调用前查询，after 在调用成功后查询
+// body 和 rsp 的类型不对时返回空，只记录请求和错误，不会 panic
+type auditTarget struct {
+	before func() *model.Pod
+	after  func(rsp interface{}) []*model.Pod
+	// changes 批量接口每个 pod 各自的修改前后，设置了之后不使用 before 和 after
+	changes func(rsp interface{}) []auditChange
+}
+
+type auditChange struct {
+	before *model.Pod
+	after  *model.Pod
+}
+
+// NewAuditHandlerWrapper 为所有修改 pod 的接口记录审计日志
+func NewAuditHandlerWrapper(auditService service.IAuditService, podDataService service.IPodDataService) server.HandlerWrapper {
+	findByID := func(id int64) *model.Pod {
+		podModel, err := podDataService.FindPodByID(id)
+		if err != nil {
+			return nil
+		}
+		return podModel
+	}
+	targets := map[string]func(body interface{}) *auditTarget{
+		"PodService.AddPod": func(body interface{}) *auditTarget {
+			info, ok := body.(*pod.PodInfo)
+			if !ok {
+				return nil
+			}
+			return &auditTarget{after: func(interface{}) []*model.Pod {
+				podModel, err := podDataService.FindPodByName(model.ClusterOrDefault(info.PodCluster), info.PodNamespace, info.PodName)
+				if err != nil {
+					return nil
+				}
+				return []*model.Pod{podModel}
+			}}
+		},
+		"PodService.UpdatePod": func(body interface{}) *auditTarget {
+			info, ok := body.(*pod.PodInfo)
+			if !ok {
+				return nil
+			}
+			id := info.Id
+			return &auditTarget{
+				before: func() *model.Pod { return findByID(id) },
+				after:  func(interface{}) []*model.Pod { return []*model.Pod{findByID(id)} },
+			}
+		},
+		"PodService.DeletePod": func(body interface{}) *auditTarget {
+			podID, ok := body.(*pod.PodID)
+			if !ok {
+				return nil
+			}
+			id := podID.Id
+			return &auditTarget{
+				before: func() *model.Pod { return findByID(id) },
+				after:  func(interface{}) []*model.Pod { return []*model.Pod{findByID(id)} },
+			}
+		},
+		"PodService.RestorePod": func(body interface{}) *auditTarget {
+			podID, ok := body.(*pod.PodID)
+			if !ok {
+				return nil
+			}
+			id := podID.Id
+			return &auditTarget{
+				before: func() *model.Pod {
+					podModel, err := podDataService.FindDeletedPodByID(id)
+					if err != nil {
+						return nil
+					}
+					return podModel
+				},
+				after: func(interface{}) []*model.Pod { return []*model.Pod{findByID(id)} },
+			}
+		},
+		"PodService.ApplyManifest": func(body interface{}) *auditTarget {
+			return &auditTarget{after: func(rsp interface{}) []*model.Pod {
+				response, ok := rsp.(*pod.ApplyManifestResponse)
+				if !ok {
+					return nil
+				}
+				var pods []*model.Pod
+				for _, result := range response.Results {
+					if result.Created {
+						pods = append(pods, findByID(result.PodId))
+					}
+				}
+				return pods
+			}}
+		},
+		"PodService.BatchApply": func(body interface{}) *auditTarget {
+			request, ok := body.(*pod.BatchApplyRequest)
+			if !ok {
+				return nil
+			}
+			befores := map[int64]*model.Pod{}
+			for _, info := range request.PodInfos {
+				if info.Id != 0 {
+					befores[info.Id] = findByID(info.Id)
+				}
+			}
+			return &auditTarget{changes: func(rsp interface{}) []auditChange {
+				return batchChanges(rsp, befores, findByID)
+			}}
+		},
+		"PodService.BatchDelete": func(body interface{}) *auditTarget {
+			request, ok := body.(*pod.BatchDeleteRequest)
+			if !ok {
+				return nil
+			}
+			befores := map[int64]*model.Pod{}
+			for _, id := range request.Ids {
+				befores[id] = findByID(id)
+			}
+			return &auditTarget{changes: func(rsp interface{}) []auditChange {
+				return batchChanges(rsp, befores, findByID)
+			}}
+		},
+		"PodService.ImportPods": func(body interface{}) *auditTarget {
+			return &auditTarget{after: func(rsp interface{}) []*model.Pod {
+				response, ok := rsp.(*pod.ImportPodsResponse)
+				if !ok {
+					return nil
+				}
+				var pods []*model.Pod
+				for _, result := range response.Results {
+					if result.Imported {
+						pods = append(pods, findByID(result.PodId))
+					}
+				}
+				return pods
+			}}
+		},
+	}
+
+	return func(fn server.HandlerFunc) server.HandlerFunc {
+		return func(ctx context.Context, req server.Request, rsp interface{}) error {
+			newTarget, ok := targets[req.Endpoint()]
+			if !ok {
+				return fn(ctx, req, rsp)
+			}
+			// dry run 不修改任何数据，不需要审计
+			if info, ok := req.Body().(*pod.PodInfo); ok && info.DryRun {
+				return fn(ctx, req, rsp)
+			}
+			target := newTarget(req.Body())
+			if target == nil {
+				zap.S().Errorf("audit %s unexpected request body %T", req.Endpoint(), req.Body())
+				target = &auditTarget{}
+			}
+			var before *model.Pod
+			if target.before != nil {
+				before = target.before()
+			}
+
+			ctx, outcome := service.WithAuditOutcome(ctx)
+			err := fn(ctx, req, rsp)
+
+			auditLog := &model.AuditLog{
+				Actor:      getActor(ctx),
+				RPC:        req.Endpoint(),
+				K8sOutcome: outcome.String(),
+			}
+			if err != nil {
+				auditLog.Error = err.Error()
+			}
+			// 请求失败时查不到 pod，先用请求中的信息
+			switch body := req.Body().(type) {
+			case *pod.PodInfo:
+				auditLog.PodID, auditLog.PodName, auditLog.PodNamespace, auditLog.PodTeamID = body.Id, body.PodName, body.PodNamespace, body.PodTeamId
+			case *pod.PodID:
+				auditLog.PodID = body.Id
+			}
+			// 没有提交操作时没有修改，不查询 after，比如 AddPod 返回 ALREADY_EXISTS 时查到的是别人已经创建的 pod
+			// wait 时操作提交之后滚动失败或者操作补偿也会返回错误，这时数据库已经修改过，需要查询 after
+			committed := err == nil
+			if response, ok := rsp.(*pod.Response); ok && response.OperationId != 0 {
+				committed = true
+			}
+			var changes []auditChange
+			if committed {
+				if target.changes != nil {
+					changes = target.changes(rsp)
+				} else if target.after != nil {
+					for _, after := range target.after(rsp) {
+						changes = append(changes, auditChange{before: before, after: after})
+					}
+				}
+			}
+			if len(changes) == 0 {
+				changes = []auditChange{{before: before}}
+				if !committed {
+					changes[0].after = before
+				}
+			}
+			for _, change := range changes {
+				entry := *auditLog
+				if recordErr := auditService.Record(&entry, change.before, change.after); recordErr != nil {
+					zap.S().Errorf("record audit log %s error %s", req.Endpoint(), recordErr.Error())
+				}
+			}
+			return err
+		}
+	}
+}
+
+// batchChanges 只记录提交过操作的项，回滚之后 after 和 before 一样
+func batchChanges(rsp interface{}, befores map[int64]*model.Pod, findByID func(id int64) *model.Pod) []auditChange {
+	response, ok := rsp.(*pod.BatchResponse)
+	if !ok {
+		return nil
+	}
+	var changes []auditChange
+	for _, result := range response.Results {
+		if result.OperationId != 0 {
+			changes = append(changes, auditChange{before: befores[result.PodId], after: findByID(result.PodId)})
+		}
+	}
+	return changes
+}
+
+// getActor 优先使用调用方传递的操作人，没有时使用调用方地址
+func getActor(ctx context.Context) string {
+	if actor, ok := metadata.Get(ctx, ActorHeader); ok && actor != "" {
+		return actor
+	}
+	if remote, ok := metadata.Get(ctx, "Remote"); ok && remote != "" {
+		return remote
+	}
+	return "unknown"
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	"github.com/DuanNengxin/wepass-pod/domain/repository"
+	"github.com/DuanNengxin/wepass-pod/domain/service"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"github.com/asim/go-micro/v3/server"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+// fakeRequest 只实现 wrapper 用到的 Endpoint 和 Body
+type fakeRequest struct {
+	server.Request
+	endpoint string
+	body     interface{}
+}
+
+func (f *fakeRequest) Endpoint() string {
+	return f.endpoint
+}
+
+func (f *fakeRequest) Body() interface{} {
+	return f.body
+}
+
+// fakeAuditRepository 保存在内存中，审计记录由真正的 AuditService 生成
+type fakeAuditRepository struct {
+	repository.IAuditRepository
+	logs []*model.AuditLog
+}
+
+func (f *fakeAuditRepository) CreateAuditLog(log *model.AuditLog) error {
+	f.logs = append(f.logs, log)
+	return nil
+}
+
+func newTestWrapper(t *testing.T) (server.HandlerWrapper, *fakeAuditRepository, repository.IPodRepository) {
+	t.Helper()
+	podRepository := repository.NewMemoryPodRepository()
+	if _, err := podRepository.CreatePod(&model.Pod{PodCluster: "default", PodNamespace: "wepass", PodName: "web",
+		PodTeamID: "team-b", PodImage: "nginx:1.25", PodReplicas: 1}); err != nil {
+		t.Fatalf("create pod error %s", err)
+	}
+	auditRepository := &fakeAuditRepository{}
+	podDataService := service.NewPodDataService(podRepository, fake.NewSimpleClientset())
+	return NewAuditHandlerWrapper(service.NewAuditService(auditRepository), podDataService), auditRepository, podRepository
+}
+
+func TestAuditFailedAddPodDoesNotRecordExistingPod(t *testing.T) {
+	wrapper, auditRepository, _ := newTestWrapper(t)
+	handler := wrapper(func(ctx context.Context, req server.Request, rsp interface{}) error {
+		return common.AlreadyExists("pod web already exists")
+	})
+	request := &fakeRequest{endpoint: "PodService.AddPod", body: &pod.PodInfo{PodNamespace: "wepass", PodName: "web", PodTeamId: "team-a"}}
+	if err := handler(context.TODO(), request, &pod.Response{}); err == nil {
+		t.Fatal("wrapper swallowed the handler error")
+	}
+	if len(auditRepository.logs) != 1 {
+		t.Fatalf("%d audit logs, want 1", len(auditRepository.logs))
+	}
+	log := auditRepository.logs[0]
+	if log.After != "" || log.Diff != "" || log.PodID != 0 || log.PodTeamID != "team-a" || log.Error == "" {
+		t.Fatalf("audit log for a failed create %+v", log)
+	}
+}
+
+func TestAuditUnexpectedBodyDoesNotPanic(t *testing.T) {
+	wrapper, auditRepository, _ := newTestWrapper(t)
+	called := false
+	handler := wrapper(func(ctx context.Context, req server.Request, rsp interface{}) error {
+		called = true
+		return nil
+	})
+	for _, endpoint := range []string{"PodService.AddPod", "PodService.UpdatePod", "PodService.DeletePod",
+		"PodService.RestorePod", "PodService.BatchApply", "PodService.BatchDelete", "PodService.ImportPods",
+		"PodService.ApplyManifest"} {
+		called = false
+		if err := handler(context.TODO(), &fakeRequest{endpoint: endpoint, body: &pod.FindAll{}}, &pod.PodInfos{}); err != nil {
+			t.Fatalf("%s error %s", endpoint, err)
+		}
+		if !called {
+			t.Fatalf("%s handler not called", endpoint)
+		}
+	}
+	if len(auditRepository.logs) != 8 {
+		t.Fatalf("%d audit logs, want 8", len(auditRepository.logs))
+	}
+}
+
+func TestAuditFailedRolloutRecordsCommittedChange(t *testing.T) {
+	wrapper, auditRepository, podRepository := newTestWrapper(t)
+	// 操作已经提交，等待滚动更新失败后返回错误
+	handler := wrapper(func(ctx context.Context, req server.Request, rsp interface{}) error {
+		podModel, err := podRepository.FindPodByID(1)
+		if err != nil {
+			return err
+		}
+		podModel.PodImage = "nginx:bad"
+		if err := podRepository.UpdatePod(podModel); err != nil {
+			return err
+		}
+		rsp.(*pod.Response).OperationId = 7
+		return common.Unavailable("rollout web failed ProgressDeadlineExceeded")
+	})
+	request := &fakeRequest{endpoint: "PodService.UpdatePod", body: &pod.PodInfo{Id: 1, PodNamespace: "wepass", PodName: "web", Wait: true}}
+	if err := handler(context.TODO(), request, &pod.Response{}); err == nil {
+		t.Fatal("wrapper swallowed the handler error")
+	}
+	if len(auditRepository.logs) != 1 {
+		t.Fatalf("%d audit logs, want 1", len(auditRepository.logs))
+	}
+	log := auditRepository.logs[0]
+	if log.Error == "" || !strings.Contains(log.After, "nginx:bad") || !strings.Contains(log.Diff, "nginx:bad") {
+		t.Fatalf("audit log for a failed rollout %+v, want the committed change", log)
+	}
+}
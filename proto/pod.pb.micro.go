@@ -39,8 +39,23 @@ type PodService interface {
 	AddPod(ctx context.Context, in *PodInfo, opts ...client.CallOption) (*Response, error)
 	DeletePod(ctx context.Context, in *PodID, opts ...client.CallOption) (*Response, error)
 	FindPodByID(ctx context.Context, in *PodID, opts ...client.CallOption) (*PodInfo, error)
+	FindPodByName(ctx context.Context, in *FindPodByNameRequest, opts ...client.CallOption) (*PodInfo, error)
 	UpdatePod(ctx context.Context, in *PodInfo, opts ...client.CallOption) (*Response, error)
 	FindPodAll(ctx context.Context, in *FindAll, opts ...client.CallOption) (*PodInfos, error)
+	WatchPods(ctx context.Context, in *WatchPodsRequest, opts ...client.CallOption) (PodService_WatchPodsService, error)
+	ReconcileStatus(ctx context.Context, in *ReconcileStatusRequest, opts ...client.CallOption) (*ReconcileReport, error)
+	ImportPods(ctx context.Context, in *ImportPodsRequest, opts ...client.CallOption) (*ImportPodsResponse, error)
+	GetPodMetrics(ctx context.Context, in *PodID, opts ...client.CallOption) (*PodMetrics, error)
+	ListPodEvents(ctx context.Context, in *ListPodEventsRequest, opts ...client.CallOption) (*ClusterEvents, error)
+	ListDeletedPods(ctx context.Context, in *ListDeletedPodsRequest, opts ...client.CallOption) (*PodInfos, error)
+	RestorePod(ctx context.Context, in *PodID, opts ...client.CallOption) (*Response, error)
+	QueryAudit(ctx context.Context, in *QueryAuditRequest, opts ...client.CallOption) (*AuditLogs, error)
+	GetPodOperation(ctx context.Context, in *OperationID, opts ...client.CallOption) (*PodOperation, error)
+	GetPodHistory(ctx context.Context, in *GetPodHistoryRequest, opts ...client.CallOption) (*PodHistory, error)
+	ExportPods(ctx context.Context, in *ExportPodsRequest, opts ...client.CallOption) (*ExportPodsResponse, error)
+	ApplyManifest(ctx context.Context, in *ApplyManifestRequest, opts ...client.CallOption) (*ApplyManifestResponse, error)
+	BatchApply(ctx context.Context, in *BatchApplyRequest, opts ...client.CallOption) (*BatchResponse, error)
+	BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...client.CallOption) (*BatchResponse, error)
 }
 
 type podService struct {
@@ -85,6 +100,16 @@ func (c *podService) FindPodByID(ctx context.Context, in *PodID, opts ...client.
 	return out, nil
 }
 
+func (c *podService) FindPodByName(ctx context.Context, in *FindPodByNameRequest, opts ...client.CallOption) (*PodInfo, error) {
+	req := c.c.NewRequest(c.name, "PodService.FindPodByName", in)
+	out := new(PodInfo)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *podService) UpdatePod(ctx context.Context, in *PodInfo, opts ...client.CallOption) (*Response, error) {
 	req := c.c.NewRequest(c.name, "PodService.UpdatePod", in)
 	out := new(Response)
@@ -105,14 +130,208 @@ func (c *podService) FindPodAll(ctx context.Context, in *FindAll, opts ...client
 	return out, nil
 }
 
+func (c *podService) WatchPods(ctx context.Context, in *WatchPodsRequest, opts ...client.CallOption) (PodService_WatchPodsService, error) {
+	req := c.c.NewRequest(c.name, "PodService.WatchPods", &WatchPodsRequest{})
+	stream, err := c.c.Stream(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(in); err != nil {
+		return nil, err
+	}
+	return &podServiceWatchPods{stream}, nil
+}
+
+type PodService_WatchPodsService interface {
+	Context() context.Context
+	SendMsg(interface{}) error
+	RecvMsg(interface{}) error
+	Close() error
+	Recv() (*PodEvent, error)
+}
+
+type podServiceWatchPods struct {
+	stream client.Stream
+}
+
+func (x *podServiceWatchPods) Close() error {
+	return x.stream.Close()
+}
+
+func (x *podServiceWatchPods) Context() context.Context {
+	return x.stream.Context()
+}
+
+func (x *podServiceWatchPods) SendMsg(m interface{}) error {
+	return x.stream.Send(m)
+}
+
+func (x *podServiceWatchPods) RecvMsg(m interface{}) error {
+	return x.stream.Recv(m)
+}
+
+func (x *podServiceWatchPods) Recv() (*PodEvent, error) {
+	m := new(PodEvent)
+	err := x.stream.Recv(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *podService) ReconcileStatus(ctx context.Context, in *ReconcileStatusRequest, opts ...client.CallOption) (*ReconcileReport, error) {
+	req := c.c.NewRequest(c.name, "PodService.ReconcileStatus", in)
+	out := new(ReconcileReport)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) ImportPods(ctx context.Context, in *ImportPodsRequest, opts ...client.CallOption) (*ImportPodsResponse, error) {
+	req := c.c.NewRequest(c.name, "PodService.ImportPods", in)
+	out := new(ImportPodsResponse)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) GetPodMetrics(ctx context.Context, in *PodID, opts ...client.CallOption) (*PodMetrics, error) {
+	req := c.c.NewRequest(c.name, "PodService.GetPodMetrics", in)
+	out := new(PodMetrics)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) ListPodEvents(ctx context.Context, in *ListPodEventsRequest, opts ...client.CallOption) (*ClusterEvents, error) {
+	req := c.c.NewRequest(c.name, "PodService.ListPodEvents", in)
+	out := new(ClusterEvents)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) ListDeletedPods(ctx context.Context, in *ListDeletedPodsRequest, opts ...client.CallOption) (*PodInfos, error) {
+	req := c.c.NewRequest(c.name, "PodService.ListDeletedPods", in)
+	out := new(PodInfos)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) RestorePod(ctx context.Context, in *PodID, opts ...client.CallOption) (*Response, error) {
+	req := c.c.NewRequest(c.name, "PodService.RestorePod", in)
+	out := new(Response)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) QueryAudit(ctx context.Context, in *QueryAuditRequest, opts ...client.CallOption) (*AuditLogs, error) {
+	req := c.c.NewRequest(c.name, "PodService.QueryAudit", in)
+	out := new(AuditLogs)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) GetPodOperation(ctx context.Context, in *OperationID, opts ...client.CallOption) (*PodOperation, error) {
+	req := c.c.NewRequest(c.name, "PodService.GetPodOperation", in)
+	out := new(PodOperation)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) GetPodHistory(ctx context.Context, in *GetPodHistoryRequest, opts ...client.CallOption) (*PodHistory, error) {
+	req := c.c.NewRequest(c.name, "PodService.GetPodHistory", in)
+	out := new(PodHistory)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) ExportPods(ctx context.Context, in *ExportPodsRequest, opts ...client.CallOption) (*ExportPodsResponse, error) {
+	req := c.c.NewRequest(c.name, "PodService.ExportPods", in)
+	out := new(ExportPodsResponse)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) ApplyManifest(ctx context.Context, in *ApplyManifestRequest, opts ...client.CallOption) (*ApplyManifestResponse, error) {
+	req := c.c.NewRequest(c.name, "PodService.ApplyManifest", in)
+	out := new(ApplyManifestResponse)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) BatchApply(ctx context.Context, in *BatchApplyRequest, opts ...client.CallOption) (*BatchResponse, error) {
+	req := c.c.NewRequest(c.name, "PodService.BatchApply", in)
+	out := new(BatchResponse)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *podService) BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...client.CallOption) (*BatchResponse, error) {
+	req := c.c.NewRequest(c.name, "PodService.BatchDelete", in)
+	out := new(BatchResponse)
+	err := c.c.Call(ctx, req, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for PodService service
 
 type PodServiceHandler interface {
 	AddPod(context.Context, *PodInfo, *Response) error
 	DeletePod(context.Context, *PodID, *Response) error
 	FindPodByID(context.Context, *PodID, *PodInfo) error
+	FindPodByName(context.Context, *FindPodByNameRequest, *PodInfo) error
 	UpdatePod(context.Context, *PodInfo, *Response) error
 	FindPodAll(context.Context, *FindAll, *PodInfos) error
+	WatchPods(context.Context, *WatchPodsRequest, PodService_WatchPodsStream) error
+	ReconcileStatus(context.Context, *ReconcileStatusRequest, *ReconcileReport) error
+	ImportPods(context.Context, *ImportPodsRequest, *ImportPodsResponse) error
+	GetPodMetrics(context.Context, *PodID, *PodMetrics) error
+	ListPodEvents(context.Context, *ListPodEventsRequest, *ClusterEvents) error
+	ListDeletedPods(context.Context, *ListDeletedPodsRequest, *PodInfos) error
+	RestorePod(context.Context, *PodID, *Response) error
+	QueryAudit(context.Context, *QueryAuditRequest, *AuditLogs) error
+	GetPodOperation(context.Context, *OperationID, *PodOperation) error
+	GetPodHistory(context.Context, *GetPodHistoryRequest, *PodHistory) error
+	ExportPods(context.Context, *ExportPodsRequest, *ExportPodsResponse) error
+	ApplyManifest(context.Context, *ApplyManifestRequest, *ApplyManifestResponse) error
+	BatchApply(context.Context, *BatchApplyRequest, *BatchResponse) error
+	BatchDelete(context.Context, *BatchDeleteRequest, *BatchResponse) error
 }
 
 func RegisterPodServiceHandler(s server.Server, hdlr PodServiceHandler, opts ...server.HandlerOption) error {
@@ -120,8 +339,23 @@ func RegisterPodServiceHandler(s server.Server, hdlr PodServiceHandler, opts ...
 		AddPod(ctx context.Context, in *PodInfo, out *Response) error
 		DeletePod(ctx context.Context, in *PodID, out *Response) error
 		FindPodByID(ctx context.Context, in *PodID, out *PodInfo) error
+		FindPodByName(ctx context.Context, in *FindPodByNameRequest, out *PodInfo) error
 		UpdatePod(ctx context.Context, in *PodInfo, out *Response) error
 		FindPodAll(ctx context.Context, in *FindAll, out *PodInfos) error
+		WatchPods(ctx context.Context, stream server.Stream) error
+		ReconcileStatus(ctx context.Context, in *ReconcileStatusRequest, out *ReconcileReport) error
+		ImportPods(ctx context.Context, in *ImportPodsRequest, out *ImportPodsResponse) error
+		GetPodMetrics(ctx context.Context, in *PodID, out *PodMetrics) error
+		ListPodEvents(ctx context.Context, in *ListPodEventsRequest, out *ClusterEvents) error
+		ListDeletedPods(ctx context.Context, in *ListDeletedPodsRequest, out *PodInfos) error
+		RestorePod(ctx context.Context, in *PodID, out *Response) error
+		QueryAudit(ctx context.Context, in *QueryAuditRequest, out *AuditLogs) error
+		GetPodOperation(ctx context.Context, in *OperationID, out *PodOperation) error
+		GetPodHistory(ctx context.Context, in *GetPodHistoryRequest, out *PodHistory) error
+		ExportPods(ctx context.Context, in *ExportPodsRequest, out *ExportPodsResponse) error
+		ApplyManifest(ctx context.Context, in *ApplyManifestRequest, out *ApplyManifestResponse) error
+		BatchApply(ctx context.Context, in *BatchApplyRequest, out *BatchResponse) error
+		BatchDelete(ctx context.Context, in *BatchDeleteRequest, out *BatchResponse) error
 	}
 	type PodService struct {
 		podService
@@ -146,6 +380,10 @@ func (h *podServiceHandler) FindPodByID(ctx context.Context, in *PodID, out *Pod
 	return h.PodServiceHandler.FindPodByID(ctx, in, out)
 }
 
+func (h *podServiceHandler) FindPodByName(ctx context.Context, in *FindPodByNameRequest, out *PodInfo) error {
+	return h.PodServiceHandler.FindPodByName(ctx, in, out)
+}
+
 func (h *podServiceHandler) UpdatePod(ctx context.Context, in *PodInfo, out *Response) error {
 	return h.PodServiceHandler.UpdatePod(ctx, in, out)
 }
@@ -153,3 +391,95 @@ func (h *podServiceHandler) UpdatePod(ctx context.Context, in *PodInfo, out *Res
 func (h *podServiceHandler) FindPodAll(ctx context.Context, in *FindAll, out *PodInfos) error {
 	return h.PodServiceHandler.FindPodAll(ctx, in, out)
 }
+
+func (h *podServiceHandler) WatchPods(ctx context.Context, stream server.Stream) error {
+	m := new(WatchPodsRequest)
+	if err := stream.Recv(m); err != nil {
+		return err
+	}
+	return h.PodServiceHandler.WatchPods(ctx, m, &podServiceWatchPodsStream{stream})
+}
+
+type PodService_WatchPodsStream interface {
+	Context() context.Context
+	SendMsg(interface{}) error
+	RecvMsg(interface{}) error
+	Close() error
+	Send(*PodEvent) error
+}
+
+type podServiceWatchPodsStream struct {
+	stream server.Stream
+}
+
+func (x *podServiceWatchPodsStream) Close() error {
+	return x.stream.Close()
+}
+
+func (x *podServiceWatchPodsStream) Context() context.Context {
+	return x.stream.Context()
+}
+
+func (x *podServiceWatchPodsStream) SendMsg(m interface{}) error {
+	return x.stream.Send(m)
+}
+
+func (x *podServiceWatchPodsStream) RecvMsg(m interface{}) error {
+	return x.stream.Recv(m)
+}
+
+func (x *podServiceWatchPodsStream) Send(m *PodEvent) error {
+	return x.stream.Send(m)
+}
+
+func (h *podServiceHandler) ReconcileStatus(ctx context.Context, in *ReconcileStatusRequest, out *ReconcileReport) error {
+	return h.PodServiceHandler.ReconcileStatus(ctx, in, out)
+}
+
+func (h *podServiceHandler) ImportPods(ctx context.Context, in *ImportPodsRequest, out *ImportPodsResponse) error {
+	return h.PodServiceHandler.ImportPods(ctx, in, out)
+}
+
+func (h *podServiceHandler) GetPodMetrics(ctx context.Context, in *PodID, out *PodMetrics) error {
+	return h.PodServiceHandler.GetPodMetrics(ctx, in, out)
+}
+
+func (h *podServiceHandler) ListPodEvents(ctx context.Context, in *ListPodEventsRequest, out *ClusterEvents) error {
+	return h.PodServiceHandler.ListPodEvents(ctx, in, out)
+}
+
+func (h *podServiceHandler) ListDeletedPods(ctx context.Context, in *ListDeletedPodsRequest, out *PodInfos) error {
+	return h.PodServiceHandler.ListDeletedPods(ctx, in, out)
+}
+
+func (h *podServiceHandler) RestorePod(ctx context.Context, in *PodID, out *Response) error {
+	return h.PodServiceHandler.RestorePod(ctx, in, out)
+}
+
+func (h *podServiceHandler) QueryAudit(ctx context.Context, in *QueryAuditRequest, out *AuditLogs) error {
+	return h.PodServiceHandler.QueryAudit(ctx, in, out)
+}
+
+func (h *podServiceHandler) GetPodOperation(ctx context.Context, in *OperationID, out *PodOperation) error {
+	return h.PodServiceHandler.GetPodOperation(ctx, in, out)
+}
+
+func (h *podServiceHandler) GetPodHistory(ctx context.Context, in *GetPodHistoryRequest, out *PodHistory) error {
+	return h.PodServiceHandler.GetPodHistory(ctx, in, out)
+}
+
+func (h *podServiceHandler) ExportPods(ctx context.Context, in *ExportPodsRequest, out *ExportPodsResponse) error {
+	return h.PodServiceHandler.ExportPods(ctx, in, out)
+}
+
+func (h *podServiceHandler) ApplyManifest(ctx context.Context, in *ApplyManifestRequest, out *ApplyManifestResponse) error {
+	return h.PodServiceHandler.ApplyManifest(ctx, in, out)
+}
+
+func (h *podServiceHandler) BatchApply(ctx context.Context, in *BatchApplyRequest, out *BatchResponse) error {
+	return h.PodServiceHandler.BatchApply(ctx, in, out)
+}
+
+func (h *podServiceHandler) BatchDelete(ctx context.Context, in *BatchDeleteRequest, out *BatchResponse) error {
+	return h.PodServiceHandler.BatchDelete(ctx, in, out)
+}
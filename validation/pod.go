@@ -0,0 +1,204 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/DuanNengxin/wepass-pod/common"
+	"github.com/DuanNengxin/wepass-pod/domain/model"
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"math"
+	"strings"
+)
+
+var (
+	supportedPullPolicies = []string{"Always", "IfNotPresent", "Never"}
+	// Deployment 只支持 Always
+	supportedRestartPolicies = []string{"Always"}
+	supportedPodTypes        = []string{"Recreate", "Rolling"}
+	supportedProtocols       = []string{"TCP", "UDP", "SCTP"}
+	// 由 wepass 管理的标签，和 service.LabelAppName 等保持一致，不能由用户设置
+	reservedLabelKeys = []string{"app-name", "wepass.io/managed-by", "wepass.io/team"}
+)
+
+// ValidatePodInfo 返回所有字段错误，路径使用 PodInfo 的字段名，比如 pod_port[0].container_port
+// 可选的字段为空时使用默认值，不报错
+func ValidatePodInfo(info *pod.PodInfo) field.ErrorList {
+	var errs field.ErrorList
+	// pod 名称同时是容器名称和 app-name 标签的值，只能是 DNS-1123 label
+	errs = append(errs, validateDNS1123Label(field.NewPath("pod_name"), info.PodName)...)
+	errs = append(errs, validateDNS1123Label(field.NewPath("pod_namespace"), info.PodNamespace)...)
+	if !model.IsSupportedCluster(info.PodCluster) {
+		errs = append(errs, field.NotSupported(field.NewPath("pod_cluster"), info.PodCluster, model.SupportedClusters))
+	}
+	if info.PodTeamId != "" {
+		for _, msg := range k8svalidation.IsValidLabelValue(info.PodTeamId) {
+			errs = append(errs, field.Invalid(field.NewPath("pod_team_id"), info.PodTeamId, msg))
+		}
+	}
+	if strings.TrimSpace(info.PodImage) == "" {
+		errs = append(errs, field.Required(field.NewPath("pod_image"), ""))
+	} else if strings.ContainsAny(info.PodImage, " \t\n") {
+		errs = append(errs, field.Invalid(field.NewPath("pod_image"), info.PodImage, "must not contain whitespace"))
+	}
+	if info.PodReplicas <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("pod_replicas"), info.PodReplicas, "must be greater than 0"))
+	}
+	errs = append(errs, validateResource(field.NewPath("pod_cpu_min"), field.NewPath("pod_cpu_max"), info.PodCpuMin, info.PodCpuMax)...)
+	errs = append(errs, validateResource(field.NewPath("pod_memory_min"), field.NewPath("pod_memory_max"), info.PodMemoryMin, info.PodMemoryMax)...)
+	errs = append(errs, validateEnum(field.NewPath("pod_pull_policy"), info.PodPullPolicy, supportedPullPolicies)...)
+	errs = append(errs, validateEnum(field.NewPath("pod_restart"), info.PodRestart, supportedRestartPolicies)...)
+	errs = append(errs, validateEnum(field.NewPath("pod_type"), info.PodType, supportedPodTypes)...)
+	errs = append(errs, validatePorts(field.NewPath("pod_port"), info.PodPort)...)
+	errs = append(errs, validateEnv(field.NewPath("pod_env"), info.PodEnv)...)
+	errs = append(errs, validateLabels(field.NewPath("pod_label"), info.PodLabel)...)
+	if info.WaitTimeoutSeconds < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("wait_timeout_seconds"), info.WaitTimeoutSeconds, "must not be negative"))
+	}
+	return errs
+}
+
+// ValidatePodUpdate 名称、命名空间和集群确定了 Deployment，修改之后 worker 会创建新的 Deployment，旧的不再被管理
+func ValidatePodUpdate(info *pod.PodInfo, current *model.Pod) field.ErrorList {
+	var errs field.ErrorList
+	if info.PodName != current.PodName {
+		errs = append(errs, field.Invalid(field.NewPath("pod_name"), info.PodName, "field is immutable"))
+	}
+	if info.PodNamespace != current.PodNamespace {
+		errs = append(errs, field.Invalid(field.NewPath("pod_namespace"), info.PodNamespace, "field is immutable"))
+	}
+	if model.ClusterOrDefault(info.PodCluster) != model.ClusterOrDefault(current.PodCluster) {
+		errs = append(errs, field.Invalid(field.NewPath("pod_cluster"), info.PodCluster, "field is immutable"))
+	}
+	return errs
+}
+
+// ToError 没有错误时返回 nil，否则返回带所有字段错误的 InvalidArgument
+func ToError(errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	typed := common.InvalidArgument("invalid pod: %d field errors", len(errs))
+	for _, err := range errs {
+		typed.WithField(err.Field, err.ErrorBody())
+	}
+	return typed
+}
+
+func validateDNS1123Label(path *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return field.ErrorList{field.Required(path, "")}
+	}
+	var errs field.ErrorList
+	for _, msg := range k8svalidation.IsDNS1123Label(value) {
+		errs = append(errs, field.Invalid(path, value, msg))
+	}
+	return errs
+}
+
+// validateResource 资源在生成 Deployment 时用 resource.MustParse 转换，非法的数字会导致 panic
+func validateResource(minPath, maxPath *field.Path, min, max float32) field.ErrorList {
+	var errs field.ErrorList
+	if !isFinite(min) {
+		errs = append(errs, field.Invalid(minPath, fmt.Sprint(min), "must be a finite number"))
+	}
+	if !isFinite(max) {
+		errs = append(errs, field.Invalid(maxPath, fmt.Sprint(max), "must be a finite number"))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if min < 0 {
+		errs = append(errs, field.Invalid(minPath, min, "must not be negative"))
+	}
+	if max < 0 {
+		errs = append(errs, field.Invalid(maxPath, max, "must not be negative"))
+	}
+	if min > max {
+		errs = append(errs, field.Invalid(minPath, min, fmt.Sprintf("must be less than or equal to %s %v", maxPath, max)))
+	}
+	return errs
+}
+
+func isFinite(number float32) bool {
+	return !math.IsNaN(float64(number)) && !math.IsInf(float64(number), 0)
+}
+
+func validateEnum(path *field.Path, value string, supported []string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	for _, s := range supported {
+		if value == s {
+			return nil
+		}
+	}
+	return field.ErrorList{field.NotSupported(path, value, supported)}
+}
+
+func validatePorts(path *field.Path, ports []*pod.PodPort) field.ErrorList {
+	var errs field.ErrorList
+	seen := map[string]bool{}
+	for i, port := range ports {
+		portPath := path.Index(i)
+		for _, msg := range k8svalidation.IsValidPortNum(int(port.ContainerPort)) {
+			errs = append(errs, field.Invalid(portPath.Child("container_port"), port.ContainerPort, msg))
+		}
+		errs = append(errs, validateEnum(portPath.Child("protocol"), port.Protocol, supportedProtocols)...)
+		// 没有设置协议时是 TCP
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "TCP"
+		}
+		key := fmt.Sprintf("%d/%s", port.ContainerPort, protocol)
+		if seen[key] {
+			errs = append(errs, field.Duplicate(portPath, key))
+		}
+		seen[key] = true
+	}
+	return errs
+}
+
+func validateEnv(path *field.Path, envs []*pod.PodEnv) field.ErrorList {
+	var errs field.ErrorList
+	seen := map[string]bool{}
+	for i, env := range envs {
+		keyPath := path.Index(i).Child("env_key")
+		if env.EnvKey == "" {
+			errs = append(errs, field.Required(keyPath, ""))
+			continue
+		}
+		for _, msg := range k8svalidation.IsEnvVarName(env.EnvKey) {
+			errs = append(errs, field.Invalid(keyPath, env.EnvKey, msg))
+		}
+		if seen[env.EnvKey] {
+			errs = append(errs, field.Duplicate(keyPath, env.EnvKey))
+		}
+		seen[env.EnvKey] = true
+	}
+	return errs
+}
+
+func validateLabels(path *field.Path, labels []*pod.PodLabel) field.ErrorList {
+	var errs field.ErrorList
+	seen := map[string]bool{}
+	for i, label := range labels {
+		keyPath := path.Index(i).Child("label_key")
+		for _, msg := range k8svalidation.IsQualifiedName(label.LabelKey) {
+			errs = append(errs, field.Invalid(keyPath, label.LabelKey, msg))
+		}
+		for _, key := range reservedLabelKeys {
+			if label.LabelKey == key {
+				errs = append(errs, field.Forbidden(keyPath, fmt.Sprintf("%s is managed by wepass", key)))
+			}
+		}
+		for _, msg := range k8svalidation.IsValidLabelValue(label.LabelValue) {
+			errs = append(errs, field.Invalid(path.Index(i).Child("label_value"), label.LabelValue, msg))
+		}
+		if seen[label.LabelKey] {
+			errs = append(errs, field.Duplicate(keyPath, label.LabelKey))
+		}
+		seen[label.LabelKey] = true
+	}
+	return errs
+}
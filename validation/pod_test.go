@@ -0,0 +1,75 @@
+package validation
+
+import (
+	pod "github.com/DuanNengxin/wepass-pod/proto"
+	"math"
+	"testing"
+)
+
+func newValidPodInfo() *pod.PodInfo {
+	return &pod.PodInfo{
+		PodNamespace:  "wepass",
+		PodName:       "web",
+		PodTeamId:     "team-a",
+		PodCpuMax:     1,
+		PodCpuMin:     0.5,
+		PodReplicas:   2,
+		PodMemoryMax:  268435456,
+		PodMemoryMin:  134217728,
+		PodPullPolicy: "IfNotPresent",
+		PodRestart:    "Always",
+		PodType:       "Rolling",
+		PodImage:      "nginx:1.25",
+		PodPort:       []*pod.PodPort{{ContainerPort: 80, Protocol: "TCP"}, {ContainerPort: 80, Protocol: "UDP"}},
+		PodEnv:        []*pod.PodEnv{{EnvKey: "LOG_LEVEL", EnvValue: "debug"}},
+		PodLabel:      []*pod.PodLabel{{LabelKey: "example.com/tier", LabelValue: "web"}},
+	}
+}
+
+func TestValidatePodInfo(t *testing.T) {
+	if errs := ValidatePodInfo(newValidPodInfo()); len(errs) != 0 {
+		t.Fatalf("valid pod info errors %v", errs)
+	}
+	// 可选字段为空时使用默认值
+	minimal := &pod.PodInfo{PodNamespace: "wepass", PodName: "web", PodImage: "nginx", PodReplicas: 1}
+	if errs := ValidatePodInfo(minimal); len(errs) != 0 {
+		t.Fatalf("minimal pod info errors %v", errs)
+	}
+
+	for _, test := range []struct {
+		field  string
+		modify func(info *pod.PodInfo)
+	}{
+		{"pod_name", func(info *pod.PodInfo) { info.PodName = "Web_1" }},
+		{"pod_name", func(info *pod.PodInfo) { info.PodName = "" }},
+		{"pod_namespace", func(info *pod.PodInfo) { info.PodNamespace = "a.b" }},
+		{"pod_cluster", func(info *pod.PodInfo) { info.PodCluster = "backup" }},
+		{"pod_team_id", func(info *pod.PodInfo) { info.PodTeamId = "team a" }},
+		{"pod_image", func(info *pod.PodInfo) { info.PodImage = " " }},
+		{"pod_replicas", func(info *pod.PodInfo) { info.PodReplicas = 0 }},
+		{"pod_cpu_min", func(info *pod.PodInfo) { info.PodCpuMin = 2 }},
+		{"pod_cpu_max", func(info *pod.PodInfo) { info.PodCpuMax = float32(math.NaN()) }},
+		{"pod_memory_min", func(info *pod.PodInfo) { info.PodMemoryMin = -1 }},
+		{"pod_pull_policy", func(info *pod.PodInfo) { info.PodPullPolicy = "Sometimes" }},
+		{"pod_restart", func(info *pod.PodInfo) { info.PodRestart = "Never" }},
+		{"pod_type", func(info *pod.PodInfo) { info.PodType = "BlueGreen" }},
+		{"pod_port[0].container_port", func(info *pod.PodInfo) { info.PodPort[0].ContainerPort = 70000 }},
+		{"pod_port[1].protocol", func(info *pod.PodInfo) { info.PodPort[1].Protocol = "HTTP" }},
+		{"pod_port[1]", func(info *pod.PodInfo) { info.PodPort[1].Protocol = "" }},
+		{"pod_env[1].env_key", func(info *pod.PodInfo) {
+			info.PodEnv = append(info.PodEnv, &pod.PodEnv{EnvKey: "LOG_LEVEL", EnvValue: "info"})
+		}},
+		{"pod_env[0].env_key", func(info *pod.PodInfo) { info.PodEnv[0].EnvKey = "1=A" }},
+		{"pod_label[0].label_key", func(info *pod.PodInfo) { info.PodLabel[0].LabelKey = "-tier" }},
+		{"pod_label[0].label_key", func(info *pod.PodInfo) { info.PodLabel[0].LabelKey = "wepass.io/team" }},
+		{"pod_label[0].label_value", func(info *pod.PodInfo) { info.PodLabel[0].LabelValue = "a b" }},
+		{"wait_timeout_seconds", func(info *pod.PodInfo) { info.WaitTimeoutSeconds = -1 }},
+	} {
+		info := newValidPodInfo()
+		test.modify(info)
+		errs := ValidatePodInfo(info)
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Fatalf("field %s errors %v, want 1 error", test.field, errs)
+		}
+	}
+}